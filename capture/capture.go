@@ -0,0 +1,130 @@
+// Package capture reads and writes the capture files recorded by the proxy.
+//
+// A capture file starts with the magic "MGOSNIFF" and a version byte, then
+// a sequence of records:
+//
+//	kind       1 byte, the record kind in the low 4 bits and the direction in the high 4 bits
+//	connID     uvarint
+//	timestamp  varint, nanoseconds since the previous record
+//	length     uvarint
+//	data       length bytes
+//
+// data is the raw wire bytes for data records, the remote address for open
+// records and empty for close and gap records.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magic   = "MGOSNIFF"
+	version = 1
+
+	// maxRecordSize protects against allocating huge buffers for corrupted files
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+// Kind is the type of a record
+type Kind uint8
+
+const (
+	// KindOpen starts a connection, Data holds the remote address
+	KindOpen Kind = 1
+	// KindData holds bytes of one direction of a connection
+	KindData Kind = 2
+	// KindClose ends a connection
+	KindClose Kind = 3
+	// KindGap tells that some data of one direction was not recorded
+	KindGap Kind = 4
+)
+
+// Direction of the traffic of a data or gap record
+type Direction uint8
+
+const (
+	ClientToServer Direction = 0
+	ServerToClient Direction = 1
+)
+
+func (d Direction) String() string {
+	if d == ServerToClient {
+		return "server->client"
+	}
+	return "client->server"
+}
+
+// Record is one entry of a capture file
+type Record struct {
+	Kind      Kind
+	ConnID    uint64
+	Direction Direction
+	Time      time.Time
+	Data      []byte
+}
+
+// Reader reads records from a capture file
+type Reader struct {
+	r    *bufio.Reader
+	last int64
+}
+
+// NewReader create a reader, the file header is checked immediately
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("read capture header failed: %v", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a mgosniff capture file")
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported capture version: %d", header[len(magic)])
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record, io.EOF is returned at the end of the file
+func (reader *Reader) Next() (*Record, error) {
+	kind, err := reader.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{Kind: Kind(kind & 0x0f), Direction: Direction(kind >> 4)}
+	if record.ConnID, err = binary.ReadUvarint(reader.r); err != nil {
+		return nil, truncated(err)
+	}
+	delta, err := binary.ReadVarint(reader.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	reader.last += delta
+	record.Time = time.Unix(0, reader.last)
+
+	length, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("invalid record length: %d", length)
+	}
+	record.Data = make([]byte, length)
+	if _, err := io.ReadFull(reader.r, record.Data); err != nil {
+		return nil, truncated(err)
+	}
+	return record, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlockingWriter blocks the first write until release is closed
+type testBlockingWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *testBlockingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.started:
+	default:
+		close(w.started)
+		<-w.release
+	}
+	return w.Buffer.Write(p)
+}
+
+// testReadAll returns the records of the capture file b and the error that ended the reading
+func testReadAll(t *testing.T, b []byte) ([]*Record, error) {
+	reader, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// testSummary returns a line such as "data 1 client->server abc" for record
+func testSummary(record *Record) string {
+	kind := map[Kind]string{KindOpen: "open", KindData: "data", KindClose: "close", KindGap: "gap"}[record.Kind]
+	return fmt.Sprintf("%s %d %s %s", kind, record.ConnID, record.Direction, record.Data)
+}
+
+func TestRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1645344931, 0)
+	records := []*Record{
+		{Kind: KindOpen, ConnID: 1, Time: start, Data: []byte("10.0.0.1:52117")},
+		{Kind: KindData, ConnID: 1, Time: start.Add(time.Millisecond), Data: []byte("request")},
+		{Kind: KindOpen, ConnID: 2, Time: start.Add(2 * time.Millisecond), Data: []byte("10.0.0.2:41000")},
+		{Kind: KindData, ConnID: 1, Direction: ServerToClient, Time: start.Add(3 * time.Millisecond), Data: []byte("reply")},
+		// the records of the connections are not recorded in time order
+		{Kind: KindGap, ConnID: 2, Direction: ServerToClient, Time: start.Add(time.Millisecond)},
+		{Kind: KindClose, ConnID: 1, Time: start.Add(time.Hour)},
+		{Kind: KindClose, ConnID: 2, Time: start.Add(time.Hour + time.Nanosecond)},
+	}
+	for _, record := range records {
+		writer.add(record)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := testReadAll(t, out.Bytes())
+	if err != io.EOF {
+		t.Fatalf("read %d records, error %v", len(read), err)
+	}
+	if len(read) != len(records) {
+		t.Fatalf("read %d records, expect %d", len(read), len(records))
+	}
+	for i, record := range records {
+		if testSummary(read[i]) != testSummary(record) || !read[i].Time.Equal(record.Time) {
+			t.Errorf("record %d: %s at %v, expect %s at %v", i, testSummary(read[i]), read[i].Time, testSummary(record), record.Time)
+		}
+	}
+}
+
+func TestGapAfterDrops(t *testing.T) {
+	out := &testBlockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	writer, err := NewWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file blocks on the open record, the queue fills up behind it
+	writer.Open(1, "10.0.0.1:52117")
+	<-out.started
+	for i := 0; i < queueSize; i++ {
+		writer.Write(1, ServerToClient, []byte("queued"))
+	}
+	writer.Write(1, ServerToClient, []byte("dropped"))
+	writer.Write(1, ServerToClient, []byte("dropped"))
+	writer.Write(1, ClientToServer, []byte("dropped"))
+	if writer.Dropped() != 3 {
+		t.Errorf("%d records dropped, expect 3", writer.Dropped())
+	}
+
+	close(out.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(writer.records) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("queue not written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writer.Write(1, ServerToClient, []byte("after"))
+	writer.Write(1, ServerToClient, []byte("next"))
+	writer.CloseConn(1)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := testReadAll(t, out.Bytes())
+	if err != io.EOF {
+		t.Fatalf("read %d records, error %v", len(read), err)
+	}
+	if len(read) != queueSize+5 {
+		t.Fatalf("read %d records, expect %d", len(read), queueSize+5)
+	}
+	var summaries []string
+	for _, record := range append(read[:1], read[queueSize+1:]...) {
+		summaries = append(summaries, testSummary(record))
+	}
+	// a single gap is written, only in the direction written to again
+	expected := []string{
+		"open 1 client->server 10.0.0.1:52117",
+		"gap 1 server->client ",
+		"data 1 server->client after",
+		"data 1 server->client next",
+		"close 1 client->server ",
+	}
+	if strings.Join(summaries, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("records\n%s\nexpect\n%s", strings.Join(summaries, "\n"), strings.Join(expected, "\n"))
+	}
+	// the gap is at the time of the data that follows it
+	if gap := read[queueSize+1]; !gap.Time.Equal(read[queueSize+2].Time) {
+		t.Errorf("gap at %v, data at %v", gap.Time, read[queueSize+2].Time)
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.add(&Record{Kind: KindOpen, ConnID: 1, Time: time.Unix(0, 1), Data: []byte("10.0.0.1:52117")})
+	writer.add(&Record{Kind: KindData, ConnID: 1, Time: time.Unix(0, 2), Data: []byte("request")})
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the kind, connID, timestamp and length of the open record fit in a byte each
+	openEnd := len(magic) + 1 + 4 + len("10.0.0.1:52117")
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"in the data", out.Len() - 3},
+		{"after the kind", openEnd + 1},
+		{"before the length", openEnd + 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			read, err := testReadAll(t, out.Bytes()[:test.size])
+			if len(read) != 1 || read[0].Kind != KindOpen {
+				t.Errorf("read %d records", len(read))
+			}
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("error %v, expect %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
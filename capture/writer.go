@@ -0,0 +1,176 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueSize is the max records waiting to be written before new records are dropped
+const queueSize = 4096
+
+type gapKey struct {
+	connID    uint64
+	direction Direction
+}
+
+// Writer writes records to a capture file in a background goroutine,
+// recording never blocks the caller: when the file can't keep up the
+// records are dropped and a gap record is written in their place
+type Writer struct {
+	w       *bufio.Writer
+	closer  io.Closer
+	records chan *Record
+	done    chan struct{}
+	last    int64
+	err     error
+
+	lock      sync.Mutex
+	closed    bool
+	gaps      map[gapKey]bool
+	dropped   uint64
+	buf       []byte
+	closeOnce sync.Once
+}
+
+// NewWriter create a writer, if w is an io.Closer it is closed by Close
+func NewWriter(w io.Writer) (*Writer, error) {
+	writer := &Writer{
+		w:       bufio.NewWriterSize(w, 64*1024),
+		records: make(chan *Record, queueSize),
+		done:    make(chan struct{}),
+		gaps:    make(map[gapKey]bool),
+		buf:     make([]byte, 1+3*binary.MaxVarintLen64),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		writer.closer = closer
+	}
+
+	if _, err := writer.w.WriteString(magic); err != nil {
+		return nil, err
+	}
+	if err := writer.w.WriteByte(version); err != nil {
+		return nil, err
+	}
+
+	go writer.loop()
+	return writer, nil
+}
+
+// Open records a new connection
+func (writer *Writer) Open(connID uint64, remoteAddr string) {
+	writer.add(&Record{Kind: KindOpen, ConnID: connID, Time: time.Now(), Data: []byte(remoteAddr)})
+}
+
+// Write records data of one direction of a connection, data is copied
+func (writer *Writer) Write(connID uint64, direction Direction, data []byte) {
+	writer.add(&Record{
+		Kind:      KindData,
+		ConnID:    connID,
+		Direction: direction,
+		Time:      time.Now(),
+		Data:      append([]byte(nil), data...),
+	})
+}
+
+// CloseConn records the end of a connection
+func (writer *Writer) CloseConn(connID uint64) {
+	writer.add(&Record{Kind: KindClose, ConnID: connID, Time: time.Now()})
+}
+
+// Dropped returns the number of records dropped
+func (writer *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&writer.dropped)
+}
+
+// Close flush the records queued and close the file
+func (writer *Writer) Close() error {
+	writer.closeOnce.Do(func() {
+		writer.lock.Lock()
+		writer.closed = true
+		close(writer.records)
+		writer.lock.Unlock()
+	})
+	<-writer.done
+
+	if writer.closer != nil {
+		if err := writer.closer.Close(); err != nil && writer.err == nil {
+			writer.err = err
+		}
+	}
+	return writer.err
+}
+
+func (writer *Writer) add(record *Record) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.closed {
+		return
+	}
+
+	key := gapKey{connID: record.ConnID, direction: record.Direction}
+	if record.Kind == KindData && writer.gaps[key] {
+		if !writer.enqueue(&Record{Kind: KindGap, ConnID: record.ConnID, Direction: record.Direction, Time: record.Time}) {
+			writer.drop(key, record)
+			return
+		}
+		delete(writer.gaps, key)
+	}
+
+	if !writer.enqueue(record) {
+		writer.drop(key, record)
+	}
+}
+
+func (writer *Writer) enqueue(record *Record) bool {
+	select {
+	case writer.records <- record:
+		return true
+	default:
+		return false
+	}
+}
+
+func (writer *Writer) drop(key gapKey, record *Record) {
+	atomic.AddUint64(&writer.dropped, 1)
+	if record.Kind == KindData {
+		writer.gaps[key] = true
+	}
+}
+
+func (writer *Writer) loop() {
+	defer close(writer.done)
+	for record := range writer.records {
+		if writer.err != nil {
+			continue
+		}
+		writer.err = writer.write(record)
+		if len(writer.records) == 0 && writer.err == nil {
+			// nothing else to write for now, keep the file up to date
+			writer.err = writer.w.Flush()
+		}
+	}
+	if writer.err == nil {
+		writer.err = writer.w.Flush()
+	}
+}
+
+func (writer *Writer) write(record *Record) error {
+	ts := record.Time.UnixNano()
+	buf := writer.buf
+	buf[0] = byte(record.Kind) | byte(record.Direction)<<4
+	n := 1
+	n += binary.PutUvarint(buf[n:], record.ConnID)
+	n += binary.PutVarint(buf[n:], ts-writer.last)
+	n += binary.PutUvarint(buf[n:], uint64(len(record.Data)))
+	writer.last = ts
+
+	if _, err := writer.w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := writer.w.Write(record.Data)
+	return err
+}
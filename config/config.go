@@ -0,0 +1,241 @@
+// Package config reads the config files which define the routes of the proxy,
+// each with its own listen address, upstream, TLS settings, filter and output.
+//
+// The files are TOML, for example
+//
+//	metrics = ":9216"
+//
+//	[[route]]
+//	name = "app"
+//	listen = ":7017"
+//	upstream = "10.0.0.5:27017"
+//	filter = "db=shop !cmd=hello"
+//	redact = ["field=**.password"]
+//
+//	[route.upstream_tls]
+//	enabled = true
+//	ca = "/etc/ssl/mongo-ca.pem"
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the content of a config file
+type Config struct {
+	// Metrics is the address the Prometheus metrics of all routes are served on
+	Metrics string
+	// Admin is the address of the admin API
+	Admin string
+	// Digest is the number of query shapes of all routes reported at exit
+	Digest int
+	// Timeout is how long requests wait for their reply before they are reported
+	Timeout time.Duration
+	Routes  []Route
+}
+
+// Route is a listener proxied to an upstream with its own output
+type Route struct {
+	// Name is written in the output of the route, it is the listen address by default
+	Name     string
+	Listen   string
+	Upstream string
+	// Output is log, json or none
+	Output string
+	// JSON is how documents are written, relaxed, canonical or shell
+	JSON string
+	// File is where JSON lines are appended, stdout when empty
+	File       string
+	Filter     string
+	Slow       time.Duration
+	Explain    bool
+	Redact     []string
+	RedactAuth bool
+	ReplicaSet bool
+	Advertise  string
+	TLS        ListenerTLS
+	// UpstreamTLS is the TLS of the connections to the upstream
+	UpstreamTLS UpstreamTLS
+}
+
+// ListenerTLS makes a route accept TLS clients when Cert is set, client
+// certificates are required when ClientCA is set
+type ListenerTLS struct {
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	ClientCA string `toml:"client_ca"`
+}
+
+// Enabled reports whether the listener accepts TLS
+func (t ListenerTLS) Enabled() bool {
+	return t.Cert != "" || t.Key != "" || t.ClientCA != ""
+}
+
+// UpstreamTLS makes a route connect to its upstream with TLS
+type UpstreamTLS struct {
+	Enabled bool
+	// CA verifies the upstream instead of the system certificates
+	CA string
+	// Cert and Key are the client certificate sent to the upstream
+	Cert string
+	Key  string
+	// SNI is the server name sent and verified, the host of the upstream by default
+	SNI      string
+	Insecure bool
+}
+
+// DefaultRoute returns the settings of a route before the config file or the flags set them
+func DefaultRoute() Route {
+	return Route{Listen: ":7017", Upstream: "127.0.0.1:27017", Output: "log", JSON: "relaxed", RedactAuth: true}
+}
+
+// Load read a config file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Parse parse the content of a config file
+func Parse(data string) (*Config, error) {
+	var f file
+	md, err := toml.Decode(data, &f)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("unknown key: %s", strings.Join(keys, ", "))
+	}
+
+	c := &Config{
+		Metrics: f.Metrics,
+		Admin:   f.Admin,
+		Digest:  f.Digest,
+		Timeout: f.Timeout.Duration,
+	}
+	for _, fr := range f.Routes {
+		r := DefaultRoute()
+		r.Name, r.Listen = fr.Name, fr.Listen
+		if fr.Upstream != nil {
+			r.Upstream = *fr.Upstream
+		}
+		if fr.Output != nil {
+			r.Output = *fr.Output
+		}
+		if fr.JSON != nil {
+			r.JSON = *fr.JSON
+		}
+		r.File, r.Filter = fr.File, fr.Filter
+		r.Slow, r.Explain = fr.Slow.Duration, fr.Explain
+		r.Redact = fr.Redact
+		if fr.RedactAuth != nil {
+			r.RedactAuth = *fr.RedactAuth
+		}
+		r.ReplicaSet, r.Advertise = fr.ReplicaSet, fr.Advertise
+		if fr.TLS != nil {
+			r.TLS = *fr.TLS
+		}
+		if u := fr.UpstreamTLS; u != nil {
+			// a [route.upstream_tls] table enables TLS unless it says otherwise
+			r.UpstreamTLS = UpstreamTLS{Enabled: u.Enabled == nil || *u.Enabled, CA: u.CA, Cert: u.Cert, Key: u.Key, SNI: u.SNI, Insecure: u.Insecure}
+		}
+		if r.Name == "" {
+			r.Name = r.Listen
+		}
+		c.Routes = append(c.Routes, r)
+	}
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("no route")
+	}
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+	for _, r := range c.Routes {
+		if r.Listen == "" {
+			return fmt.Errorf("route %s: missing listen", r.Name)
+		}
+		if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+			return fmt.Errorf("route %s: invalid listen: %v", r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate route name: %s", r.Name)
+		}
+		if listens[r.Listen] {
+			return fmt.Errorf("route %s: listen %s is used by another route", r.Name, r.Listen)
+		}
+		names[r.Name], listens[r.Listen] = true, true
+		if r.File != "" && r.Output != "json" {
+			return fmt.Errorf("route %s: file is only supported with json output", r.Name)
+		}
+	}
+	return nil
+}
+
+// file is the layout of a config file, the keys with a default are pointers
+// so that an absent key can be told from a zero value
+type file struct {
+	Metrics string      `toml:"metrics"`
+	Admin   string      `toml:"admin"`
+	Digest  int         `toml:"digest"`
+	Timeout duration    `toml:"timeout"`
+	Routes  []fileRoute `toml:"route"`
+}
+
+type fileRoute struct {
+	Name        string           `toml:"name"`
+	Listen      string           `toml:"listen"`
+	Upstream    *string          `toml:"upstream"`
+	Output      *string          `toml:"output"`
+	JSON        *string          `toml:"json"`
+	File        string           `toml:"file"`
+	Filter      string           `toml:"filter"`
+	Slow        duration         `toml:"slow"`
+	Explain     bool             `toml:"explain"`
+	Redact      []string         `toml:"redact"`
+	RedactAuth  *bool            `toml:"redact_auth"`
+	ReplicaSet  bool             `toml:"replica_set"`
+	Advertise   string           `toml:"advertise"`
+	TLS         *ListenerTLS     `toml:"tls"`
+	UpstreamTLS *fileUpstreamTLS `toml:"upstream_tls"`
+}
+
+type fileUpstreamTLS struct {
+	Enabled  *bool  `toml:"enabled"`
+	CA       string `toml:"ca"`
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	SNI      string `toml:"sni"`
+	Insecure bool   `toml:"insecure"`
+}
+
+// duration is a duration written as a string such as "100ms"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	if d.Duration, err = time.ParseDuration(string(text)); err != nil {
+		return fmt.Errorf("expected a duration such as \"100ms\": %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(`
+metrics = ":9216"
+admin = "127.0.0.1:9217"
+digest = 10
+timeout = "30s"
+
+[[route]]
+name = "app"
+listen = ":7017"
+upstream = "10.0.0.5:27017"
+filter = "!cmd=hello,isMaster"
+redact = ["field=**.password", 'value=\d{16}']
+redact_auth = false
+
+[route.tls]
+cert = "proxy.pem"
+key = "proxy.key"
+client_ca = "clients-ca.pem"
+
+[[route]]
+listen = ":7018"
+output = "json"
+file = "analytics.jsonl"
+slow = "100ms"
+explain = true
+upstream_tls = { ca = "mongo-ca.pem", sni = "analytics.internal" }
+
+[[route]]
+listen = ":7019"
+upstream_tls.enabled = false
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Metrics != ":9216" || c.Admin != "127.0.0.1:9217" || c.Digest != 10 || c.Timeout != 30*time.Second {
+		t.Errorf("config %+v", c)
+	}
+	if len(c.Routes) != 3 {
+		t.Fatalf("%d routes, expect 3", len(c.Routes))
+	}
+
+	app := c.Routes[0]
+	if app.Name != "app" || app.Upstream != "10.0.0.5:27017" || app.Filter != "!cmd=hello,isMaster" || app.RedactAuth ||
+		len(app.Redact) != 2 || app.Redact[1] != `value=\d{16}` || app.UpstreamTLS.Enabled {
+		t.Errorf("route app %+v", app)
+	}
+	if app.TLS != (ListenerTLS{Cert: "proxy.pem", Key: "proxy.key", ClientCA: "clients-ca.pem"}) {
+		t.Errorf("route app tls %+v", app.TLS)
+	}
+
+	// the name is the listen address and the keys not set have their default
+	analytics := c.Routes[1]
+	if analytics.Name != ":7018" || analytics.Upstream != "127.0.0.1:27017" || analytics.Output != "json" ||
+		analytics.JSON != "relaxed" || !analytics.RedactAuth || analytics.Slow != 100*time.Millisecond || !analytics.Explain {
+		t.Errorf("route analytics %+v", analytics)
+	}
+	if analytics.UpstreamTLS != (UpstreamTLS{Enabled: true, CA: "mongo-ca.pem", SNI: "analytics.internal"}) {
+		t.Errorf("route analytics upstream tls %+v", analytics.UpstreamTLS)
+	}
+	if c.Routes[2].UpstreamTLS.Enabled || c.Routes[2].Output != "log" {
+		t.Errorf("route :7019 %+v", c.Routes[2])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"empty", "", "no route"},
+		{"unknown key", "[[route]]\nlisten = \":7017\"\nfilters = \"db=shop\"", "unknown key: route.filters"},
+		{"unknown tls key", "[[route]]\nlisten = \":7017\"\n[route.tls]\nca = \"ca.pem\"", "unknown key: route.tls.ca"},
+		{"unknown keys", "metric = \":9216\"\n[[route]]\nlisten = \":7017\"\nupstreams = \"x\"", "unknown key: metric, route.upstreams"},
+		{"string expected", "[[route]]\nlisten = 7017", "listen"},
+		{"integer expected", "digest = \"10\"\n[[route]]\nlisten = \":7017\"", "digest"},
+		{"strings expected", "[[route]]\nlisten = \":7017\"\nredact = [1]", "redact"},
+		{"table instead of array", "[route]\nlisten = \":7017\"", "route"},
+		{"invalid duration", "[[route]]\nlisten = \":7017\"\nslow = \"fast\"", "expected a duration such as \"100ms\""},
+		{"duplicate key", "[[route]]\nlisten = \":7017\"\nlisten = \":7018\"", "listen"},
+		{"syntax", "[[route]\nlisten = \":7017\"", "toml: line"},
+		{"missing listen", "[[route]]\nname = \"app\"", "route app: missing listen"},
+		{"invalid listen", "[[route]]\nlisten = \"7017\"", "route 7017: invalid listen"},
+		{"duplicate name", "[[route]]\nname = \"a\"\nlisten = \":1\"\n[[route]]\nname = \"a\"\nlisten = \":2\"", "duplicate route name: a"},
+		{"duplicate listen", "[[route]]\nlisten = \":1\"\n[[route]]\nname = \"b\"\nlisten = \":1\"", "route b: listen :1 is used by another route"},
+		{"file without json", "[[route]]\nlisten = \":1\"\nfile = \"out.jsonl\"", "route :1: file is only supported with json output"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.data)
+			if err == nil {
+				t.Fatal("accepted")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %q, expect %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// maxPendingExplains is the number of slow operations waiting for explain,
+// beyond it they are written without plan
+const maxPendingExplains = 64
+
+var (
+	errExplainBusy   = errors.New("too many slow operations waiting for explain")
+	errExplainClosed = errors.New("explain closed by a reload")
+)
+
+// explainer runs explain with executionStats for slow operations on its own
+// connection to the server, one explain at a time. The connection doesn't
+// authenticate, so explain fails against servers with authentication
+type explainer struct {
+	addr    string
+	tls     *tls.Config
+	pending chan struct{}
+
+	lock    sync.Mutex
+	conn    net.Conn
+	replies chan mongo.Message
+	// closed is closed after the replies of the connection are all parsed
+	closed chan struct{}
+	// stop is closed by reset so the parser doesn't wait for replies nobody reads
+	stop      chan struct{}
+	requestID int32
+	// done is set by close, the explains after it fail without connecting
+	done bool
+}
+
+// newExplainer create an explainer connecting to addr, with TLS when tlsConfig is set
+func newExplainer(addr string, tlsConfig *tls.Config) *explainer {
+	return &explainer{addr: addr, tls: tlsConfig, pending: make(chan struct{}, maxPendingExplains)}
+}
+
+// explain returns the winning plan of req, or nil if req is not a find,
+// aggregate or count
+func (e *explainer) explain(req mongo.Message) (*mongo.Plan, error) {
+	db, cmd, ok := mongo.ExplainCommand(req)
+	if !ok {
+		return nil, nil
+	}
+	select {
+	case e.pending <- struct{}{}:
+		defer func() { <-e.pending }()
+	default:
+		return nil, errExplainBusy
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.done {
+		return nil, errExplainClosed
+	}
+	if e.conn == nil {
+		if err := e.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	e.requestID++
+	raw, err := mongo.EncodeMsg(e.requestID, append(cmd, bson.DocElem{Name: "$db", Value: db}))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.conn.Write(raw); err != nil {
+		e.reset()
+		return nil, err
+	}
+	reply, err := waitReply(e.replies, e.closed, e.requestID)
+	if err != nil {
+		// the reply may still come, it would be read as the reply of the next explain
+		e.reset()
+		return nil, err
+	}
+	return mongo.ParsePlan(reply)
+}
+
+// dial connect to the server and parse its replies, e.lock must be held
+func (e *explainer) dial() error {
+	conn, err := dialUpstream(e.addr, e.tls, *timeout)
+	if err != nil {
+		return err
+	}
+	replies := make(chan mongo.Message, 1)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	parser := mongo.NewBlockingParser(e.addr, newRecorder(e.addr, func(msg mongo.Message) {
+		select {
+		case replies <- msg:
+		case <-stop:
+		}
+	}))
+	go func() {
+		_, _ = io.Copy(parser, conn)
+		parser.Close()
+		parser.Wait()
+		close(closed)
+	}()
+	e.conn, e.replies, e.closed, e.stop = conn, replies, closed, stop
+	return nil
+}
+
+// close close the connection after the running explain, the later explains
+// of the slow operations still written by a replaced output fail
+func (e *explainer) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.done = true
+	if e.conn != nil {
+		e.reset()
+	}
+}
+
+// reset close the connection, the next explain connects again, e.lock must be held
+func (e *explainer) reset() {
+	close(e.stop)
+	e.conn.Close()
+	e.conn = nil
+}
@@ -0,0 +1,279 @@
+// Package filter selects the operations written by the sinks with expressions
+// such as "db=shop coll=order* !cmd=getMore or error".
+//
+// An expression is made of clauses separated by "or", an operation matches
+// when it matches all the terms of one of the clauses. A term is negated with
+// a leading "!". The terms are
+//
+//	db=GLOB       database
+//	coll=GLOB     collection
+//	ns=GLOB       database.collection
+//	op=GLOB       opCode name such as OP_MSG or QUERY, OP_ is optional
+//	cmd=GLOB      command name such as find, legacy queries are find
+//	client=GLOB   client address
+//	app=GLOB      application name the client sent in its handshake
+//	error         the reply is an error, or there was no reply
+//	slower=DUR    the reply took longer than DUR, such as 100ms
+//	has=PATH      the command document has the field PATH, such as filter.tenantId
+//	doc.PATH=GLOB the field PATH of the command document matches GLOB
+//
+// Globs are matched case insensitively, they may list alternatives separated by
+// commas such as cmd=find,aggregate.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// Filter is a parsed expression
+type Filter struct {
+	clauses [][]term
+}
+
+type term struct {
+	negate bool
+	// exchange is set for the terms which need the reply
+	exchange bool
+	match    func(t *target) bool
+}
+
+// target is what the terms are matched against
+type target struct {
+	op       *mongo.Operation
+	opName   string
+	command  bson.M
+	client   string
+	app      string
+	answered bool
+	failed   bool
+	duration time.Duration
+}
+
+// Parse parse an expression, the empty expression matches everything
+func Parse(expr string) (*Filter, error) {
+	f := &Filter{}
+	var clause []term
+	negate := false
+	for _, token := range strings.Fields(expr) {
+		switch strings.ToLower(token) {
+		case "or":
+			if len(clause) == 0 || negate {
+				return nil, fmt.Errorf("missing term before or")
+			}
+			f.clauses = append(f.clauses, clause)
+			clause = nil
+			continue
+		case "and":
+			continue
+		case "not", "!":
+			negate = !negate
+			continue
+		}
+		for strings.HasPrefix(token, "!") {
+			negate = !negate
+			token = token[1:]
+		}
+		t, err := parseTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		t.negate = negate
+		negate = false
+		clause = append(clause, t)
+	}
+	if negate {
+		return nil, fmt.Errorf("missing term after not")
+	}
+	if len(clause) > 0 {
+		f.clauses = append(f.clauses, clause)
+	} else if len(f.clauses) > 0 {
+		return nil, fmt.Errorf("missing term after or")
+	}
+	return f, nil
+}
+
+func parseTerm(token string) (term, error) {
+	if token == "error" {
+		return term{exchange: true, match: func(t *target) bool { return t.answered && t.failed }}, nil
+	}
+
+	i := strings.IndexByte(token, '=')
+	if i <= 0 {
+		return term{}, fmt.Errorf("invalid filter term: %s", token)
+	}
+	key, value := token[:i], token[i+1:]
+	if value == "" {
+		return term{}, fmt.Errorf("missing value in filter term: %s", token)
+	}
+	globs := strings.Split(strings.ToLower(value), ",")
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return term{}, fmt.Errorf("invalid pattern in filter term %s: %v", token, err)
+		}
+	}
+	matchField := func(field func(t *target) string) term {
+		return term{match: func(t *target) bool { return matchGlobs(globs, field(t)) }}
+	}
+
+	switch {
+	case key == "db":
+		return matchField(func(t *target) string { return t.op.Database }), nil
+	case key == "coll":
+		return matchField(func(t *target) string { return t.op.Collection }), nil
+	case key == "ns":
+		return matchField(func(t *target) string { return t.op.Namespace() }), nil
+	case key == "op":
+		for i, glob := range globs {
+			globs[i] = strings.TrimPrefix(glob, "op_")
+		}
+		return matchField(func(t *target) string { return strings.TrimPrefix(strings.ToLower(t.opName), "op_") }), nil
+	case key == "cmd":
+		return matchField(func(t *target) string { return t.op.Command }), nil
+	case key == "client":
+		return matchField(func(t *target) string { return t.client }), nil
+	case key == "app":
+		return matchField(func(t *target) string { return t.app }), nil
+	case key == "slower":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return term{}, fmt.Errorf("invalid duration in filter term %s: %v", token, err)
+		}
+		return term{exchange: true, match: func(t *target) bool { return t.answered && t.duration > d }}, nil
+	case key == "has":
+		fieldPath := strings.Split(value, ".")
+		return term{match: func(t *target) bool { return len(lookup(t.command, fieldPath)) > 0 }}, nil
+	case strings.HasPrefix(key, "doc."):
+		fieldPath := strings.Split(strings.TrimPrefix(key, "doc."), ".")
+		return term{match: func(t *target) bool {
+			for _, v := range lookup(t.command, fieldPath) {
+				if matchGlobs(globs, valueString(v)) {
+					return true
+				}
+			}
+			return false
+		}}, nil
+	}
+	return term{}, fmt.Errorf("unknown filter term: %s", token)
+}
+
+// NeedsReply reports whether the filter has terms about the reply, such as
+// error and slower, which can only be matched against exchanges
+func (f *Filter) NeedsReply() bool {
+	for _, clause := range f.clauses {
+		for _, t := range clause {
+			if t.exchange {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchExchange reports whether the request of ex matches, app is the
+// application name of the client
+func (f *Filter) MatchExchange(ex *mongo.Exchange, app string) bool {
+	t := &target{op: &mongo.Operation{}, client: ex.RemoteAddr, app: app}
+	if ex.Request != nil {
+		t = newTarget(ex.Request, ex.RemoteAddr, app)
+	}
+	t.answered = ex.Response != nil || ex.Unanswered
+	t.failed = ex.Unanswered || !ex.OK
+	t.duration = ex.Duration
+	return f.match(t)
+}
+
+// MatchRequest reports whether a request matches, the terms about the reply
+// don't match
+func (f *Filter) MatchRequest(req mongo.Message, client string, app string) bool {
+	return f.match(newTarget(req, client, app))
+}
+
+// MatchCursor reports whether the operation which opened c matches
+func (f *Filter) MatchCursor(c *mongo.Cursor, app string) bool {
+	op := &mongo.Operation{Command: c.Command}
+	if i := strings.IndexByte(c.Namespace, '.'); i >= 0 {
+		op.Database, op.Collection = c.Namespace[:i], c.Namespace[i+1:]
+	} else {
+		op.Database = c.Namespace
+	}
+	if op.Command == "QUERY" {
+		op.Command = "find"
+	}
+	return f.match(&target{op: op, client: c.RemoteAddr, app: app})
+}
+
+func newTarget(req mongo.Message, client string, app string) *target {
+	t := &target{opName: mongo.OpName(req), client: client, app: app, command: mongo.CommandDocument(req)}
+	t.op = mongo.Classify(req)
+	if t.op == nil {
+		t.op = &mongo.Operation{}
+	}
+	if t.command == nil && t.op.Filter != nil {
+		// the filter of a legacy query or write
+		t.command = bson.M{"filter": t.op.Filter}
+	}
+	return t
+}
+
+func (f *Filter) match(t *target) bool {
+	if len(f.clauses) == 0 {
+		return true
+	}
+	for _, clause := range f.clauses {
+		matched := true
+		for _, term := range clause {
+			if term.match(t) == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlobs(globs []string, s string) bool {
+	s = strings.ToLower(s)
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the values at fieldPath in doc, the path goes through the
+// documents of arrays such as the statements of an update
+func lookup(v interface{}, fieldPath []string) []interface{} {
+	if len(fieldPath) == 0 {
+		return []interface{}{v}
+	}
+	switch v := v.(type) {
+	case bson.M:
+		if field, ok := v[fieldPath[0]]; ok {
+			return lookup(field, fieldPath[1:])
+		}
+	case []interface{}:
+		var values []interface{}
+		for _, elem := range v {
+			values = append(values, lookup(elem, fieldPath)...)
+		}
+		return values
+	}
+	return nil
+}
+
+func valueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return mongo.ExtJSON(v, mongo.Relaxed)
+}
@@ -0,0 +1,189 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// testRequest returns the OP_MSG running body, decoded like the proxy does
+func testRequest(t *testing.T, body bson.D) mongo.Message {
+	raw, err := mongo.EncodeMsg(1, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mongo.ParseMessage(raw, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMatch(t *testing.T) {
+	find := testRequest(t, bson.D{{Name: "find", Value: "orders"},
+		{Name: "filter", Value: bson.M{"status": "A", "items": []interface{}{bson.M{"sku": "x1"}, bson.M{"sku": "x2"}}}},
+		{Name: "$db", Value: "shop"}})
+	insert := testRequest(t, bson.D{{Name: "insert", Value: "users"},
+		{Name: "documents", Value: []interface{}{bson.M{"name": "ann"}}}, {Name: "$db", Value: "shop"}})
+	update := testRequest(t, bson.D{{Name: "update", Value: "orders"},
+		{Name: "updates", Value: []interface{}{bson.M{"q": bson.M{"tenant": "t1"}, "u": bson.M{"$set": bson.M{"x": 1}}}}},
+		{Name: "$db", Value: "shop"}})
+	hello := testRequest(t, bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})
+	reply := testRequest(t, bson.D{{Name: "ok", Value: 1.0}})
+
+	// ok is answered in 10ms, failed is answered with an error, slow in 200ms
+	type outcome int
+	const (
+		ok outcome = iota
+		failed
+		slow
+		unanswered
+	)
+	tests := []struct {
+		expr    string
+		request mongo.Message
+		outcome outcome
+		match   bool
+	}{
+		{"", hello, ok, true},
+		{"db=shop", find, ok, true},
+		{"db=shop", hello, ok, false},
+		{"coll=ord*", find, ok, true},
+		{"ns=shop.users", insert, ok, true},
+		{"cmd=FIND", find, ok, true},
+		{"op=msg", find, ok, true},
+		{"op=OP_MSG", find, ok, true},
+		{"op=query", find, ok, false},
+		{"client=10.0.0.*", find, ok, true},
+		{"app=mongodb*", find, ok, true},
+		{"app=compass", find, ok, false},
+
+		// negation
+		{"!cmd=hello", hello, ok, false},
+		{"!cmd=hello", find, ok, true},
+		{"not cmd=hello", hello, ok, false},
+		{"! cmd=hello", hello, ok, false},
+		{"!!cmd=hello", hello, ok, true},
+		{"not !cmd=hello", hello, ok, true},
+		{"NOT cmd=hello", find, ok, true},
+
+		// and binds tighter than or
+		{"db=shop coll=users", insert, ok, true},
+		{"db=shop and coll=users", find, ok, false},
+		{"cmd=hello or db=shop coll=orders", find, ok, true},
+		{"cmd=hello or db=shop coll=orders", insert, ok, false},
+		{"cmd=hello or db=shop coll=orders", hello, ok, true},
+		{"db=shop !coll=orders or error", insert, ok, true},
+		{"db=shop !coll=orders or error", find, ok, false},
+		{"db=shop !coll=orders or error", find, failed, true},
+		{"!db=shop or cmd=hello", hello, ok, true},
+		{"!db=shop or cmd=find", insert, ok, false},
+		{"db=shop OR cmd=hello", hello, ok, true},
+
+		// comma alternatives
+		{"cmd=find,insert", find, ok, true},
+		{"cmd=find,insert", insert, ok, true},
+		{"cmd=find,insert", hello, ok, false},
+		{"!cmd=find,insert", hello, ok, true},
+		{"coll=users,ord*", find, ok, true},
+
+		// document paths
+		{"doc.filter.status=a", find, ok, true},
+		{"doc.filter.status=b", find, ok, false},
+		{"doc.filter.items.sku=x2", find, ok, true},
+		{"doc.filter.items.sku=x3", find, ok, false},
+		{"doc.updates.q.tenant=t1", update, ok, true},
+		{"doc.updates.u.$set.x=1", update, ok, true},
+		{"doc.documents.name=ann,bob", insert, ok, true},
+		{"has=filter.items.sku", find, ok, true},
+		{"has=filter.missing", find, ok, false},
+		{"has=updates.q", update, ok, true},
+
+		// reply
+		{"error", find, ok, false},
+		{"error", find, failed, true},
+		{"error", find, unanswered, true},
+		{"!error", find, failed, false},
+		{"slower=100ms", find, slow, true},
+		{"slower=100ms", find, ok, false},
+	}
+	for _, test := range tests {
+		f, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		ex := &mongo.Exchange{RemoteAddr: "10.0.0.1:52117", Request: test.request, Response: reply, OK: true, Duration: 10 * time.Millisecond}
+		switch test.outcome {
+		case failed:
+			ex.OK = false
+		case slow:
+			ex.Duration = 200 * time.Millisecond
+		case unanswered:
+			ex.Response, ex.Unanswered = nil, true
+		}
+		if match := f.MatchExchange(ex, "MongoDB Shell"); match != test.match {
+			t.Errorf("%q on %s %v: match %v, expect %v", test.expr, test.request, test.outcome, match, test.match)
+		}
+	}
+}
+
+func TestMatchRequest(t *testing.T) {
+	find := testRequest(t, bson.D{{Name: "find", Value: "orders"}, {Name: "$db", Value: "shop"}})
+	for expr, match := range map[string]bool{"cmd=find": true, "error": false, "slower=1ms": false, "cmd=find or error": true} {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.MatchRequest(find, "10.0.0.1:52117", "") != match {
+			t.Errorf("%q: match %v", expr, !match)
+		}
+	}
+}
+
+func TestNeedsReply(t *testing.T) {
+	for expr, needs := range map[string]bool{"": false, "db=shop": false, "error": true, "db=shop or slower=1s": true, "!error": true} {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.NeedsReply() != needs {
+			t.Errorf("%q: needs reply %v", expr, !needs)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"or db=shop", "missing term before or"},
+		{"db=shop or or cmd=find", "missing term before or"},
+		{"db=shop ! or cmd=find", "missing term before or"},
+		{"db=shop or", "missing term after or"},
+		{"db=shop !", "missing term after not"},
+		{"db=shop not", "missing term after not"},
+		{"db", "invalid filter term: db"},
+		{"=shop", "invalid filter term: =shop"},
+		{"db=", "missing value in filter term: db="},
+		{"coll=[a", "invalid pattern in filter term coll=[a: syntax error in pattern"},
+		{"cmd=find,[", "invalid pattern in filter term cmd=find,["},
+		{"slower=fast", "invalid duration in filter term slower=fast"},
+		{"foo=bar", "unknown filter term: foo=bar"},
+		{"errors", "invalid filter term: errors"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.expr)
+		if err == nil {
+			t.Errorf("%q accepted", test.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %q, expect %q", test.expr, err, test.err)
+		}
+	}
+}
@@ -3,8 +3,9 @@ module github.com/ma6174/mgosniff
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
-	github.com/klauspost/compress v1.14.3 // indirect
+	github.com/klauspost/compress v1.14.3
 	github.com/mongodb/mongonet v0.0.0-20220124145415-75addb6dfcea // indirect
 	github.com/mylxsw/asteria v0.0.0-20220215024857-ed6a52a3d70d
 	go.mongodb.org/mongo-driver v1.8.3 // indirect
@@ -1,20 +1,57 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/config"
+	"github.com/ma6174/mgosniff/filter"
 	"github.com/ma6174/mgosniff/mongo"
-	"github.com/mongodb/mongonet"
+	"github.com/ma6174/mgosniff/sink"
 	"github.com/mylxsw/asteria/log"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	listenAddr = flag.String("l", ":7017", "listen port")
-	dstAddr    = flag.String("d", "127.0.0.1:27017", "proxy to dest addr")
+	listenAddr    = flag.String("l", ":7017", "listen port")
+	dstAddr       = flag.String("d", "127.0.0.1:27017", "proxy to dest addr")
+	timeout       = flag.Duration("t", mongo.DefaultReplyTimeout, "report requests without reply after this timeout")
+	writeFile     = flag.String("w", "", "record proxied traffic to file unredacted, read it back with the read command")
+	format        = flag.String("o", "log", "output format, log, json (one JSON object per message) or none")
+	jsonMode      = flag.String("j", "relaxed", "how documents are written, relaxed or canonical extended JSON, or shell")
+	digestTop     = flag.Int("digest", 0, "report the top N query shapes by total time at exit, 0 to disable")
+	metricsAddr   = flag.String("metrics", "", "serve Prometheus metrics at /metrics on this address, such as :9216")
+	slowThreshold = flag.Duration("slow", 0, "only write the operations slower than this, 0 writes every message")
+	explainSlow   = flag.Bool("explain", false, "explain slow find, aggregate and count on a side connection to the dest addr and add the winning plan, the connection is not authenticated")
+	filterExpr    = flag.String("filter", "", "only write the operations matching this expression, such as 'db=shop !cmd=hello or error'")
+	redactAuth    = flag.Bool("redact-auth", true, "redact the credentials of saslStart, saslContinue and authenticate")
+	// redactRules are the -redact flags
+	redactRules ruleList
+	// output receives the messages and exchanges of the read and pcap commands
+	output sink.Sink
+	// outputFiles are the files of the routes writing JSON lines to a file, by path
+	outputFiles     = make(map[string]*os.File)
+	outputFilesLock sync.Mutex
+	// digest groups the operations by query shape when -digest is set
+	digest *sink.Digest
+	// metrics counts the proxied traffic when -metrics is set
+	metrics *sink.Metrics
+	// exitHooks run on SIGINT or SIGTERM before the proxy exits
+	exitHooks []func()
+	// captureWriter records the proxied traffic when -w is set
+	captureWriter *capture.Writer
+	// lastConnID is the id of the last accepted connection
+	lastConnID uint64
 	bufferPool = sync.Pool{
 		New: func() interface{} {
 			return make([]byte, 4096)
@@ -22,8 +59,47 @@ var (
 	}
 )
 
-func handleConn(conn net.Conn) {
-	dst, err := net.Dial("tcp", *dstAddr)
+// redactUsage is the help of the -redact flags
+const redactUsage = "redact values in the output, field=GLOB, hash=GLOB or value=REGEX, may be repeated; error messages other than duplicate keys are only redacted by value rules"
+
+func init() {
+	flag.Var(&redactRules, "redact", redactUsage)
+}
+
+// ruleList is a flag which may be repeated
+type ruleList []string
+
+func (l *ruleList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *ruleList) Set(rule string) error {
+	*l = append(*l, rule)
+	return nil
+}
+
+// handleConn proxy conn to upstream, or to the upstream of r when it is empty,
+// and parse what goes through with the output of r
+func handleConn(conn net.Conn, r *route, upstream string) {
+	// the settings of r are read once, a reload applies to the next connections
+	settings := r.current()
+	if upstream == "" {
+		upstream = settings.Upstream
+	}
+	if settings.listenerTLS != nil {
+		// the parsers see the decrypted messages, a failed handshake is logged here
+		// rather than as a read error
+		tc := tls.Server(conn, settings.listenerTLS)
+		conn = tc
+		_ = tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			log.Errorf("[%s] TLS handshake failed: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		_ = tc.SetDeadline(time.Time{})
+	}
+	dst, err := dialUpstream(upstream, settings.dialTLS, 0)
 	if err != nil {
 		log.Errorf("[%s] unexpected err:%v, close connection:%s\n", conn.RemoteAddr(), err, conn.RemoteAddr())
 		conn.Close()
@@ -38,48 +114,16 @@ func handleConn(conn net.Conn) {
 		dst.Close()
 	}
 
-	pr, pw := io.Pipe()
+	connID := atomic.AddUint64(&lastConnID, 1)
+	s := newSession(connID, conn.RemoteAddr().String(), false, r.output)
 	defer func() {
-		pr.Close()
-		pw.Close()
+		go s.close()
 	}()
 
-	go func() {
-		for {
-			message, err := mongonet.ReadMessage(pr)
-			if err != nil {
-				panic(err)
-			}
-
-			fmt.Println(message.Header().OpCode)
-			switch message.Header().OpCode {
-			case mongonet.OP_MSG, mongonet.OP_MSG_LEGACY:
-				msg := message.(*mongonet.MessageMessage)
-				bodyDoc, err := msg.BodyDoc()
-				if err != nil {
-					panic(err)
-				}
-
-				log.WithFields(log.Fields{
-					"bodyDoc": bodyDoc.String(),
-				}).Info("OP_MSG")
-			case mongonet.OP_INSERT:
-				msg := message.(*mongonet.InsertMessage)
-				log.WithFields(log.Fields{
-					"namespace": msg.Namespace,
-					"docs":      msg.Docs,
-				}).Info("OP_INSERT")
-			case mongonet.OP_QUERY:
-				msg := message.(*mongonet.QueryMessage)
-				log.F(log.M{
-					"namespace": msg.Namespace,
-					"project":   msg.Project,
-					"query":     msg.Query,
-				}).Info("OP_QUERY")
-
-			}
-		}
-	}()
+	if captureWriter != nil {
+		captureWriter.Open(connID, conn.RemoteAddr().String())
+		defer captureWriter.CloseConn(connID)
+	}
 
 	cp := func(dst io.Writer, src io.Reader, srcAddr string, cb func(data []byte)) {
 		p := bufferPool.Get().([]byte)
@@ -109,29 +153,276 @@ func handleConn(conn net.Conn) {
 		}
 		bufferPool.Put(p)
 	}
-	go cp(conn, dst, dst.RemoteAddr().String(), func(data []byte) {
-		//pw.Write(data)
+	var toClient io.Writer = conn
+	if r.topology != nil {
+		// the parser sees the member addresses sent by the server
+		toClient = mongo.NewTopologyRewriter(conn, r.topology.rewriter(upstream))
+	}
+	go cp(toClient, dst, dst.RemoteAddr().String(), func(data []byte) {
+		if captureWriter != nil {
+			captureWriter.Write(connID, capture.ServerToClient, data)
+		}
+		if metrics != nil {
+			metrics.Bytes(capture.ServerToClient, len(data))
+		}
+		_, _ = s.server.Write(data)
 	})
 	cp(dst, conn, conn.RemoteAddr().String(), func(data []byte) {
-		pw.Write(data)
+		if captureWriter != nil {
+			captureWriter.Write(connID, capture.ClientToServer, data)
+		}
+		if metrics != nil {
+			metrics.Bytes(capture.ClientToServer, len(data))
+		}
+		_, _ = s.client.Write(data)
 	})
 }
 
+// newRecorder create a recorder which log the errors of one connection and pass the messages to next
+func newRecorder(remoteAddr string, next func(msg mongo.Message)) mongo.Recorder {
+	return func(msg mongo.Message, err error) {
+		if err != nil {
+			log.Errorf("[%s] %v", remoteAddr, err)
+			if metrics != nil {
+				metrics.ParseError(err)
+			}
+			return
+		}
+		next(msg)
+	}
+}
+
+// newSink create the sink of an output format writing JSON to w, documents are rendered
+// in jsonMode, JSON is written for each exchange instead of each message when exchanges
+// is set. The lines are named after route when it is set
+func newSink(format string, jsonMode string, exchanges bool, w io.Writer, route string) (sink.Sink, error) {
+	mode, err := mongo.ParseJSONMode(jsonMode)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "log":
+		return sink.Log{Mode: mode, Route: route}, nil
+	case "json":
+		s := sink.NewJSONLines(w, mode)
+		if exchanges {
+			s = sink.NewJSONExchanges(w, mode)
+		}
+		s.Route = route
+		return s, nil
+	case "none":
+		return sink.Discard{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+// setupOutput create the output sink of the read and pcap commands from the flags
+func setupOutput() error {
+	setupStats()
+	s, err := newOutput(flagRoute(), nil)
+	if err != nil {
+		return err
+	}
+	output = withStats(s)
+	return nil
+}
+
+// setupStats create the digest and the metrics of all routes if -digest or -metrics is set
+func setupStats() {
+	if *digestTop > 0 {
+		digest = sink.NewDigest()
+	}
+	if *metricsAddr != "" {
+		metrics = sink.NewMetrics()
+	}
+}
+
+// withStats returns s teed with the digest and the metrics, they see all the
+// operations whatever the route writes
+func withStats(s sink.Sink) sink.Sink {
+	sinks := sink.Tee{s}
+	if digest != nil {
+		sinks = append(sinks, digest)
+	}
+	if metrics != nil {
+		sinks = append(sinks, metrics)
+	}
+	if len(sinks) > 1 {
+		return sinks
+	}
+	return s
+}
+
+// newOutput create the output sink of a route, only the slow operations and the
+// operations matching its filter are written, the slow ones are explained by e when it is set
+func newOutput(c config.Route, e *explainer) (sink.Sink, error) {
+	expr, err := filter.Parse(c.Filter)
+	if err != nil {
+		return nil, err
+	}
+	redact, err := newRedactor(c.Redact, c.RedactAuth)
+	if err != nil {
+		return nil, err
+	}
+	w := io.Writer(os.Stdout)
+	if c.File != "" {
+		if w, err = openOutputFile(c.File); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSink(c.Output, c.JSON, c.Slow > 0 || expr.NeedsReply(), w, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	if redact != nil {
+		// the filter and explain see the values, only the output is redacted
+		s = &sink.Redact{Next: s, Redactor: redact}
+	}
+	if c.Slow > 0 {
+		slow := &sink.Slow{Next: s, Threshold: c.Slow}
+		if e != nil {
+			slow.Explain = e.explain
+		}
+		s = slow
+	}
+	if c.Filter != "" {
+		s = sink.NewFilter(s, expr)
+	}
+	return s, nil
+}
+
+// openOutputFile open a file the JSON lines are appended to, a file is opened once
+// and kept open so the outputs replaced by a reload can finish writing
+func openOutputFile(path string) (io.Writer, error) {
+	outputFilesLock.Lock()
+	defer outputFilesLock.Unlock()
+	if f, ok := outputFiles[path]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	outputFiles[path] = f
+	return f, nil
+}
+
+// newRedactor create a redactor, it is nil when nothing is redacted
+func newRedactor(rules []string, auth bool) (*mongo.Redactor, error) {
+	r, err := mongo.NewRedactor(rules, auth)
+	if err != nil || !r.Enabled() {
+		return nil, err
+	}
+	return r, nil
+}
+
+// serveMetrics serve the metrics on -metrics
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			log.Errorf("serve metrics failed: %v", err)
+		}
+	}()
+}
+
+// reportDigest write the top query shapes to stdout if -digest is set
+func reportDigest() {
+	if digest != nil {
+		digest.Report(os.Stdout, *digestTop)
+	}
+}
+
+// handleExitSignals run the exit hooks and exit on SIGINT or SIGTERM
+func handleExitSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		for _, hook := range exitHooks {
+			hook()
+		}
+		os.Exit(0)
+	}()
+}
+
+// startCapture create the capture file and close it at exit so the records
+// queued are not lost
+func startCapture(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	captureWriter, err = capture.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	exitHooks = append(exitHooks, func() {
+		if err := captureWriter.Close(); err != nil {
+			log.Errorf("write capture file failed: %v", err)
+		}
+		if dropped := captureWriter.Dropped(); dropped > 0 {
+			log.Warningf("%d records dropped from capture file %s", dropped, path)
+		}
+	})
+	return nil
+}
+
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pcap":
+			analyzePcap(os.Args[2:])
+			return
+		case "read":
+			readCapture(os.Args[2:])
+			return
+		case "replay":
+			replayCapture(os.Args[2:])
+			return
+		case "top":
+			runTop(os.Args[2:])
+			return
+		}
+	}
 
-	log.Debugf("%s listen at %s, proxy to mongodb server %s\n", os.Args[0], *listenAddr, *dstAddr)
-	ln, err := net.Listen("tcp", *listenAddr)
+	flag.Parse()
+	routes, err := setupRoutes()
 	if err != nil {
-		log.Errorf("listen failed:", err)
+		log.Errorf("%v", err)
 		return
 	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Errorf("accept connection failed:", err)
-			continue
+	exitHooks = append(exitHooks, reportDigest)
+	if metrics != nil {
+		serveMetrics()
+	}
+
+	if *writeFile != "" {
+		if err := startCapture(*writeFile); err != nil {
+			log.Errorf("create capture file failed: %v", err)
+			return
 		}
-		go handleConn(conn)
+		for _, r := range routes {
+			if len(r.current().Redact) > 0 {
+				log.Warningf("capture file %s holds the traffic unredacted, the redaction rules only apply to the output", *writeFile)
+				break
+			}
+		}
+	}
+
+	handleExitSignals()
+	if err := serveRoutes(routes); err != nil {
+		log.Errorf("listen failed: %v", err)
+		return
+	}
+	handleReloadSignal()
+	if *adminAddr != "" {
+		serveAdmin()
 	}
+	// the routes are served until the proxy exits, a reload may stop any of them
+	select {}
 }
@@ -0,0 +1,151 @@
+package mongo
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBufferSize is the max bytes waiting in a parser's buffer, data written
+// when the buffer is full will be dropped instead of blocking the writer
+const DefaultBufferSize = 16 * 1024 * 1024
+
+// errGap is returned by buffer.Read when some data before the next bytes was dropped
+var errGap = errors.New("buffer overflow, data dropped")
+
+type chunk struct {
+	data []byte
+	gap  bool
+	time time.Time
+}
+
+// buffer is a bounded, non-blocking queue between the proxy and the parser
+type buffer struct {
+	chunks       chan chunk
+	current      []byte
+	currentTime  time.Time
+	limit        int64
+	blocking     bool
+	pending      int64
+	gap          int32
+	dropped      uint64
+	droppedBytes uint64
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newBuffer(limit int64) *buffer {
+	return &buffer{
+		chunks: make(chan chunk, 1024),
+		limit:  limit,
+		closed: make(chan struct{}),
+	}
+}
+
+// Write copy p to the buffer, it never blocks, p is dropped if the buffer is full
+func (b *buffer) Write(p []byte) (n int, err error) {
+	return b.writeWithTime(p, time.Now())
+}
+
+// writeWithTime is the same as Write, t is the time p was received
+func (b *buffer) writeWithTime(p []byte, t time.Time) (n int, err error) {
+	if len(p) == 0 || b.isClosed() {
+		return len(p), nil
+	}
+
+	if b.blocking {
+		c := chunk{data: append([]byte(nil), p...), time: t, gap: atomic.CompareAndSwapInt32(&b.gap, 1, 0)}
+		atomic.AddInt64(&b.pending, int64(len(p)))
+		select {
+		case b.chunks <- c:
+		case <-b.closed:
+		}
+		return len(p), nil
+	}
+
+	if atomic.LoadInt64(&b.pending)+int64(len(p)) > b.limit {
+		b.drop(len(p))
+		return len(p), nil
+	}
+
+	c := chunk{data: make([]byte, len(p)), time: t}
+	copy(c.data, p)
+	c.gap = atomic.CompareAndSwapInt32(&b.gap, 1, 0)
+
+	atomic.AddInt64(&b.pending, int64(len(p)))
+	select {
+	case b.chunks <- c:
+	default:
+		atomic.AddInt64(&b.pending, -int64(len(p)))
+		b.drop(len(p))
+	}
+	return len(p), nil
+}
+
+// markGap tells the reader that some data before the next write is missing
+func (b *buffer) markGap() {
+	atomic.StoreInt32(&b.gap, 1)
+}
+
+func (b *buffer) drop(n int) {
+	atomic.AddUint64(&b.dropped, 1)
+	atomic.AddUint64(&b.droppedBytes, uint64(n))
+	atomic.StoreInt32(&b.gap, 1)
+}
+
+// Read read buffered data, it blocks until data available or the buffer closed
+func (b *buffer) Read(p []byte) (n int, err error) {
+	for len(b.current) == 0 {
+		c, ok := b.next()
+		if !ok {
+			return 0, io.EOF
+		}
+		atomic.AddInt64(&b.pending, -int64(len(c.data)))
+		b.current = c.data
+		b.currentTime = c.time
+		if c.gap {
+			return 0, errGap
+		}
+	}
+
+	n = copy(p, b.current)
+	b.current = b.current[n:]
+	return n, nil
+}
+
+// readTime returns the time the data last read was received
+func (b *buffer) readTime() time.Time {
+	return b.currentTime
+}
+
+func (b *buffer) next() (chunk, bool) {
+	select {
+	case c := <-b.chunks:
+		return c, true
+	case <-b.closed:
+		// drain data written before close
+		select {
+		case c := <-b.chunks:
+			return c, true
+		default:
+			return chunk{}, false
+		}
+	}
+}
+
+func (b *buffer) Close() {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+}
+
+func (b *buffer) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,162 @@
+package mongo
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRead returns the data read from b until EOF, a gap is read as |
+func testRead(t *testing.T, b *buffer) string {
+	var read strings.Builder
+	p := make([]byte, 4)
+	for {
+		n, err := b.Read(p)
+		read.Write(p[:n])
+		switch err {
+		case nil:
+		case errGap:
+			read.WriteString("|")
+		case io.EOF:
+			return read.String()
+		default:
+			t.Fatal(err)
+		}
+	}
+}
+
+// testNotBlocking fails t when write blocks
+func testNotBlocking(t *testing.T, write func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		write()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked")
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	b := newBuffer(16)
+	testNotBlocking(t, func() {
+		for _, data := range []string{"0123456789", "abcdefghij", "klmnopqrst", "xyz"} {
+			if n, err := b.Write([]byte(data)); n != len(data) || err != nil {
+				t.Errorf("write %q: %d %v", data, n, err)
+			}
+		}
+	})
+	if b.dropped != 2 || b.droppedBytes != 20 {
+		t.Errorf("dropped %d writes of %d bytes, expect 2 of 20", b.dropped, b.droppedBytes)
+	}
+	b.Close()
+	// the data written after the drops follows a gap
+	if read := testRead(t, b); read != "0123456789|xyz" {
+		t.Errorf("read %q", read)
+	}
+}
+
+func TestBufferOverflowChunks(t *testing.T) {
+	b := newBuffer(DefaultBufferSize)
+	testNotBlocking(t, func() {
+		for i := 0; i < cap(b.chunks)+2; i++ {
+			_, _ = b.Write([]byte("x"))
+		}
+	})
+	// the bytes are under the limit, the writes are not
+	if b.dropped != 2 || b.droppedBytes != 2 {
+		t.Errorf("dropped %d writes of %d bytes, expect 2 of 2", b.dropped, b.droppedBytes)
+	}
+	b.Close()
+	if read := testRead(t, b); read != strings.Repeat("x", cap(b.chunks)) {
+		t.Errorf("read %d bytes", len(read))
+	}
+	_, _ = b.Write([]byte("after close"))
+	if b.dropped != 2 {
+		t.Error("write after close dropped")
+	}
+}
+
+func TestBufferGap(t *testing.T) {
+	b := newBuffer(DefaultBufferSize)
+	_, _ = b.Write([]byte("ab"))
+	b.markGap()
+	b.markGap()
+	_, _ = b.Write([]byte("cd"))
+	_, _ = b.Write([]byte("ef"))
+	b.Close()
+	if read := testRead(t, b); read != "ab|cdef" {
+		t.Errorf("read %q", read)
+	}
+}
+
+func TestBufferBlocking(t *testing.T) {
+	b := newBuffer(1)
+	b.blocking = true
+	writes := cap(b.chunks) * 2
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			_, _ = b.Write([]byte("xy"))
+		}
+		b.Close()
+	}()
+	read := testRead(t, b)
+	wg.Wait()
+	if read != strings.Repeat("xy", writes) || b.dropped != 0 {
+		t.Errorf("read %d bytes, %d writes dropped", len(read), b.dropped)
+	}
+
+	// Close releases a writer blocked on a full buffer
+	b = newBuffer(1)
+	b.blocking = true
+	for i := 0; i < cap(b.chunks); i++ {
+		_, _ = b.Write([]byte("x"))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = b.Write([]byte("x"))
+	}()
+	select {
+	case <-done:
+		t.Fatal("write to a full blocking buffer returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.Close()
+	<-done
+}
+
+func TestParserGap(t *testing.T) {
+	first := testEvent{0, "find", 1, 0}.message(t).Raw()
+	lost := testEvent{0, "find", 2, 0}.message(t).Raw()
+	last := testEvent{0, "find", 3, 0}.message(t).Raw()
+
+	var parsed []string
+	p := NewParser("test", func(msg Message, err error) {
+		if err != nil {
+			parsed = append(parsed, err.Error())
+			return
+		}
+		parsed = append(parsed, fmt.Sprintf("%s %d", OpName(msg), msg.Header().RequestID))
+	})
+	_, _ = p.Write(first)
+	// the head of the second message is lost, the parser resyncs at the third
+	p.Gap()
+	_, _ = p.Write(lost[20:])
+	_, _ = p.Write(last)
+	p.Close()
+	p.Wait()
+
+	if len(parsed) != 3 || !strings.HasSuffix(parsed[0], " 1") || !strings.HasSuffix(parsed[2], " 3") ||
+		!strings.Contains(parsed[1], "resynchronizing") {
+		t.Errorf("parsed %q", parsed)
+	}
+}
@@ -0,0 +1,257 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Operation is what a request asks the server to do, the fields which don't
+// apply to the command are empty
+type Operation struct {
+	// Command is the command name such as find or insert, legacy queries are
+	// find and the other legacy operations are named after the command they match
+	Command    string
+	Database   string
+	Collection string
+	Filter     bson.M
+	Projection bson.M
+	// Sort keeps the order of the keys
+	Sort     bson.D
+	Skip     int64
+	Limit    int64
+	Pipeline []interface{}
+	// Update is the update of findAndModify, or of update when it has a single statement
+	Update interface{}
+	// Key is the field of distinct
+	Key       string
+	CursorIDs []int64
+	// Count is the number of documents of insert, statements of update and delete, or indexes of createIndexes
+	Count int
+	// AppName is the application name a client sends in the handshake
+	AppName string
+}
+
+// Namespace returns database.collection, or the database alone
+func (op *Operation) Namespace() string {
+	if op.Collection == "" {
+		return op.Database
+	}
+	return op.Database + "." + op.Collection
+}
+
+func (op *Operation) String() string {
+	return op.Format(Relaxed)
+}
+
+// Format returns a one line summary such as "find test.orders filter={...} sort={...} limit=20"
+func (op *Operation) Format(mode JSONMode) string {
+	parts := []string{op.Command}
+	if ns := op.Namespace(); ns != "" {
+		parts = append(parts, ns)
+	}
+	if op.Key != "" {
+		parts = append(parts, "key="+op.Key)
+	}
+	if op.Filter != nil {
+		parts = append(parts, "filter="+ExtJSON(op.Filter, mode))
+	}
+	if op.Projection != nil {
+		parts = append(parts, "projection="+ExtJSON(op.Projection, mode))
+	}
+	if op.Sort != nil {
+		parts = append(parts, "sort="+ExtJSON(op.Sort, mode))
+	}
+	if op.Skip != 0 {
+		parts = append(parts, fmt.Sprintf("skip=%d", op.Skip))
+	}
+	if op.Limit != 0 {
+		parts = append(parts, fmt.Sprintf("limit=%d", op.Limit))
+	}
+	if op.Pipeline != nil {
+		parts = append(parts, "pipeline="+ExtJSON(op.Pipeline, mode))
+	}
+	if op.Update != nil {
+		parts = append(parts, "update="+ExtJSON(op.Update, mode))
+	}
+	if op.CursorIDs != nil {
+		parts = append(parts, "cursors="+ExtJSON(op.CursorIDs, mode))
+	}
+	if op.Count != 0 {
+		parts = append(parts, fmt.Sprintf("%s=%d", countName(op.Command), op.Count))
+	}
+	if op.AppName != "" {
+		parts = append(parts, "app="+op.AppName)
+	}
+	return strings.Join(parts, " ")
+}
+
+// countName returns what Count counts for command
+func countName(command string) string {
+	switch command {
+	case "update":
+		return "updates"
+	case "delete":
+		return "deletes"
+	case "createIndexes":
+		return "indexes"
+	}
+	return "documents"
+}
+
+// Classify returns the operation of a request, it is nil for replies
+func Classify(msg Message) *Operation {
+	if msg.Header().ResponseTo != 0 {
+		return nil
+	}
+	switch m := msg.(type) {
+	case *OpQuery:
+		if m.command == "" {
+			return classifyQuery(m)
+		}
+	case *OpInsert:
+		op := legacyOperation("insert", m.FullCollectionName)
+		op.Count = len(m.Documents)
+		return op
+	case *OpUpdate:
+		op := legacyOperation("update", m.FullCollectionName)
+		op.Filter, op.Update, op.Count = m.Selector, m.Update, 1
+		return op
+	case *OpDelete:
+		op := legacyOperation("delete", m.FullCollectionName)
+		op.Filter, op.Count = m.Selector, 1
+		return op
+	case *OpGetMore:
+		op := legacyOperation("getMore", m.FullCollectionName)
+		op.CursorIDs = []int64{m.CursorID}
+		return op
+	case *OpKillCursors:
+		return &Operation{Command: "killCursors", CursorIDs: m.CursorIDs}
+	}
+
+	cmd := CommandDocument(msg)
+	if cmd == nil {
+		return nil
+	}
+	op := &Operation{Command: CommandName(msg)}
+	op.Database, op.Collection = splitNamespace(Namespace(msg))
+	ordered := orderedFieldsOf(msg.base().document)
+
+	switch strings.ToLower(op.Command) {
+	case "find":
+		op.Filter = toM(cmd["filter"])
+		op.Projection = toM(cmd["projection"])
+		op.Sort = ordered.Sort
+		op.Skip = toInt64(cmd["skip"])
+		op.Limit = toInt64(cmd["limit"])
+	case "aggregate":
+		op.Pipeline, _ = cmd["pipeline"].([]interface{})
+	case "count":
+		op.Filter = toM(cmd["query"])
+		op.Skip = toInt64(cmd["skip"])
+		op.Limit = toInt64(cmd["limit"])
+	case "distinct":
+		op.Key, _ = cmd["key"].(string)
+		op.Filter = toM(cmd["query"])
+	case "findandmodify":
+		op.Filter = toM(cmd["query"])
+		op.Projection = toM(cmd["fields"])
+		op.Sort = ordered.Sort
+		op.Update = cmd["update"]
+	case "insert":
+		docs, _ := cmd["documents"].([]interface{})
+		op.Count = len(docs)
+	case "update":
+		updates, _ := cmd["updates"].([]interface{})
+		op.Count = len(updates)
+		if len(updates) == 1 {
+			update := toM(updates[0])
+			op.Filter, op.Update = toM(update["q"]), update["u"]
+		}
+	case "delete":
+		deletes, _ := cmd["deletes"].([]interface{})
+		op.Count = len(deletes)
+		if len(deletes) == 1 {
+			del := toM(deletes[0])
+			op.Filter, op.Limit = toM(del["q"]), toInt64(del["limit"])
+		}
+	case "getmore":
+		// the first value is the cursor id, the collection has its own field
+		op.Collection, _ = cmd["collection"].(string)
+		op.CursorIDs = []int64{toInt64(cmd["getMore"])}
+	case "killcursors":
+		ids, _ := cmd["cursors"].([]interface{})
+		for _, id := range ids {
+			op.CursorIDs = append(op.CursorIDs, toInt64(id))
+		}
+	case "createindexes":
+		indexes, _ := cmd["indexes"].([]interface{})
+		op.Count = len(indexes)
+	case "hello", "ismaster":
+		client := toM(cmd["client"])
+		op.AppName, _ = toM(client["application"])["name"].(string)
+	}
+	return op
+}
+
+// classifyQuery classify a legacy query on a collection, the filter is wrapped
+// in $query when the query has modifiers such as $orderby
+func classifyQuery(m *OpQuery) *Operation {
+	op := legacyOperation("find", m.FullCollectionName)
+	op.Filter = m.Query
+	if query, ok := m.Query["$query"]; ok {
+		op.Filter = toM(query)
+		op.Sort = orderedFieldsOf(m.document).OrderBy
+	}
+	op.Projection = m.ReturnFieldsSelector
+	op.Skip = int64(m.NumberToSkip)
+	if m.NumberToReturn < 0 {
+		// a negative numberToReturn is a limit which closes the cursor after the first batch
+		op.Limit = int64(-m.NumberToReturn)
+	} else {
+		op.Limit = int64(m.NumberToReturn)
+	}
+	return op
+}
+
+func legacyOperation(command string, fullCollectionName string) *Operation {
+	op := &Operation{Command: command}
+	op.Database, op.Collection = splitNamespace(fullCollectionName)
+	return op
+}
+
+func splitNamespace(ns string) (db string, collection string) {
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
+
+// orderedFields are the fields whose key order is lost in bson.M
+type orderedFields struct {
+	Query   bson.Raw `bson:"$query"`
+	Sort    bson.D   `bson:"sort"`
+	OrderBy bson.D   `bson:"$orderby"`
+}
+
+// orderedFieldsOf decode the ordered fields of a raw command or query document,
+// a command wrapped in $query by a legacy driver is unwrapped
+func orderedFieldsOf(document []byte) orderedFields {
+	var fields orderedFields
+	if document == nil {
+		return fields
+	}
+	_ = bson.Unmarshal(document, &fields)
+	if fields.Query.Kind == 0x03 && fields.Sort == nil {
+		var inner orderedFields
+		_ = fields.Query.Unmarshal(&inner)
+		fields.Sort = inner.Sort
+	}
+	return fields
+}
+
+func toM(v interface{}) bson.M {
+	m, _ := v.(bson.M)
+	return m
+}
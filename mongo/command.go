@@ -0,0 +1,79 @@
+package mongo
+
+import (
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// CommandName returns the name of the command a request runs, such as find
+// or insert, it is empty for replies and legacy operations other than commands
+func CommandName(msg Message) string {
+	return msg.base().command
+}
+
+// Namespace returns the database and collection a request operates on, such as
+// test.orders, only the database is returned for commands without a collection
+func Namespace(msg Message) string {
+	switch m := msg.(type) {
+	case *OpQuery:
+		if m.command == "" {
+			return m.FullCollectionName
+		}
+		db := strings.TrimSuffix(m.FullCollectionName, ".$cmd")
+		return commandNamespace(db, CommandDocument(m)[m.command])
+	case *OpInsert:
+		return m.FullCollectionName
+	case *OpUpdate:
+		return m.FullCollectionName
+	case *OpDelete:
+		return m.FullCollectionName
+	case *OpGetMore:
+		return m.FullCollectionName
+	case *OpMsg:
+		for _, section := range m.Sections {
+			if section.Kind == 0 {
+				db, _ := section.Body["$db"].(string)
+				return commandNamespace(db, section.Body[m.command])
+			}
+		}
+	case *OpCommand:
+		return commandNamespace(m.Database, m.CommandArgs[m.CommandName])
+	}
+	return ""
+}
+
+// IsAuthCommand reports whether msg runs saslStart, saslContinue or authenticate
+func IsAuthCommand(msg Message) bool {
+	return authCommands[strings.ToLower(CommandName(msg))]
+}
+
+// CommandDocument returns the command a request runs, it is nil for legacy
+// operations other than commands
+func CommandDocument(msg Message) bson.M {
+	switch m := msg.(type) {
+	case *OpQuery:
+		if m.command == "" {
+			return nil
+		}
+		if query, ok := m.Query["$query"].(bson.M); ok {
+			return query
+		}
+		return m.Query
+	case *OpMsg:
+		return m.Command()
+	case *OpCommand:
+		return m.CommandArgs
+	}
+	return nil
+}
+
+// commandNamespace join db with the collection a command names in its first
+// value, for commands like {ping: 1} the value is not a collection
+func commandNamespace(db string, value interface{}) string {
+	collection, ok := value.(string)
+	if !ok || collection == "" || db == "" {
+		return db
+	}
+	return db + "." + collection
+}
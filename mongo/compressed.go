@@ -0,0 +1,93 @@
+package mongo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor ids used by OP_COMPRESSED, see
+// https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+const (
+	compressorNoop   = 0
+	compressorSnappy = 1
+	compressorZlib   = 2
+	compressorZstd   = 3
+)
+
+var compressorNames = map[uint8]string{
+	compressorNoop:   "noop",
+	compressorSnappy: "snappy",
+	compressorZlib:   "zlib",
+	compressorZstd:   "zstd",
+}
+
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+	zstdDecoderOnce sync.Once
+)
+
+func compressorName(compressorID uint8) string {
+	if name, ok := compressorNames[compressorID]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", compressorID)
+}
+
+// decompress unwraps the payload of an OP_COMPRESSED message, the result
+// must be exactly uncompressedSize bytes long. The sizes come from the wire,
+// nothing larger than a message is allocated
+func decompress(compressorID uint8, compressed []byte, uncompressedSize int32) ([]byte, error) {
+	if uncompressedSize < 0 || uncompressedSize > maxMessageSize {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+
+	var data []byte
+	var err error
+	switch compressorID {
+	case compressorNoop:
+		data = compressed
+	case compressorSnappy:
+		// the snappy header has its own length, check it before allocating
+		var size int
+		if size, err = snappy.DecodedLen(compressed); err == nil && size != int(uncompressedSize) {
+			return nil, fmt.Errorf("snappy decompress failed: expect %d bytes, header has %d", uncompressedSize, size)
+		}
+		if err == nil {
+			data, err = snappy.Decode(nil, compressed)
+		}
+	case compressorZlib:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			data, err = ioutil.ReadAll(io.LimitReader(zr, int64(uncompressedSize)+1))
+			_ = zr.Close()
+		}
+	case compressorZstd:
+		zstdDecoderOnce.Do(func() {
+			// a frame decoding to more than a message is given up as it is decoded
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMessageSize))
+		})
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+		data, err = zstdDecoder.DecodeAll(compressed, make([]byte, 0, uncompressedSize))
+	default:
+		return nil, fmt.Errorf("unknown compressor: %d", compressorID)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s decompress failed: %v", compressorName(compressorID), err)
+	}
+	if len(data) != int(uncompressedSize) {
+		return nil, fmt.Errorf("%s decompress failed: expect %d bytes, got %d",
+			compressorName(compressorID), uncompressedSize, len(data))
+	}
+	return data, nil
+}
@@ -0,0 +1,110 @@
+package mongo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	data := []byte(strings.Repeat("mgosniff", 16))
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		compressorID uint8
+		compressed   []byte
+	}{
+		{compressorNoop, data},
+		{compressorSnappy, snappy.Encode(nil, data)},
+		{compressorZlib, zlibbed.Bytes()},
+		{compressorZstd, zstdEncoder.EncodeAll(data, nil)},
+	} {
+		decompressed, err := decompress(test.compressorID, test.compressed, int32(len(data)))
+		if err != nil {
+			t.Errorf("%s: %v", compressorName(test.compressorID), err)
+			continue
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%s: decompressed %q", compressorName(test.compressorID), decompressed)
+		}
+	}
+}
+
+func TestDecompressSizeErrors(t *testing.T) {
+	data := []byte(strings.Repeat("mgosniff", 16))
+	// a snappy header claiming 1GB in place of the 2 bytes of 128
+	lying := append([]byte{0x80, 0x80, 0x80, 0x80, 0x04}, snappy.Encode(nil, data)[2:]...)
+
+	for _, test := range []struct {
+		name             string
+		compressorID     uint8
+		compressed       []byte
+		uncompressedSize int32
+		err              string
+	}{
+		{"negative size", compressorNoop, data, -1, "invalid uncompressed size"},
+		{"oversized header", compressorZstd, []byte{0}, maxMessageSize + 1, "invalid uncompressed size"},
+		{"oversized header snappy", compressorSnappy, snappy.Encode(nil, data), 1 << 30, "invalid uncompressed size"},
+		{"lying snappy header", compressorSnappy, lying, int32(len(data)), "header has 1073741824"},
+		{"short snappy", compressorSnappy, snappy.Encode(nil, data), int32(len(data)) - 1, "header has 128"},
+		{"short noop", compressorNoop, data, int32(len(data)) + 1, "expect 129 bytes, got 128"},
+		{"unknown compressor", 9, data, int32(len(data)), "unknown compressor"},
+	} {
+		_, err := decompress(test.compressorID, test.compressed, test.uncompressedSize)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, expect %s", test.name, err, test.err)
+		}
+	}
+}
+
+// testBomb returns zeros larger than a message compressed by a stream writer,
+// which doesn't write the decompressed size in the frame header
+func testBomb(t *testing.T, newWriter func(w io.Writer) (io.WriteCloser, error)) []byte {
+	var compressed bytes.Buffer
+	w, err := newWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, 1<<20)
+	for written := 0; written <= maxMessageSize; written += len(zeros) {
+		if _, err := w.Write(zeros); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestDecompressBomb(t *testing.T) {
+	zstdBomb := testBomb(t, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) })
+	zlibBomb := testBomb(t, func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil })
+	for _, test := range []struct {
+		compressorID uint8
+		compressed   []byte
+	}{
+		{compressorZstd, zstdBomb},
+		{compressorZlib, zlibBomb},
+	} {
+		// the header of the message is legal, the payload is not
+		for _, size := range []int32{128, maxMessageSize} {
+			_, err := decompress(test.compressorID, test.compressed, size)
+			if err == nil || !strings.Contains(err.Error(), compressorName(test.compressorID)+" decompress failed") {
+				t.Errorf("%s bomb of %d bytes to %d: error %v", compressorName(test.compressorID), len(test.compressed), size, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package mongo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// DefaultReplyTimeout is how long a request waits for its reply before it is reported as unanswered
+const DefaultReplyTimeout = 5 * time.Minute
+
+// Exchange is a request paired with its reply
+type Exchange struct {
+	RemoteAddr string
+	// Request is nil when a reply arrives for a request never seen, such
+	// as when the request was dropped or sent before sniffing started
+	Request Message
+	// Response is nil for unanswered requests and requests which expect no reply
+	Response Message
+	// Duration is the round-trip time between the request and the reply seen at the proxy
+	Duration time.Duration
+	// OK, ErrMsg and Code are read from the reply document
+	OK     bool
+	ErrMsg string
+	Code   int32
+	// Unanswered is set when no reply arrived before the connection
+	// was closed or the reply timeout elapsed
+	Unanswered bool
+	// Sequence is the position of Response in the stream of replies to an
+	// exhaust request or an awaitable hello, it is 0 for the first or only
+	// reply, Duration of the following replies is the time since the previous reply
+	Sequence int
+	// MoreToCome is set when the server sends more replies to Request after Response
+	MoreToCome bool
+	// Plan is the winning plan of Request when it was explained as a slow operation
+	Plan *Plan
+}
+
+// stream is a request whose replies are streamed by the server, each reply
+// answers the previous one
+type stream struct {
+	request Message
+	last    Message
+	count   int
+}
+
+// Correlator pairs the requests and replies of one connection by RequestID and ResponseTo
+type Correlator struct {
+	remoteAddr string
+	timeout    time.Duration
+	handler    func(ex *Exchange)
+
+	lock     sync.Mutex
+	requests map[int32]Message
+	// replies holds the replies decoded before their requests, the
+	// two directions of a connection are parsed concurrently
+	replies map[int32]Message
+	// streams holds the streams waiting for their next reply by the RequestID of the last reply
+	streams map[int32]*stream
+	// lastSeen and lastSeenAt map message time to wall time, so that timeouts
+	// also work when replaying a capture file
+	lastSeen   time.Time
+	lastSeenAt time.Time
+	closed     bool
+	stop       chan struct{}
+}
+
+// NewCorrelator create a correlator, handler is called with every exchange and
+// may be called from different goroutines, requests without reply are reported after timeout
+func NewCorrelator(remoteAddr string, timeout time.Duration, handler func(ex *Exchange)) *Correlator {
+	c := &Correlator{
+		remoteAddr: remoteAddr,
+		timeout:    timeout,
+		handler:    handler,
+		requests:   make(map[int32]Message),
+		replies:    make(map[int32]Message),
+		streams:    make(map[int32]*stream),
+		stop:       make(chan struct{}),
+	}
+	go c.expireLoop()
+	return c
+}
+
+// Request is the recorder for the client to server direction
+func (c *Correlator) Request(msg Message) {
+	var exchanges []*Exchange
+
+	c.lock.Lock()
+	c.see(msg)
+	switch {
+	case !ExpectsReply(msg):
+		exchanges = append(exchanges, &Exchange{Request: msg})
+	case c.replies[msg.Header().RequestID] != nil:
+		reply := c.replies[msg.Header().RequestID]
+		delete(c.replies, msg.Header().RequestID)
+		exchanges = append(exchanges, c.answer(&stream{request: msg}, reply)...)
+	default:
+		c.requests[msg.Header().RequestID] = msg
+	}
+	exchanges = append(exchanges, c.expire(c.now())...)
+	c.lock.Unlock()
+
+	c.emit(exchanges)
+}
+
+// Response is the recorder for the server to client direction
+func (c *Correlator) Response(msg Message) {
+	var exchanges []*Exchange
+
+	c.lock.Lock()
+	c.see(msg)
+	if req, ok := c.requests[msg.Header().ResponseTo]; ok {
+		delete(c.requests, msg.Header().ResponseTo)
+		exchanges = append(exchanges, c.answer(&stream{request: req}, msg)...)
+	} else if s, ok := c.streams[msg.Header().ResponseTo]; ok {
+		delete(c.streams, msg.Header().ResponseTo)
+		exchanges = append(exchanges, c.answer(s, msg)...)
+	} else {
+		c.replies[msg.Header().ResponseTo] = msg
+	}
+	exchanges = append(exchanges, c.expire(c.now())...)
+	c.lock.Unlock()
+
+	c.emit(exchanges)
+}
+
+// answer pair the next reply of s, when more replies follow s waits for them,
+// the replies of s already decoded are paired at once, c.lock must be held
+func (c *Correlator) answer(s *stream, reply Message) (exchanges []*Exchange) {
+	for reply != nil {
+		ex := newExchange(s.request, reply)
+		ex.Sequence = s.count
+		if s.last != nil {
+			ex.Duration = reply.Received().Sub(s.last.Received())
+		}
+		ex.MoreToCome = MoreToCome(s.request, reply)
+		exchanges = append(exchanges, ex)
+		if !ex.MoreToCome {
+			return exchanges
+		}
+
+		s.last = reply
+		s.count++
+		next := c.replies[reply.Header().RequestID]
+		if next == nil {
+			c.streams[reply.Header().RequestID] = s
+			return exchanges
+		}
+		delete(c.replies, reply.Header().RequestID)
+		reply = next
+	}
+	return exchanges
+}
+
+// Close reports all pending requests as unanswered, it should be called
+// after both directions of the connection are parsed
+func (c *Correlator) Close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	exchanges := c.expire(time.Time{})
+	c.lock.Unlock()
+
+	c.emit(exchanges)
+}
+
+func (c *Correlator) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.lock.Lock()
+			exchanges := c.expire(c.now())
+			c.lock.Unlock()
+			c.emit(exchanges)
+		}
+	}
+}
+
+func (c *Correlator) see(msg Message) {
+	if msg.Received().After(c.lastSeen) {
+		c.lastSeen = msg.Received()
+		c.lastSeenAt = time.Now()
+	}
+}
+
+// now returns the current time in the clock of the messages
+func (c *Correlator) now() time.Time {
+	if c.lastSeen.IsZero() {
+		return time.Now()
+	}
+	return c.lastSeen.Add(time.Since(c.lastSeenAt))
+}
+
+// expire removes the requests and replies received before now - timeout,
+// all of them are removed when now is zero, c.lock must be held
+func (c *Correlator) expire(now time.Time) (exchanges []*Exchange) {
+	deadline := now.Add(-c.timeout)
+	for id, req := range c.requests {
+		if now.IsZero() || req.Received().Before(deadline) {
+			delete(c.requests, id)
+			exchanges = append(exchanges, &Exchange{Request: req, Unanswered: true})
+		}
+	}
+	for id, reply := range c.replies {
+		if now.IsZero() || reply.Received().Before(deadline) {
+			delete(c.replies, id)
+			exchanges = append(exchanges, newExchange(nil, reply))
+		}
+	}
+	// a stream ends when the client closes the connection or stops reading
+	// it, so streams without next reply are removed silently
+	for id, s := range c.streams {
+		if now.IsZero() || s.last.Received().Before(deadline) {
+			delete(c.streams, id)
+		}
+	}
+	return exchanges
+}
+
+func (c *Correlator) emit(exchanges []*Exchange) {
+	for _, ex := range exchanges {
+		ex.RemoteAddr = c.remoteAddr
+		c.handler(ex)
+	}
+}
+
+func newExchange(req Message, reply Message) *Exchange {
+	ex := &Exchange{Request: req, Response: reply}
+	if req != nil {
+		ex.Duration = reply.Received().Sub(req.Received())
+	}
+	ex.OK, ex.ErrMsg, ex.Code = ReplyStatus(reply)
+	return ex
+}
+
+// ExpectsReply reports whether the server replies to msg, legacy write
+// operations, kill cursors and OP_MSG with moreToCome are fire-and-forget
+func ExpectsReply(msg Message) bool {
+	switch m := msg.(type) {
+	case *OpQuery, *OpGetMore, *OpCommand:
+		return true
+	case *OpMsg:
+		return !m.MoreToCome()
+	}
+	return false
+}
+
+// queryExhaust is set in the flags of OP_QUERY when the client accepts all
+// batches of the cursor without sending getMore
+const queryExhaust = 1 << 6
+
+// MoreToCome reports whether the server sends more replies to req after reply,
+// for OP_MSG it is flagged on the reply, a legacy exhaust query is streamed until the cursor is exhausted
+func MoreToCome(req Message, reply Message) bool {
+	switch r := reply.(type) {
+	case *OpMsg:
+		return r.MoreToCome()
+	case *OpReply:
+		query, ok := req.(*OpQuery)
+		return ok && query.Flags&queryExhaust != 0 && r.CursorID != 0
+	}
+	return false
+}
+
+// ReplyDocument returns the document which holds the command result of a
+// reply, that is the first document of OP_REPLY, the body of OP_MSG
+// or the commandReply of OP_COMMANDREPLY
+func ReplyDocument(msg Message) bson.M {
+	switch m := msg.(type) {
+	case *OpReply:
+		if len(m.Documents) > 0 {
+			return m.Documents[0]
+		}
+	case *OpMsg:
+		for _, section := range m.Sections {
+			if section.Kind == 0 {
+				return section.Body
+			}
+		}
+	case *OpCommandReply:
+		return m.CommandReply
+	}
+	return nil
+}
+
+// ReplyStatus read ok, errmsg and code from a reply
+func ReplyStatus(msg Message) (ok bool, errMsg string, code int32) {
+	doc := ReplyDocument(msg)
+	if reply, isReply := msg.(*OpReply); isReply && reply.ResponseFlags&replyQueryFailure != 0 {
+		errMsg, _ = doc["$err"].(string)
+		return false, errMsg, toInt32(doc["code"])
+	}
+	if doc == nil {
+		return true, "", 0
+	}
+
+	ok = true
+	if v, exists := doc["ok"]; exists {
+		ok = toInt32(v) == 1
+	}
+	errMsg, _ = doc["errmsg"].(string)
+	if errMsg == "" {
+		errMsg, _ = doc["$err"].(string)
+	}
+	code = toInt32(doc["code"])
+	if writeErrors, _ := doc["writeErrors"].([]interface{}); ok && len(writeErrors) > 0 {
+		ok = false
+		if first, _ := writeErrors[0].(bson.M); first != nil {
+			errMsg, _ = first["errmsg"].(string)
+			code = toInt32(first["code"])
+		}
+	}
+	return ok, errMsg, code
+}
+
+// replyQueryFailure is set in the responseFlags of OP_REPLY when the query failed
+const replyQueryFailure = 1 << 1
+
+func toInt32(v interface{}) int32 {
+	switch n := v.(type) {
+	case int:
+		return int32(n)
+	case int32:
+		return n
+	case int64:
+		return int32(n)
+	case float64:
+		return int32(n)
+	case bool:
+		if n {
+			return 1
+		}
+	}
+	return 0
+}
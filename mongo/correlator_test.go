@@ -0,0 +1,241 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// testStart is the time of the first message of the correlator tests, in the past
+// like the messages of a capture file
+var testStart = time.Unix(1645344931, 0)
+
+// testEvent is a message received at testStart + at, kind is one of
+//
+//	find     an OP_MSG request
+//	fire     an OP_MSG request with moreToCome
+//	insert   a legacy insert
+//	ok       an OP_MSG reply
+//	error    an OP_MSG reply with ok: 0
+//	more     an OP_MSG reply with moreToCome
+//	exhaust  a legacy exhaust query
+//	batch    an OP_REPLY of cursor 9
+//	last     an OP_REPLY of cursor 0
+type testEvent struct {
+	at         time.Duration
+	kind       string
+	requestID  int32
+	responseTo int32
+}
+
+func (ev testEvent) message(t *testing.T) Message {
+	var b []byte
+	switch ev.kind {
+	case "find", "fire":
+		b = testMsg(t, bson.D{{Name: "find", Value: "users"}, {Name: "$db", Value: "shop"}}, "")
+	case "ok", "more":
+		b = testMsg(t, bson.D{{Name: "ok", Value: 1.0}}, "")
+	case "error":
+		b = testMsg(t, bson.D{{Name: "ok", Value: 0.0}, {Name: "errmsg", Value: "failed"}, {Name: "code", Value: 2}}, "")
+	case "insert":
+		b = testLegacyMsg(t, opInsert, int32(0), "shop.users", bson.M{"_id": 1})
+	case "exhaust":
+		b = testLegacyMsg(t, opQuery, int32(queryExhaust), "shop.users", int32(0), int32(0), bson.M{})
+	case "batch", "last":
+		cursorID := int64(9)
+		if ev.kind == "last" {
+			cursorID = 0
+		}
+		b = testLegacyMsg(t, opReply, int32(0), cursorID, int32(0), int32(1), bson.M{"_id": 1})
+	default:
+		t.Fatalf("unknown event %s", ev.kind)
+	}
+	if ev.kind == "fire" || ev.kind == "more" {
+		b[4*4] |= MsgMoreToCome
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(ev.requestID))
+	binary.LittleEndian.PutUint32(b[8:], uint32(ev.responseTo))
+
+	msg, err := ParseMessage(b, testStart.Add(ev.at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// testSummary returns a line such as "req 1 reply 100 in 10ms" for ex
+func testSummary(ex *Exchange) string {
+	var parts []string
+	if ex.Request != nil {
+		parts = append(parts, fmt.Sprintf("req %d", ex.Request.Header().RequestID))
+	}
+	if ex.Response != nil {
+		parts = append(parts, fmt.Sprintf("reply %d in %v", ex.Response.Header().RequestID, ex.Duration))
+		if !ex.OK {
+			parts = append(parts, "failed")
+		}
+	}
+	if ex.Unanswered {
+		parts = append(parts, "unanswered")
+	}
+	if ex.Sequence > 0 {
+		parts = append(parts, fmt.Sprintf("seq %d", ex.Sequence))
+	}
+	if ex.MoreToCome {
+		parts = append(parts, "more")
+	}
+	return strings.Join(parts, " ")
+}
+
+// testCorrelate returns the summaries of the exchanges of events, those
+// reported by Close follow "close"
+func testCorrelate(t *testing.T, timeout time.Duration, events []testEvent) []string {
+	var lock sync.Mutex
+	var exchanges []string
+	c := NewCorrelator("10.0.0.1:52117", timeout, func(ex *Exchange) {
+		if ex.RemoteAddr != "10.0.0.1:52117" {
+			t.Errorf("exchange of %s", ex.RemoteAddr)
+		}
+		lock.Lock()
+		exchanges = append(exchanges, testSummary(ex))
+		lock.Unlock()
+	})
+	for _, ev := range events {
+		if ev.responseTo == 0 {
+			c.Request(ev.message(t))
+		} else {
+			c.Response(ev.message(t))
+		}
+	}
+	lock.Lock()
+	exchanges = append(exchanges, "close")
+	lock.Unlock()
+	c.Close()
+	return exchanges
+}
+
+func TestCorrelator(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		events   []testEvent
+		expected []string
+	}{
+		{"request then reply", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+			{10 * ms, "ok", 100, 1},
+		}, []string{"req 1 reply 100 in 10ms", "close"}},
+		{"reply parsed before its request", time.Minute, []testEvent{
+			{10 * ms, "ok", 100, 1},
+			{0, "find", 1, 0},
+		}, []string{"req 1 reply 100 in 10ms", "close"}},
+		{"interleaved", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+			{1 * ms, "find", 2, 0},
+			{5 * ms, "error", 101, 2},
+			{8 * ms, "ok", 100, 1},
+		}, []string{"req 2 reply 101 in 4ms failed", "req 1 reply 100 in 8ms", "close"}},
+		{"fire and forget", time.Minute, []testEvent{
+			{0, "insert", 1, 0},
+			{1 * ms, "fire", 2, 0},
+			{2 * ms, "find", 3, 0},
+			{3 * ms, "ok", 100, 3},
+		}, []string{"req 1", "req 2", "req 3 reply 100 in 1ms", "close"}},
+		{"close reports unanswered", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+		}, []string{"close", "req 1 unanswered"}},
+		{"close reports replies without request", time.Minute, []testEvent{
+			{0, "ok", 100, 1},
+		}, []string{"close", "reply 100 in 0s"}},
+		{"timeout", time.Second, []testEvent{
+			{0, "find", 1, 0},
+			{2 * time.Second, "find", 2, 0},
+			{2*time.Second + 3*ms, "ok", 100, 2},
+		}, []string{"req 1 unanswered", "req 2 reply 100 in 3ms", "close"}},
+		{"reply without request times out", time.Second, []testEvent{
+			{0, "ok", 100, 1},
+			{2 * time.Second, "find", 2, 0},
+		}, []string{"reply 100 in 0s", "close", "req 2 unanswered"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exchanges := testCorrelate(t, test.timeout, test.events)
+			if strings.Join(exchanges, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("exchanges\n%s\nexpect\n%s", strings.Join(exchanges, "\n"), strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestCorrelatorStreams(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		events   []testEvent
+		expected []string
+	}{
+		{"moreToCome", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+			{10 * ms, "more", 100, 1},
+			{15 * ms, "more", 101, 100},
+			{17 * ms, "ok", 102, 101},
+		}, []string{"req 1 reply 100 in 10ms more", "req 1 reply 101 in 5ms seq 1 more", "req 1 reply 102 in 2ms seq 2", "close"}},
+		{"replies buffered before the request", time.Minute, []testEvent{
+			{10 * ms, "more", 100, 1},
+			{15 * ms, "more", 101, 100},
+			{17 * ms, "ok", 102, 101},
+			{0, "find", 1, 0},
+		}, []string{"req 1 reply 100 in 10ms more", "req 1 reply 101 in 5ms seq 1 more", "req 1 reply 102 in 2ms seq 2", "close"}},
+		{"replies of the stream out of order", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+			{15 * ms, "ok", 101, 100},
+			{10 * ms, "more", 100, 1},
+		}, []string{"req 1 reply 100 in 10ms more", "req 1 reply 101 in 5ms seq 1", "close"}},
+		{"stream expires", time.Second, []testEvent{
+			{0, "find", 1, 0},
+			{10 * ms, "more", 100, 1},
+			// the stream waiting for the reply to 100 is given up silently
+			{2 * time.Second, "find", 2, 0},
+			{2*time.Second + 1*ms, "ok", 101, 100},
+			{2*time.Second + 2*ms, "ok", 200, 2},
+		}, []string{"req 1 reply 100 in 10ms more", "req 2 reply 200 in 2ms", "close", "reply 101 in 0s"}},
+		{"stream open on close", time.Minute, []testEvent{
+			{0, "find", 1, 0},
+			{10 * ms, "more", 100, 1},
+		}, []string{"req 1 reply 100 in 10ms more", "close"}},
+		{"legacy exhaust query", time.Minute, []testEvent{
+			{0, "exhaust", 1, 0},
+			{10 * ms, "batch", 100, 1},
+			{12 * ms, "batch", 101, 100},
+			{20 * ms, "last", 102, 101},
+			// the cursor is exhausted, a reply to the last one is not part of the stream
+			{21 * ms, "last", 103, 102},
+		}, []string{"req 1 reply 100 in 10ms more", "req 1 reply 101 in 2ms seq 1 more", "req 1 reply 102 in 8ms seq 2", "close", "reply 103 in 0s"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exchanges := testCorrelate(t, test.timeout, test.events)
+			if strings.Join(exchanges, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("exchanges\n%s\nexpect\n%s", strings.Join(exchanges, "\n"), strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestCorrelatorCloseOnce(t *testing.T) {
+	var count int
+	c := NewCorrelator("10.0.0.1:52117", time.Minute, func(ex *Exchange) { count++ })
+	c.Request(testEvent{0, "find", 1, 0}.message(t))
+	c.Close()
+	c.Close()
+	if count != 1 {
+		t.Errorf("%d exchanges reported, expect 1", count)
+	}
+}
@@ -0,0 +1,333 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// CursorState is how a cursor ended
+type CursorState string
+
+const (
+	// CursorExhausted is a cursor whose last batch was returned
+	CursorExhausted CursorState = "exhausted"
+	// CursorKilled is a cursor closed by the client with killCursors
+	CursorKilled CursorState = "killed"
+	// CursorNotFound is a cursor the server didn't know anymore, such as after it timed out
+	CursorNotFound CursorState = "notFound"
+	// CursorLeaked is a cursor neither exhausted nor killed when the connection was closed
+	CursorLeaked CursorState = "leaked"
+)
+
+// codeCursorNotFound is the error code of getMore on an unknown cursor
+const codeCursorNotFound = 43
+
+// replyCursorNotFound is set in the responseFlags of OP_REPLY when the cursor of OP_GET_MORE is unknown
+const replyCursorNotFound = 1 << 0
+
+// Cursor is the life of a server cursor, from the reply which opened it to the
+// reply which exhausted it or the killCursors which closed it
+type Cursor struct {
+	RemoteAddr string
+	ID         int64
+	Namespace  string
+	// Command is the command which opened the cursor, such as find or aggregate,
+	// it is QUERY for a legacy query
+	Command string
+	Opened  time.Time
+	// Closed is the time the cursor ended, or the time of its last batch for leaked cursors
+	Closed    time.Time
+	Documents int
+	Batches   int
+	State     CursorState
+
+	// request is the id of the legacy query which opened the cursor
+	request int32
+}
+
+// Lifetime returns how long the cursor was open
+func (c *Cursor) Lifetime() time.Duration {
+	return c.Closed.Sub(c.Opened)
+}
+
+// CursorTracker follows the cursors of one connection through the exchanges of
+// find, aggregate and other commands returning a cursor, getMore and killCursors,
+// both as OP_MSG commands and as legacy opCodes
+type CursorTracker struct {
+	remoteAddr string
+	handler    func(c *Cursor)
+
+	lock    sync.Mutex
+	cursors map[int64]*Cursor
+}
+
+// NewCursorTracker create a tracker, handler is called with every cursor when it ends
+func NewCursorTracker(remoteAddr string, handler func(c *Cursor)) *CursorTracker {
+	return &CursorTracker{
+		remoteAddr: remoteAddr,
+		handler:    handler,
+		cursors:    make(map[int64]*Cursor),
+	}
+}
+
+// Exchange update the cursors with an exchange of the correlator
+func (t *CursorTracker) Exchange(ex *Exchange) {
+	if ex.Request == nil {
+		return
+	}
+
+	var ended []*Cursor
+	t.lock.Lock()
+	switch req := ex.Request.(type) {
+	case *OpKillCursors:
+		for _, id := range req.CursorIDs {
+			ended = t.end(ended, id, CursorKilled, req.Received())
+		}
+	case *OpGetMore:
+		if reply, ok := ex.Response.(*OpReply); ok {
+			ended = t.legacyBatch(ended, req.CursorID, reply)
+		}
+	case *OpQuery:
+		if reply, ok := ex.Response.(*OpReply); ok && req.command == "" {
+			if ex.Sequence == 0 && reply.CursorID != 0 {
+				t.open(reply.CursorID, req.FullCollectionName, "QUERY", reply.Received())
+				t.cursors[reply.CursorID].request = req.Header().RequestID
+			}
+			// the first reply is the first batch, the others are streamed to an
+			// exhaust query and the last of them has cursor id 0
+			ended = t.legacyBatch(ended, t.queryCursor(req), reply)
+			break
+		}
+		ended = t.command(ended, ex)
+	default:
+		ended = t.command(ended, ex)
+	}
+	t.lock.Unlock()
+
+	for _, c := range ended {
+		t.handler(c)
+	}
+}
+
+// Close reports the cursors still open as leaked, it should be called after
+// the last exchange of the connection
+func (t *CursorTracker) Close() {
+	var ended []*Cursor
+	t.lock.Lock()
+	for id, c := range t.cursors {
+		delete(t.cursors, id)
+		c.State = CursorLeaked
+		ended = append(ended, c)
+	}
+	t.lock.Unlock()
+
+	for _, c := range ended {
+		t.handler(c)
+	}
+}
+
+// command handle the commands which open, iterate or kill cursors, t.lock must be held
+func (t *CursorTracker) command(ended []*Cursor, ex *Exchange) []*Cursor {
+	cmd := CommandDocument(ex.Request)
+	name := CommandName(ex.Request)
+	if cmd == nil || name == "" {
+		return ended
+	}
+
+	switch name {
+	case "killCursors":
+		ids, _ := cmd["cursors"].([]interface{})
+		for _, id := range ids {
+			ended = t.end(ended, toInt64(id), CursorKilled, ex.Request.Received())
+		}
+		return ended
+	case "getMore":
+		if ex.Response == nil {
+			return ended
+		}
+		id := toInt64(cmd["getMore"])
+		if !ex.OK && ex.Code == codeCursorNotFound {
+			return t.end(ended, id, CursorNotFound, ex.Response.Received())
+		}
+		cursor, _ := ReplyDocument(ex.Response)["cursor"].(bson.M)
+		return t.batch(ended, id, cursor, "nextBatch", ex.Response.Received())
+	}
+
+	if ex.Response == nil || ex.Sequence > 0 {
+		return ended
+	}
+	cursor, _ := ReplyDocument(ex.Response)["cursor"].(bson.M)
+	id := toInt64(cursor["id"])
+	if cursor == nil || id == 0 {
+		// no cursor, or all the results fit in the first batch
+		return ended
+	}
+	ns, _ := cursor["ns"].(string)
+	if ns == "" {
+		ns = Namespace(ex.Request)
+	}
+	t.open(id, ns, name, ex.Response.Received())
+	return t.batch(ended, id, cursor, "firstBatch", ex.Response.Received())
+}
+
+// queryCursor returns the id of the cursor opened by a legacy query
+func (t *CursorTracker) queryCursor(req *OpQuery) int64 {
+	for id, c := range t.cursors {
+		if c.request == req.Header().RequestID {
+			return id
+		}
+	}
+	return 0
+}
+
+func (t *CursorTracker) open(id int64, ns string, command string, at time.Time) {
+	t.cursors[id] = &Cursor{
+		RemoteAddr: t.remoteAddr,
+		ID:         id,
+		Namespace:  ns,
+		Command:    command,
+		Opened:     at,
+		Closed:     at,
+	}
+}
+
+// batch add a batch of a command reply to cursor id, the cursor is exhausted
+// when the reply returns cursor id 0
+func (t *CursorTracker) batch(ended []*Cursor, id int64, cursor bson.M, field string, at time.Time) []*Cursor {
+	c, ok := t.cursors[id]
+	if !ok || cursor == nil {
+		return ended
+	}
+	docs, _ := cursor[field].([]interface{})
+	c.Documents += len(docs)
+	c.Batches++
+	c.Closed = at
+	if toInt64(cursor["id"]) == 0 {
+		return t.end(ended, id, CursorExhausted, at)
+	}
+	return ended
+}
+
+// legacyBatch add the documents of OP_REPLY to cursor id
+func (t *CursorTracker) legacyBatch(ended []*Cursor, id int64, reply *OpReply) []*Cursor {
+	if reply.ResponseFlags&replyCursorNotFound != 0 {
+		return t.end(ended, id, CursorNotFound, reply.Received())
+	}
+	c, ok := t.cursors[id]
+	if !ok {
+		return ended
+	}
+	c.Documents += int(reply.NumberReturned)
+	c.Batches++
+	c.Closed = reply.Received()
+	if reply.CursorID == 0 {
+		return t.end(ended, id, CursorExhausted, reply.Received())
+	}
+	return ended
+}
+
+func (t *CursorTracker) end(ended []*Cursor, id int64, state CursorState, at time.Time) []*Cursor {
+	c, ok := t.cursors[id]
+	if !ok {
+		return ended
+	}
+	delete(t.cursors, id)
+	c.State = state
+	c.Closed = at
+	return append(ended, c)
+}
+
+// ReplyCursorID returns the id of the cursor a reply returns batches of, it is
+// 0 when the reply has no cursor or the cursor is exhausted
+func ReplyCursorID(msg Message) int64 {
+	if reply, ok := msg.(*OpReply); ok {
+		return reply.CursorID
+	}
+	cursor, _ := ReplyDocument(msg)["cursor"].(bson.M)
+	return toInt64(cursor["id"])
+}
+
+// RewriteCursorIDs returns msg in wire format with the cursor ids of getMore
+// and killCursors replaced by rewrite, ok is false when msg is neither or can't
+// be encoded again. The message is not compressed and the checksum of OP_MSG is
+// removed as it no longer matches
+func RewriteCursorIDs(msg Message, rewrite func(id int64) int64) (rewritten []byte, ok bool) {
+	header := msg.Header()
+	var b []byte
+	switch m := msg.(type) {
+	case *OpGetMore:
+		b = make([]byte, 4*4+4, 4*4+4+len(m.FullCollectionName)+1+4+8)
+		b = append(append(b, m.FullCollectionName...), 0)
+		b = appendInt32(b, m.NumberToReturn)
+		b = appendInt64(b, rewrite(m.CursorID))
+	case *OpKillCursors:
+		b = make([]byte, 4*4+4, 4*4+4+4+8*len(m.CursorIDs))
+		b = appendInt32(b, int32(len(m.CursorIDs)))
+		for _, id := range m.CursorIDs {
+			b = appendInt64(b, rewrite(id))
+		}
+	case *OpMsg:
+		if (m.command != "getMore" && m.command != "killCursors") || len(m.Sections) != 1 {
+			return nil, false
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(m.document, &doc); err != nil {
+			return nil, false
+		}
+		for i, elem := range doc {
+			switch {
+			case elem.Name == "getMore" && m.command == "getMore":
+				doc[i].Value = rewrite(toInt64(elem.Value))
+			case elem.Name == "cursors" && m.command == "killCursors":
+				ids, _ := elem.Value.([]interface{})
+				rewrittenIDs := make([]interface{}, len(ids))
+				for j, id := range ids {
+					rewrittenIDs[j] = rewrite(toInt64(id))
+				}
+				doc[i].Value = rewrittenIDs
+			}
+		}
+		body, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, false
+		}
+		// header, flagBits and the kind of the body section
+		b = make([]byte, 4*4+4+1, 4*4+4+1+len(body))
+		binary.LittleEndian.PutUint32(b[4*4:], m.FlagBits&^MsgChecksumPresent)
+		b = append(b, body...)
+	default:
+		return nil, false
+	}
+	header.MessageLength = int32(len(b))
+	putHeader(b, header)
+	return b, true
+}
+
+func appendInt32(b []byte, n int32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(n))
+	return append(b, buf[:]...)
+}
+
+func appendInt64(b []byte, n int64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(n))
+	return append(b, buf[:]...)
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestRewriteCursorIDs(t *testing.T) {
+	rewrite := func(id int64) int64 { return id + 100 }
+	getMore := testMsg(t, bson.D{{Name: "getMore", Value: int64(7)}, {Name: "collection", Value: "users"}, {Name: "$db", Value: "shop"}}, "")
+	// a checksum is dropped with its flag
+	checksummed := testChecksum(getMore)
+
+	tests := []struct {
+		name string
+		msg  []byte
+		ids  []int64
+	}{
+		{"getMore", getMore, []int64{107}},
+		{"getMore with checksum", checksummed, []int64{107}},
+		{"killCursors", testMsg(t, bson.D{{Name: "killCursors", Value: "users"},
+			{Name: "cursors", Value: []int64{7, 8}}, {Name: "$db", Value: "shop"}}, ""), []int64{107, 108}},
+		{"legacy getMore", testLegacyMsg(t, opGetMore, int32(0), "shop.users", int32(10), int64(7)), []int64{107}},
+		{"legacy killCursors", testLegacyMsg(t, opKillCursors, int32(0), int32(2), int64(7), int64(8)), []int64{107, 108}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewritten, ok := RewriteCursorIDs(testParse(t, test.msg), rewrite)
+			if !ok {
+				t.Fatal("not rewritten")
+			}
+			var ids []int64
+			switch m := testParse(t, rewritten).(type) {
+			case *OpMsg:
+				if m.ChecksumPresent() {
+					t.Error("checksum flag kept")
+				}
+				if id := toInt64(m.Command()["getMore"]); id != 0 {
+					ids = append(ids, id)
+				}
+				cursors, _ := m.Command()["cursors"].([]interface{})
+				for _, id := range cursors {
+					ids = append(ids, toInt64(id))
+				}
+			case *OpGetMore:
+				ids = []int64{m.CursorID}
+			case *OpKillCursors:
+				ids = m.CursorIDs
+			}
+			if len(ids) != len(test.ids) {
+				t.Fatalf("cursor ids %v, expect %v", ids, test.ids)
+			}
+			for i := range ids {
+				if ids[i] != test.ids[i] {
+					t.Fatalf("cursor ids %v, expect %v", ids, test.ids)
+				}
+			}
+		})
+	}
+
+	find := testMsg(t, bson.D{{Name: "find", Value: "users"}, {Name: "$db", Value: "shop"}}, "")
+	if _, ok := RewriteCursorIDs(testParse(t, find), rewrite); ok {
+		t.Error("find rewritten")
+	}
+}
+
+func TestReplyCursorID(t *testing.T) {
+	reply := testParse(t, testMsg(t, bson.D{{Name: "cursor", Value: bson.D{{Name: "id", Value: int64(7)},
+		{Name: "ns", Value: "shop.users"}, {Name: "firstBatch", Value: []interface{}{}}}}, {Name: "ok", Value: 1.0}}, ""))
+	if id := ReplyCursorID(reply); id != 7 {
+		t.Errorf("cursor id %d, expect 7", id)
+	}
+	legacy := &OpReply{CursorID: 8}
+	if id := ReplyCursorID(legacy); id != 8 {
+		t.Errorf("legacy cursor id %d, expect 8", id)
+	}
+	noCursor := testParse(t, testMsg(t, bson.D{{Name: "ok", Value: 1.0}}, ""))
+	if id := ReplyCursorID(noCursor); id != 0 {
+		t.Errorf("cursor id %d without cursor", id)
+	}
+}
+
+func TestCursorTracker(t *testing.T) {
+	const exhaust, cursorNotFound = int32(queryExhaust), int32(replyCursorNotFound)
+	msg := func(body bson.D) Message { return testParse(t, testMsg(t, body, "")) }
+	docs := func(n int) []interface{} {
+		batch := make([]interface{}, n)
+		for i := range batch {
+			batch[i] = bson.M{"_id": i}
+		}
+		return batch
+	}
+	cursorReply := func(id int64, batch string, n int) Message {
+		return msg(bson.D{{Name: "cursor", Value: bson.D{{Name: "id", Value: id}, {Name: "ns", Value: "shop.users"},
+			{Name: batch, Value: docs(n)}}}, {Name: "ok", Value: 1.0}})
+	}
+	find := msg(bson.D{{Name: "find", Value: "users"}, {Name: "$db", Value: "shop"}})
+	aggregate := msg(bson.D{{Name: "aggregate", Value: "users"}, {Name: "pipeline", Value: []interface{}{}}, {Name: "$db", Value: "shop"}})
+	getMore := msg(bson.D{{Name: "getMore", Value: int64(7)}, {Name: "collection", Value: "users"}, {Name: "$db", Value: "shop"}})
+	killCursors := msg(bson.D{{Name: "killCursors", Value: "users"}, {Name: "cursors", Value: []int64{7}}, {Name: "$db", Value: "shop"}})
+	notFound := msg(bson.D{{Name: "ok", Value: 0.0}, {Name: "errmsg", Value: "cursor id 7 not found"}, {Name: "code", Value: 43}})
+	query := func(flags int32) Message {
+		return testParse(t, testLegacyMsg(t, opQuery, flags, "shop.users", int32(0), int32(0), bson.M{"status": "A"}))
+	}
+	reply := func(flags int32, id int64, n int32) Message {
+		parts := []interface{}{flags, id, int32(0), n}
+		for i := int32(0); i < n; i++ {
+			parts = append(parts, bson.M{"_id": i})
+		}
+		return testParse(t, testLegacyMsg(t, opReply, parts...))
+	}
+	legacyGetMore := testParse(t, testLegacyMsg(t, opGetMore, int32(0), "shop.users", int32(0), int64(9)))
+	legacyKillCursors := testParse(t, testLegacyMsg(t, opKillCursors, int32(0), int32(1), int64(9)))
+	exchange := func(req, resp Message, sequence int) *Exchange {
+		ex := &Exchange{RemoteAddr: "10.0.0.1:52117", Request: req, Response: resp, Sequence: sequence}
+		if resp != nil {
+			ex.OK, ex.ErrMsg, ex.Code = ReplyStatus(resp)
+		}
+		return ex
+	}
+
+	tests := []struct {
+		name      string
+		exchanges []*Exchange
+		// ended are the cursors in the order they end, Close included
+		ended []Cursor
+	}{
+		{"find getMore exhausted", []*Exchange{
+			exchange(find, cursorReply(7, "firstBatch", 2), 0),
+			exchange(getMore, cursorReply(7, "nextBatch", 2), 0),
+			exchange(getMore, cursorReply(0, "nextBatch", 1), 0),
+		}, []Cursor{{ID: 7, Namespace: "shop.users", Command: "find", Documents: 5, Batches: 3, State: CursorExhausted}}},
+		{"first batch only", []*Exchange{
+			exchange(find, cursorReply(0, "firstBatch", 2), 0),
+		}, nil},
+		{"killCursors", []*Exchange{
+			exchange(aggregate, cursorReply(7, "firstBatch", 2), 0),
+			exchange(killCursors, msg(bson.D{{Name: "cursorsKilled", Value: []int64{7}}, {Name: "ok", Value: 1.0}}), 0),
+		}, []Cursor{{ID: 7, Namespace: "shop.users", Command: "aggregate", Documents: 2, Batches: 1, State: CursorKilled}}},
+		{"getMore cursorNotFound", []*Exchange{
+			exchange(find, cursorReply(7, "firstBatch", 2), 0),
+			exchange(getMore, notFound, 0),
+		}, []Cursor{{ID: 7, Namespace: "shop.users", Command: "find", Documents: 2, Batches: 1, State: CursorNotFound}}},
+		{"legacy getMore", []*Exchange{
+			exchange(query(0), reply(0, 9, 2), 0),
+			exchange(legacyGetMore, reply(0, 0, 1), 0),
+		}, []Cursor{{ID: 9, Namespace: "shop.users", Command: "QUERY", Documents: 3, Batches: 2, State: CursorExhausted}}},
+		{"legacy getMore CursorNotFound flag", []*Exchange{
+			exchange(query(0), reply(0, 9, 2), 0),
+			exchange(legacyGetMore, reply(cursorNotFound, 0, 0), 0),
+		}, []Cursor{{ID: 9, Namespace: "shop.users", Command: "QUERY", Documents: 2, Batches: 1, State: CursorNotFound}}},
+		{"legacy killCursors", []*Exchange{
+			exchange(query(0), reply(0, 9, 2), 0),
+			exchange(legacyKillCursors, nil, 0),
+		}, []Cursor{{ID: 9, Namespace: "shop.users", Command: "QUERY", Documents: 2, Batches: 1, State: CursorKilled}}},
+		{"legacy exhaust query", []*Exchange{
+			exchange(query(exhaust), reply(0, 9, 2), 0),
+			exchange(query(exhaust), reply(0, 9, 2), 1),
+			exchange(query(exhaust), reply(0, 0, 1), 2),
+		}, []Cursor{{ID: 9, Namespace: "shop.users", Command: "QUERY", Documents: 5, Batches: 3, State: CursorExhausted}}},
+		{"leaked", []*Exchange{
+			exchange(find, cursorReply(7, "firstBatch", 2), 0),
+			exchange(getMore, cursorReply(7, "nextBatch", 2), 0),
+		}, []Cursor{{ID: 7, Namespace: "shop.users", Command: "find", Documents: 4, Batches: 2, State: CursorLeaked}}},
+		{"unanswered getMore", []*Exchange{
+			exchange(find, cursorReply(7, "firstBatch", 2), 0),
+			exchange(getMore, nil, 0),
+		}, []Cursor{{ID: 7, Namespace: "shop.users", Command: "find", Documents: 2, Batches: 1, State: CursorLeaked}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ended []*Cursor
+			tracker := NewCursorTracker("10.0.0.1:52117", func(c *Cursor) { ended = append(ended, c) })
+			for _, ex := range test.exchanges {
+				tracker.Exchange(ex)
+			}
+			tracker.Close()
+			if len(ended) != len(test.ended) {
+				t.Fatalf("%d cursors ended, expect %d", len(ended), len(test.ended))
+			}
+			for i, e := range test.ended {
+				c := ended[i]
+				if c.ID != e.ID || c.Namespace != e.Namespace || c.Command != e.Command ||
+					c.Documents != e.Documents || c.Batches != e.Batches || c.State != e.State {
+					t.Errorf("cursor %d %s %s documents:%d batches:%d %s, expect %d %s %s documents:%d batches:%d %s",
+						c.ID, c.Namespace, c.Command, c.Documents, c.Batches, c.State,
+						e.ID, e.Namespace, e.Command, e.Documents, e.Batches, e.State)
+				}
+				if c.RemoteAddr != "10.0.0.1:52117" {
+					t.Errorf("cursor %d of %s", c.ID, c.RemoteAddr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// DecodeError is reported when a message is malformed or truncated, the parser
+// skips the rest of the message by its MessageLength and continues with the next one
+type DecodeError struct {
+	OpCode     int32
+	RequestID  int32
+	ResponseTo int32
+	// Field is the name of the message field which failed to decode
+	Field string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s id:%d to:%d failed at %s: %v",
+		opCodeName(e.OpCode), e.RequestID, e.ResponseTo, e.Field, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decoder reads the fields of one message, after the first failure all reads
+// are skipped and err holds a *DecodeError describing the failure
+type decoder struct {
+	r      *bytes.Reader
+	header MsgHeader
+	// body is the whole body of the message, it is nil for the decoder of a section
+	body []byte
+	err  error
+}
+
+func newDecoder(header MsgHeader, body []byte) *decoder {
+	return &decoder{r: bytes.NewReader(body), header: header, body: body}
+}
+
+func (d *decoder) fail(field string, err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = &DecodeError{
+		OpCode:     d.header.OpCode,
+		RequestID:  d.header.RequestID,
+		ResponseTo: d.header.ResponseTo,
+		Field:      field,
+		Err:        err,
+	}
+}
+
+func (d *decoder) uint8(field string) uint8 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := readUInt8(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return n
+}
+
+func (d *decoder) int32(field string) int32 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := readInt32(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return n
+}
+
+func (d *decoder) int64(field string) int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := readInt64(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return n
+}
+
+func (d *decoder) cstring(field string) string {
+	if d.err != nil {
+		return ""
+	}
+	s, err := readCString(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return s
+}
+
+func (d *decoder) document(field string) bson.M {
+	if d.err != nil {
+		return nil
+	}
+	m, err := readDocument(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return m
+}
+
+// command read a command document, name is its first key which is the command
+// name, raw is the document in bson which keeps the order of the keys
+func (d *decoder) command(field string) (doc bson.M, name string, raw []byte) {
+	if d.err != nil {
+		return nil, "", nil
+	}
+	one, err := readOne(d.r)
+	if err == nil {
+		err = bson.Unmarshal(one, &doc)
+	}
+	if err != nil {
+		d.fail(field, err)
+		return nil, "", nil
+	}
+	return doc, commandName(one), one
+}
+
+// optionalDocument read a document which may be absent at the end of the message
+func (d *decoder) optionalDocument(field string) bson.M {
+	if d.err != nil {
+		return nil
+	}
+	m, err := readDocument(d.r)
+	if err != nil && err != io.EOF {
+		d.fail(field, err)
+	}
+	return m
+}
+
+// documents read documents until the end of the message
+func (d *decoder) documents(field string) []bson.M {
+	if d.err != nil {
+		return nil
+	}
+	ms, err := readDocuments(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return ms
+}
+
+// rest read all remaining bytes of the message
+func (d *decoder) rest(field string) []byte {
+	if d.err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(d.r)
+	if err != nil {
+		d.fail(field, err)
+	}
+	return b
+}
+
+// section returns a decoder for the next size bytes of the message
+func (d *decoder) section(field string, size int32) *decoder {
+	sub := &decoder{r: bytes.NewReader(nil), header: d.header, err: d.err}
+	if d.err != nil {
+		return sub
+	}
+	if size < 0 || int64(size) > int64(d.r.Len()) {
+		d.fail(field, fmt.Errorf("invalid section size: %d, %d bytes left", size, d.r.Len()))
+		sub.err = d.err
+		return sub
+	}
+	b := make([]byte, size)
+	_, _ = io.ReadFull(d.r, b)
+	sub.r = bytes.NewReader(b)
+	return sub
+}
+
+// checksum read the CRC-32C at the end of the message and verify it, it covers
+// the header and the body before the checksum
+func (d *decoder) checksum(field string) uint32 {
+	if d.err != nil {
+		return 0
+	}
+	sum, err := readUint32(d.r)
+	if err != nil {
+		d.fail(field, err)
+		return 0
+	}
+
+	header := make([]byte, 4*4)
+	putHeader(header, d.header)
+	computed := crc32.Update(0, castagnoli, header)
+	computed = crc32.Update(computed, castagnoli, d.body[:len(d.body)-4])
+	if computed != sum {
+		d.fail(field, fmt.Errorf("checksum mismatch: %08x in message, %08x computed", sum, computed))
+	}
+	return sum
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// more reports whether there is anything left to read in the message
+func (d *decoder) more() bool {
+	return d.err == nil && d.r.Len() > 0
+}
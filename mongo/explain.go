@@ -0,0 +1,154 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Plan is the winning plan and execution statistics of an explained operation
+type Plan struct {
+	// Stages are the stages of the winning plan from the first to run, such as
+	// IXSCAN sku_1 then FETCH
+	Stages         []string
+	KeysExamined   int64
+	DocsExamined   int64
+	Returned       int64
+	ExecutionMilli int64
+}
+
+// CollectionScan reports whether the plan reads the whole collection
+func (p *Plan) CollectionScan() bool {
+	for _, stage := range p.Stages {
+		if strings.HasPrefix(stage, "COLLSCAN") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plan) String() string {
+	return fmt.Sprintf("%s keysExamined:%d docsExamined:%d nReturned:%d executionTimeMillis:%d",
+		strings.Join(p.Stages, " > "), p.KeysExamined, p.DocsExamined, p.Returned, p.ExecutionMilli)
+}
+
+// explainable are the commands explain runs, by lower case name
+var explainable = map[string]bool{"find": true, "aggregate": true, "count": true}
+
+// commandOnlyFields are the fields a driver adds to a command which explain
+// doesn't accept in the explained command
+var commandOnlyFields = map[string]bool{
+	"lsid": true, "txnNumber": true, "autocommit": true, "startTransaction": true,
+	"readConcern": true, "writeConcern": true,
+}
+
+// ExplainCommand returns the database and the explain command with
+// executionStats of a find, aggregate or count request, ok is false for the
+// other requests, a legacy query is explained as a find command
+func ExplainCommand(msg Message) (db string, explain bson.D, ok bool) {
+	op := Classify(msg)
+	if op == nil || !explainable[strings.ToLower(op.Command)] || op.Database == "" {
+		return "", nil, false
+	}
+
+	var cmd bson.D
+	if q, isQuery := msg.(*OpQuery); isQuery && q.command == "" {
+		cmd = bson.D{{Name: "find", Value: op.Collection}}
+		if op.Filter != nil {
+			cmd = append(cmd, bson.DocElem{Name: "filter", Value: op.Filter})
+		}
+		if op.Projection != nil {
+			cmd = append(cmd, bson.DocElem{Name: "projection", Value: op.Projection})
+		}
+		if op.Sort != nil {
+			cmd = append(cmd, bson.DocElem{Name: "sort", Value: op.Sort})
+		}
+		if op.Skip != 0 {
+			cmd = append(cmd, bson.DocElem{Name: "skip", Value: op.Skip})
+		}
+		if op.Limit != 0 {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: op.Limit})
+		}
+	} else {
+		var doc bson.D
+		if err := bson.Unmarshal(msg.base().document, &doc); err != nil {
+			return "", nil, false
+		}
+		if len(doc) > 0 && doc[0].Name == "$query" {
+			// a command of a legacy driver wrapped with its read preference
+			inner, isDoc := doc[0].Value.(bson.D)
+			if !isDoc {
+				return "", nil, false
+			}
+			doc = inner
+		}
+		for _, elem := range doc {
+			if strings.HasPrefix(elem.Name, "$") || commandOnlyFields[elem.Name] {
+				continue
+			}
+			cmd = append(cmd, elem)
+		}
+	}
+	return op.Database, bson.D{
+		{Name: "explain", Value: cmd},
+		{Name: "verbosity", Value: "executionStats"},
+	}, true
+}
+
+// ParsePlan read the winning plan of an explain reply, the plan of an
+// aggregate is the plan of its $cursor stage when the pipeline was not pushed
+// down to the query engine
+func ParsePlan(msg Message) (*Plan, error) {
+	if ok, errMsg, code := ReplyStatus(msg); !ok {
+		return nil, fmt.Errorf("explain failed: %s (code %d)", errMsg, code)
+	}
+	reply := ReplyDocument(msg)
+
+	explain := reply
+	if _, ok := explain["queryPlanner"]; !ok {
+		stages, _ := reply["stages"].([]interface{})
+		if len(stages) > 0 {
+			explain = toM(toM(stages[0])["$cursor"])
+		}
+	}
+	planner := toM(explain["queryPlanner"])
+	if planner == nil {
+		return nil, fmt.Errorf("no queryPlanner in explain reply")
+	}
+
+	winning := toM(planner["winningPlan"])
+	if queryPlan := toM(winning["queryPlan"]); queryPlan != nil {
+		// the slot based engine nests the plan
+		winning = queryPlan
+	}
+	plan := &Plan{}
+	for stage := winning; stage != nil; stage = toM(stage["inputStage"]) {
+		name, _ := stage["stage"].(string)
+		if index, _ := stage["indexName"].(string); index != "" {
+			// the key pattern is decoded without the order of its keys
+			name += " " + index
+		}
+		plan.Stages = append([]string{name}, plan.Stages...)
+	}
+
+	stats := toM(explain["executionStats"])
+	plan.KeysExamined = toInt64(stats["totalKeysExamined"])
+	plan.DocsExamined = toInt64(stats["totalDocsExamined"])
+	plan.Returned = toInt64(stats["nReturned"])
+	plan.ExecutionMilli = toInt64(stats["executionTimeMillis"])
+	return plan, nil
+}
+
+// EncodeMsg returns an OP_MSG with the single body doc
+func EncodeMsg(requestID int32, doc bson.D) ([]byte, error) {
+	body, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	// header, flagBits and the kind of the body section
+	b := make([]byte, 4*4+4+1, 4*4+4+1+len(body))
+	b = append(b, body...)
+	putHeader(b, MsgHeader{MessageLength: int32(len(b)), RequestID: requestID, OpCode: opMsgNew})
+	return b, nil
+}
@@ -0,0 +1,314 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// JSONMode selects how documents are rendered, see
+// https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+type JSONMode int
+
+const (
+	// Relaxed is Extended JSON v2 relaxed mode, numbers and dates are written
+	// as plain JSON when no precision is lost
+	Relaxed JSONMode = iota
+	// Canonical is Extended JSON v2 canonical mode, every BSON type is kept
+	Canonical
+	// Shell is the syntax of the mongo shell, such as ObjectId("...") and ISODate("..."),
+	// it is not valid JSON
+	Shell
+)
+
+var jsonModeNames = map[JSONMode]string{
+	Relaxed:   "relaxed",
+	Canonical: "canonical",
+	Shell:     "shell",
+}
+
+func (mode JSONMode) String() string {
+	return jsonModeNames[mode]
+}
+
+// ParseJSONMode returns the mode named relaxed, canonical or shell
+func ParseJSONMode(name string) (JSONMode, error) {
+	for mode, modeName := range jsonModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return Relaxed, fmt.Errorf("unknown JSON mode: %s", name)
+}
+
+// ExtJSON render v, which is a document, an array or a value decoded from bson,
+// keys of bson.M are sorted as bson.M doesn't keep their order
+func ExtJSON(v interface{}, mode JSONMode) string {
+	var buf bytes.Buffer
+	writeExtJSON(&buf, v, mode)
+	return buf.String()
+}
+
+func writeExtJSON(buf *bytes.Buffer, v interface{}, mode JSONMode) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeJSONString(buf, v)
+	case int:
+		// mgo decodes int32 as int
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			writeInt32(buf, int64(v), mode)
+		} else {
+			writeInt64(buf, int64(v), mode)
+		}
+	case uint8:
+		writeInt32(buf, int64(v), mode)
+	case int32:
+		writeInt32(buf, int64(v), mode)
+	case uint32:
+		if v <= math.MaxInt32 {
+			writeInt32(buf, int64(v), mode)
+		} else {
+			writeInt64(buf, int64(v), mode)
+		}
+	case int64:
+		writeInt64(buf, v, mode)
+	case float64:
+		writeDouble(buf, v, mode)
+	case bson.Decimal128:
+		writeWrapped(buf, mode, "NumberDecimal", strconv.Quote(v.String()), "$numberDecimal", quoteJSON(v.String()))
+	case bson.ObjectId:
+		writeWrapped(buf, mode, "ObjectId", strconv.Quote(v.Hex()), "$oid", quoteJSON(v.Hex()))
+	case time.Time:
+		writeDate(buf, v, mode)
+	case []byte:
+		writeBinary(buf, 0, v, mode)
+	case bson.Binary:
+		writeBinary(buf, v.Kind, v.Data, mode)
+	case bson.MongoTimestamp:
+		t, i := uint32(uint64(v)>>32), uint32(v)
+		if mode == Shell {
+			fmt.Fprintf(buf, "Timestamp(%d, %d)", t, i)
+		} else {
+			fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, t, i)
+		}
+	case bson.RegEx:
+		if mode == Shell {
+			fmt.Fprintf(buf, "/%s/%s", strings.Replace(v.Pattern, "/", `\/`, -1), v.Options)
+		} else {
+			buf.WriteString(`{"$regularExpression":{"pattern":`)
+			writeJSONString(buf, v.Pattern)
+			buf.WriteString(`,"options":`)
+			writeJSONString(buf, v.Options)
+			buf.WriteString("}}")
+		}
+	case bson.DBPointer:
+		if mode == Shell {
+			fmt.Fprintf(buf, "DBPointer(%s, ObjectId(%q))", strconv.Quote(v.Namespace), v.Id.Hex())
+		} else {
+			buf.WriteString(`{"$dbPointer":{"$ref":`)
+			writeJSONString(buf, v.Namespace)
+			fmt.Fprintf(buf, `,"$id":{"$oid":"%s"}}}`, v.Id.Hex())
+		}
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeJSONString(buf, v.Code)
+		if v.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			writeExtJSON(buf, v.Scope, mode)
+		}
+		buf.WriteString("}")
+	case bson.Symbol:
+		if mode == Shell {
+			writeJSONString(buf, string(v))
+		} else {
+			buf.WriteString(`{"$symbol":`)
+			writeJSONString(buf, string(v))
+			buf.WriteString("}")
+		}
+	case bson.M:
+		writeMap(buf, v, mode)
+	case map[string]interface{}:
+		writeMap(buf, v, mode)
+	case bson.D:
+		buf.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeJSONString(buf, elem.Name)
+			buf.WriteString(":")
+			writeExtJSON(buf, elem.Value, mode)
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeExtJSON(buf, elem, mode)
+		}
+		buf.WriteString("]")
+	case []bson.M:
+		buf.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeMap(buf, elem, mode)
+		}
+		buf.WriteString("]")
+	case []int64:
+		buf.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeInt64(buf, elem, mode)
+		}
+		buf.WriteString("]")
+	default:
+		switch v {
+		case bson.MinKey:
+			writeWrapped(buf, mode, "MinKey", "", "$minKey", "1")
+		case bson.MaxKey:
+			writeWrapped(buf, mode, "MaxKey", "", "$maxKey", "1")
+		case bson.Undefined:
+			writeWrapped(buf, mode, "undefined", "", "$undefined", "true")
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				fmt.Fprintf(buf, "{\"error\":%s}", quoteJSON(err.Error()))
+				return
+			}
+			buf.Write(b)
+		}
+	}
+}
+
+// writeWrapped write a value as shellFunc(shellArg) in shell mode, otherwise
+// as {"key":value}, shellFunc alone is written when shellArg is empty
+func writeWrapped(buf *bytes.Buffer, mode JSONMode, shellFunc, shellArg, key, value string) {
+	if mode == Shell {
+		buf.WriteString(shellFunc)
+		if shellArg != "" {
+			buf.WriteString("(" + shellArg + ")")
+		}
+		return
+	}
+	buf.WriteString(`{"` + key + `":` + value + "}")
+}
+
+func writeMap(buf *bytes.Buffer, m map[string]interface{}, mode JSONMode) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		writeJSONString(buf, k)
+		buf.WriteString(":")
+		writeExtJSON(buf, m[k], mode)
+	}
+	buf.WriteString("}")
+}
+
+func writeInt32(buf *bytes.Buffer, n int64, mode JSONMode) {
+	s := strconv.FormatInt(n, 10)
+	if mode == Canonical {
+		buf.WriteString(`{"$numberInt":"` + s + `"}`)
+		return
+	}
+	buf.WriteString(s)
+}
+
+func writeInt64(buf *bytes.Buffer, n int64, mode JSONMode) {
+	s := strconv.FormatInt(n, 10)
+	switch mode {
+	case Canonical:
+		buf.WriteString(`{"$numberLong":"` + s + `"}`)
+	case Shell:
+		buf.WriteString("NumberLong(" + s + ")")
+	default:
+		buf.WriteString(s)
+	}
+}
+
+func writeDouble(buf *bytes.Buffer, f float64, mode JSONMode) {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	case math.IsNaN(f):
+		s = "NaN"
+	default:
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		if !bytes.ContainsAny([]byte(s), ".E") {
+			// keep the value a double when read back
+			s += ".0"
+		}
+	}
+
+	finite := !math.IsInf(f, 0) && !math.IsNaN(f)
+	switch {
+	case mode == Shell, mode == Relaxed && finite:
+		buf.WriteString(s)
+	default:
+		buf.WriteString(`{"$numberDouble":"` + s + `"}`)
+	}
+}
+
+func writeDate(buf *bytes.Buffer, t time.Time, mode JSONMode) {
+	t = t.UTC()
+	iso := t.Format("2006-01-02T15:04:05.000Z")
+	ms := t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+	switch {
+	case mode == Shell:
+		fmt.Fprintf(buf, "ISODate(%q)", iso)
+	case mode == Relaxed && t.Year() >= 1970 && t.Year() <= 9999:
+		fmt.Fprintf(buf, `{"$date":"%s"}`, iso)
+	default:
+		fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, ms)
+	}
+}
+
+func writeBinary(buf *bytes.Buffer, kind byte, data []byte, mode JSONMode) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if mode == Shell {
+		fmt.Fprintf(buf, "BinData(%d, %q)", kind, encoded)
+		return
+	}
+	fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, encoded, kind)
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteString(quoteJSON(s))
+}
+
+// quoteJSON returns s as a JSON string without escaping HTML characters
+func quoteJSON(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return string(bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,395 @@
+package mongo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// MsgHeader is the standard header of every wire protocol message
+type MsgHeader struct {
+	MessageLength int32
+	RequestID     int32
+	ResponseTo    int32
+	OpCode        int32
+}
+
+// Compression describes how a message was wrapped in OP_COMPRESSED
+type Compression struct {
+	Compressor     string
+	CompressedSize int
+	Ratio          float64
+}
+
+// Message is a decoded wire protocol message, it is one of
+// *OpQuery, *OpReply, *OpMsg, *OpInsert, *OpUpdate, *OpDelete, *OpGetMore,
+// *OpKillCursors, *OpCommand, *OpCommandReply, *OpLegacyMsg and *OpRaw
+type Message interface {
+	// Header returns the header of the message, for a compressed message it is
+	// the header of the original message
+	Header() MsgHeader
+	// Compression returns nil if the message was not compressed
+	Compression() *Compression
+	// Received returns the time the message was received
+	Received() time.Time
+	// Raw returns the message as it was on the wire including the header,
+	// for a compressed message it is the OP_COMPRESSED message
+	Raw() []byte
+	// String returns a human-readable one line description of the message
+	String() string
+	// Format is the same as String with the documents rendered in mode
+	Format(mode JSONMode) string
+
+	base() *message
+}
+
+// message holds the fields shared by all messages
+type message struct {
+	header      MsgHeader
+	compression *Compression
+	received    time.Time
+	raw         []byte
+	// command is the name of the command a request runs
+	command string
+	// document is the query or command document of a request in bson
+	document []byte
+}
+
+func (m *message) Header() MsgHeader {
+	return m.header
+}
+
+func (m *message) Compression() *Compression {
+	return m.compression
+}
+
+func (m *message) Received() time.Time {
+	return m.received
+}
+
+func (m *message) Raw() []byte {
+	return m.raw
+}
+
+func (m *message) base() *message {
+	return m
+}
+
+// OpName returns the name of the message's opCode, such as QUERY or OP_MSG
+func OpName(msg Message) string {
+	return opCodeName(msg.Header().OpCode)
+}
+
+// OpQuery is a legacy query (OP_QUERY)
+type OpQuery struct {
+	message
+	Flags                int32
+	FullCollectionName   string
+	NumberToSkip         int32
+	NumberToReturn       int32
+	Query                bson.M
+	ReturnFieldsSelector bson.M
+}
+
+func (m *OpQuery) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpQuery) Format(mode JSONMode) string {
+	return fmt.Sprintf("QUERY id:%d coll:%s toskip:%d toret:%d flag:%b query:%v sel:%v",
+		m.header.RequestID,
+		m.FullCollectionName,
+		m.NumberToSkip,
+		m.NumberToReturn,
+		m.Flags,
+		ExtJSON(m.Query, mode),
+		ExtJSON(m.ReturnFieldsSelector, mode))
+}
+
+// OpReply is the reply of OP_QUERY and OP_GET_MORE (OP_REPLY)
+type OpReply struct {
+	message
+	ResponseFlags  int32
+	CursorID       int64
+	StartingFrom   int32
+	NumberReturned int32
+	Documents      []bson.M
+}
+
+func (m *OpReply) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpReply) Format(mode JSONMode) string {
+	return fmt.Sprintf("REPLY to:%d flag:%b curID:%d from:%d reted:%d docs:%v",
+		m.header.ResponseTo,
+		m.ResponseFlags,
+		m.CursorID,
+		m.StartingFrom,
+		m.NumberReturned,
+		docsJson(m.Documents, mode))
+}
+
+// Section is one section of OP_MSG, Kind 0 carries a single Body document,
+// Kind 1 carries a document sequence named by Identifier
+type Section struct {
+	Kind       uint8
+	Body       bson.M
+	Identifier string
+	Documents  []bson.M
+}
+
+// flag bits of OP_MSG
+const (
+	// MsgChecksumPresent is set when the message ends with a CRC-32C checksum
+	MsgChecksumPresent = 1 << 0
+	// MsgMoreToCome is set when another message follows without waiting for a
+	// reply, a request with it set expects no reply
+	MsgMoreToCome = 1 << 1
+	// MsgExhaustAllowed is set on requests when the client accepts replies with moreToCome
+	MsgExhaustAllowed = 1 << 16
+)
+
+var msgFlagNames = []struct {
+	bit  uint32
+	name string
+}{
+	{MsgChecksumPresent, "checksumPresent"},
+	{MsgMoreToCome, "moreToCome"},
+	{MsgExhaustAllowed, "exhaustAllowed"},
+}
+
+// OpMsg is the extensible message format introduced in MongoDB 3.6 (OP_MSG)
+type OpMsg struct {
+	message
+	FlagBits uint32
+	Sections []Section
+	// Checksum is zero unless ChecksumPresent, it is verified while decoding
+	Checksum uint32
+}
+
+func (m *OpMsg) ChecksumPresent() bool {
+	return m.FlagBits&MsgChecksumPresent != 0
+}
+
+func (m *OpMsg) MoreToCome() bool {
+	return m.FlagBits&MsgMoreToCome != 0
+}
+
+func (m *OpMsg) ExhaustAllowed() bool {
+	return m.FlagBits&MsgExhaustAllowed != 0
+}
+
+// Flags returns the names of the flag bits set, unknown bits are ignored
+func (m *OpMsg) Flags() []string {
+	var names []string
+	for _, flag := range msgFlagNames {
+		if m.FlagBits&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// Command returns the body merged with the document sequences as the server sees
+// it, each sequence becomes an array field named by its identifier, such as the
+// documents of an insert
+func (m *OpMsg) Command() bson.M {
+	command := bson.M{}
+	for _, section := range m.Sections {
+		if section.Kind == 0 {
+			for k, v := range section.Body {
+				command[k] = v
+			}
+		}
+	}
+	for _, section := range m.Sections {
+		if section.Kind != 1 {
+			continue
+		}
+		docs, _ := command[section.Identifier].([]interface{})
+		for _, doc := range section.Documents {
+			docs = append(docs, doc)
+		}
+		command[section.Identifier] = docs
+	}
+	return command
+}
+
+func (m *OpMsg) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpMsg) Format(mode JSONMode) string {
+	var flags string
+	for _, name := range m.Flags() {
+		flags += " " + name
+	}
+	if m.ChecksumPresent() {
+		flags += fmt.Sprintf(" checksum:%08x", m.Checksum)
+	}
+	return fmt.Sprintf("MSG id:%d to:%d flag:%b%s body:%v",
+		m.header.RequestID, m.header.ResponseTo, m.FlagBits, flags, ExtJSON(m.Command(), mode))
+}
+
+// OpInsert is a legacy insert (OP_INSERT)
+type OpInsert struct {
+	message
+	Flags              int32
+	FullCollectionName string
+	Documents          []bson.M
+}
+
+func (m *OpInsert) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpInsert) Format(mode JSONMode) string {
+	return fmt.Sprintf("INSERT id:%d coll:%s flag:%b docs:%v",
+		m.header.RequestID, m.FullCollectionName, m.Flags, docsJson(m.Documents, mode))
+}
+
+// OpUpdate is a legacy update (OP_UPDATE)
+type OpUpdate struct {
+	message
+	FullCollectionName string
+	Flags              int32
+	Selector           bson.M
+	Update             bson.M
+}
+
+func (m *OpUpdate) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpUpdate) Format(mode JSONMode) string {
+	return fmt.Sprintf("UPDATE id:%d coll:%s flag:%b sel:%v update:%v",
+		m.header.RequestID, m.FullCollectionName, m.Flags, ExtJSON(m.Selector, mode), ExtJSON(m.Update, mode))
+}
+
+// OpDelete is a legacy delete (OP_DELETE)
+type OpDelete struct {
+	message
+	FullCollectionName string
+	Flags              int32
+	Selector           bson.M
+}
+
+func (m *OpDelete) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpDelete) Format(mode JSONMode) string {
+	return fmt.Sprintf("DELETE id:%d coll:%s flag:%b sel:%v",
+		m.header.RequestID, m.FullCollectionName, m.Flags, ExtJSON(m.Selector, mode))
+}
+
+// OpGetMore is a legacy request for more documents of a cursor (OP_GET_MORE)
+type OpGetMore struct {
+	message
+	FullCollectionName string
+	NumberToReturn     int32
+	CursorID           int64
+}
+
+func (m *OpGetMore) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpGetMore) Format(mode JSONMode) string {
+	return fmt.Sprintf("GETMORE id:%d coll:%s toret:%d curID:%d",
+		m.header.RequestID, m.FullCollectionName, m.NumberToReturn, m.CursorID)
+}
+
+// OpKillCursors is a legacy request to close cursors (OP_KILL_CURSORS)
+type OpKillCursors struct {
+	message
+	CursorIDs []int64
+}
+
+func (m *OpKillCursors) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpKillCursors) Format(mode JSONMode) string {
+	return fmt.Sprintf("KILLCURSORS id:%d numCurID:%d curIDs:%d",
+		m.header.RequestID, len(m.CursorIDs), m.CursorIDs)
+}
+
+// OpCommand is the internal command format of MongoDB 3.2 (OP_COMMAND)
+type OpCommand struct {
+	message
+	Database    string
+	CommandName string
+	Metadata    bson.M
+	CommandArgs bson.M
+	InputDocs   []bson.M
+}
+
+func (m *OpCommand) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpCommand) Format(mode JSONMode) string {
+	return fmt.Sprintf("COMMAND id:%v db:%v meta:%v cmd:%v args:%v docs %v",
+		m.header.RequestID,
+		m.Database,
+		ExtJSON(m.Metadata, mode),
+		m.CommandName,
+		ExtJSON(m.CommandArgs, mode),
+		ExtJSON(m.InputDocs, mode))
+}
+
+// OpCommandReply is the reply of OP_COMMAND (OP_COMMANDREPLY)
+type OpCommandReply struct {
+	message
+	Metadata     bson.M
+	CommandReply bson.M
+	OutputDocs   []bson.M
+}
+
+func (m *OpCommandReply) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpCommandReply) Format(mode JSONMode) string {
+	return fmt.Sprintf("COMMANDREPLY to:%d id:%v meta:%v cmdReply:%v outputDocs:%v",
+		m.header.ResponseTo, m.header.RequestID, ExtJSON(m.Metadata, mode), ExtJSON(m.CommandReply, mode), ExtJSON(m.OutputDocs, mode))
+}
+
+// OpLegacyMsg is the diagnostic message of very old servers (opCode 1000)
+type OpLegacyMsg struct {
+	message
+	Message string
+}
+
+func (m *OpLegacyMsg) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpLegacyMsg) Format(mode JSONMode) string {
+	return fmt.Sprintf("MSG %d %s", m.header.RequestID, m.Message)
+}
+
+// OpRaw is a message whose body is not decoded, such as OP_RESERVED
+// and the deprecated command opCodes
+type OpRaw struct {
+	message
+	Body []byte
+}
+
+func (m *OpRaw) String() string {
+	return m.Format(Relaxed)
+}
+
+func (m *OpRaw) Format(mode JSONMode) string {
+	return fmt.Sprintf("%s id:%d to:%d size:%d", opCodeName(m.header.OpCode), m.header.RequestID, m.header.ResponseTo, len(m.Body))
+}
+
+func docsJson(docs []bson.M, mode JSONMode) string {
+	if len(docs) == 1 {
+		return ExtJSON(docs[0], mode)
+	}
+	return ExtJSON(docs, mode)
+}
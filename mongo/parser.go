@@ -2,13 +2,17 @@ package mongo
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/mylxsw/asteria/log"
 	"io"
-	"io/ioutil"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+var errInvalidHeader = errors.New("invalid message header")
+
 const (
 	opReply                  = 1
 	opMsg                    = 1000
@@ -23,331 +27,526 @@ const (
 	opCommandReplyDeprecated = 2009
 	opCommand                = 2010
 	opCommandReply           = 2011
+	opCompressed             = 2012
 	opMsgNew                 = 2013
 )
 
-type msgHeader struct {
-	MessageLength int32
-	RequestID     int32
-	ResponseTo    int32
-	OpCode        int32
+var opCodeNames = map[int32]string{
+	opReply:                  "REPLY",
+	opMsg:                    "MSG",
+	opUpdate:                 "UPDATE",
+	opInsert:                 "INSERT",
+	opReserved:               "RESERVED",
+	opQuery:                  "QUERY",
+	opGetMore:                "GETMORE",
+	opDelete:                 "DELETE",
+	opKillCursors:            "KILLCURSORS",
+	opCommandDeprecated:      "COMMAND_DEPRECATED",
+	opCommandReplyDeprecated: "COMMANDREPLY_DEPRECATED",
+	opCommand:                "COMMAND",
+	opCommandReply:           "COMMANDREPLY",
+	opCompressed:             "COMPRESSED",
+	opMsgNew:                 "OP_MSG",
+}
+
+func opCodeName(opCode int32) string {
+	if name, ok := opCodeNames[opCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", opCode)
 }
 
+// maxMessageSize is the largest message mongodb server accepts (maxMessageSizeBytes)
+const maxMessageSize = 48000000
+
+// Recorder receives every message decoded by a parser, msg is nil and err
+// is set when the data could not be decoded
+type Recorder func(msg Message, err error)
+
 type Parser struct {
-	pipeWriter       *io.PipeWriter
-	remoteAddr       string
-	pipeWriterClosed bool
-	recorder         func(opCode int32, message string, data map[string]interface{})
+	done       chan struct{}
+	buffer     *buffer
+	remoteAddr string
+	recorder   Recorder
+}
+
+// NewParser create a parser which parses the data written to it in a new goroutine,
+// writing to the parser never blocks: when the parser falls behind more than
+// DefaultBufferSize bytes, data is dropped and the parser resynchronizes at the next message
+func NewParser(remoteAddr string, recorder Recorder) *Parser {
+	return newParser(remoteAddr, recorder, false)
 }
 
-func NewParser(remoteAddr string, recorder func(opCode int32, message string, data map[string]interface{})) *Parser {
-	pr, pw := io.Pipe()
+// NewBlockingParser is the same as NewParser except that writing blocks instead of dropping
+// data when the parser falls behind, it is used when nothing waits on the data, such as
+// when reading a capture file
+func NewBlockingParser(remoteAddr string, recorder Recorder) *Parser {
+	return newParser(remoteAddr, recorder, true)
+}
+
+// ParseMessage decodes b, a whole message received at received, with a blocking
+// parser, the error is that of the parser when no message is decoded
+func ParseMessage(b []byte, received time.Time) (Message, error) {
+	var msg Message
+	var parseErr error
+	parser := NewBlockingParser("", func(m Message, err error) {
+		if err != nil {
+			if parseErr == nil {
+				parseErr = err
+			}
+		} else if msg == nil {
+			msg = m
+		}
+	})
+	_, _ = parser.WriteWithTime(b, received)
+	parser.Close()
+	parser.Wait()
+	if msg != nil {
+		return msg, nil
+	}
+	if parseErr == nil {
+		parseErr = errors.New("no message decoded")
+	}
+	return nil, parseErr
+}
+
+func newParser(remoteAddr string, recorder Recorder, blocking bool) *Parser {
 	parser := &Parser{
-		pipeWriter: pw,
+		done:       make(chan struct{}),
+		buffer:     newBuffer(DefaultBufferSize),
 		remoteAddr: remoteAddr,
 		recorder:   recorder,
 	}
-	go parser.Parse(pr)
+	parser.buffer.blocking = blocking
+	go func() {
+		defer close(parser.done)
+		parser.Parse(parser.buffer)
+	}()
 	return parser
 }
 
 func (parser *Parser) Write(p []byte) (n int, err error) {
-	if parser.pipeWriterClosed {
-		return len(p), nil
-	}
-	return parser.pipeWriter.Write(p)
+	return parser.buffer.Write(p)
+}
+
+// WriteWithTime is the same as Write, t is the time p was received,
+// it is used when the data is not parsed in real time, such as from a capture file
+func (parser *Parser) WriteWithTime(p []byte, t time.Time) (n int, err error) {
+	return parser.buffer.writeWithTime(p, t)
+}
+
+// Gap tells the parser that some data before the next write is missing, the
+// parser resynchronizes at the next message header
+func (parser *Parser) Gap() {
+	parser.buffer.markGap()
 }
 
 func (parser *Parser) Close() {
-	parser.pipeWriterClosed = true
-	_ = parser.pipeWriter.Close()
+	parser.buffer.Close()
 }
 
-func (parser *Parser) writeParsedMessage(opCode int32, message string, data map[string]interface{}) {
-	if data == nil {
-		data = log.Fields{}
-	}
+// Wait blocks until all the data written before Close has been parsed
+func (parser *Parser) Wait() {
+	<-parser.done
+}
 
-	data["opCode"] = opCode
-	parser.recorder(opCode, message, data)
-	//switch opCode {
-	//case opCommand, opDelete, opInsert, opQuery, opUpdate, opMsg, opMsgNew:
-	//	if data == nil {
-	//		data = log.Fields{}
-	//	}
-	//
-	//	data["opCode"] = opCode
-	//	parser.recorder(opCode, message, data)
-	//default:
-	//}
+// RemoteAddr returns the address of the client whose traffic is parsed
+func (parser *Parser) RemoteAddr() string {
+	return parser.remoteAddr
 }
 
-func (parser *Parser) writeErrorMessage(message string) {
-	parser.recorder(0, message, log.Fields{
-		"opCode": 0,
-	})
+// Dropped returns how many writes and bytes were dropped because the parser fell behind
+func (parser *Parser) Dropped() (writes uint64, bytes uint64) {
+	return atomic.LoadUint64(&parser.buffer.dropped), atomic.LoadUint64(&parser.buffer.droppedBytes)
+}
+
+func (parser *Parser) writeParsedMessage(msg Message) {
+	parser.recorder(msg, nil)
 }
 
-func (parser *Parser) Parse(r *io.PipeReader) {
+func (parser *Parser) writeErrorMessage(err error) {
+	parser.recorder(nil, err)
+}
+
+func (parser *Parser) Parse(r io.Reader) {
 	defer func() {
 		if e := recover(); e != nil {
-			parser.writeErrorMessage(fmt.Sprintf("parser failed, painc: %v\n", e))
+			parser.writeErrorMessage(fmt.Errorf("parser failed, panic: %v", e))
 			debug.PrintStack()
-			parser.pipeWriterClosed = true
-			_ = parser.pipeWriter.Close()
+			parser.buffer.Close()
 		}
 	}()
+	synced := true
 	for {
-		header := msgHeader{}
-		err := binary.Read(r, binary.LittleEndian, &header)
+		header, raw, received, err := readMessage(r, synced)
 		if err != nil {
+			if err == errGap || err == errInvalidHeader {
+				if synced {
+					_, droppedBytes := parser.Dropped()
+					parser.writeErrorMessage(fmt.Errorf("%v, %d bytes dropped in total, resynchronizing", err, droppedBytes))
+				}
+				synced = false
+				continue
+			}
 			if err != io.EOF {
-				parser.writeErrorMessage(fmt.Sprintf("unexpected error:%v\n", err))
+				parser.writeErrorMessage(fmt.Errorf("unexpected error: %v", err))
 			}
 			break
 		}
-		rd := io.LimitReader(r, int64(header.MessageLength-4*4))
-		switch header.OpCode {
-		case opQuery:
-			parser.parseQuery(header, rd)
-		case opInsert:
-			parser.parseInsert(header, rd)
-		case opDelete:
-			parser.parseDelete(header, rd)
-		case opUpdate:
-			parser.parseUpdate(header, rd)
-		case opMsg:
-			parser.parseMsg(header, rd)
-		case opReply:
-			parser.parseReply(header, rd)
-		case opGetMore:
-			parser.parseGetMore(header, rd)
-		case opKillCursors:
-			parser.parseKillCursors(header, rd)
-		case opReserved:
-			parser.parseReserved(header)
-		case opCommandDeprecated:
-			parser.parseCommandDeprecated(header, rd)
-		case opCommandReplyDeprecated:
-			parser.parseCommandReplyDeprecated(header, rd)
-		case opCommand:
-			parser.parseCommand(header, rd)
-		case opCommandReply:
-			parser.parseCommandReply(header, rd)
-		case opMsgNew:
-			parser.parseMsgNew(header, rd)
-		default:
-			parser.writeErrorMessage(fmt.Sprintf("unknown OpCode: %d", header.OpCode))
-			_, err = io.Copy(ioutil.Discard, rd)
-			if err != nil {
-				parser.writeErrorMessage(fmt.Sprintf("read failed: %v", err))
-				break
-			}
+
+		synced = true
+		msg, err := decode(header, raw[4*4:])
+		if err != nil {
+			parser.writeErrorMessage(err)
+			continue
 		}
+		msg.base().received = received
+		msg.base().raw = raw
+		parser.writeParsedMessage(msg)
 	}
 }
 
-func (parser *Parser) parseQuery(header msgHeader, r io.Reader) {
-	flag := mustReadInt32(r)
-	fullCollectionName := readCString(r)
-	numberToSkip := mustReadInt32(r)
-	numberToReturn := mustReadInt32(r)
-	query := toJson(readDocument(r))
-	selector := toJson(readDocument(r))
-	parser.writeParsedMessage(
-		header.OpCode,
-		fmt.Sprintf("QUERY id:%d coll:%s toskip:%d toret:%d flag:%b query:%v sel:%v\n",
-			header.RequestID,
-			fullCollectionName,
-			numberToSkip,
-			numberToReturn,
-			flag,
-			query,
-			selector),
-		nil,
-	)
-}
-
-func (parser *Parser) parseInsert(header msgHeader, r io.Reader) {
-	flag := mustReadInt32(r)
-	fullCollectionName := readCString(r)
-	docs := readDocuments(r)
-	var docsStr string
-	if len(docs) == 1 {
-		docsStr = toJson(docs[0])
+// readMessage read a whole message from r, raw includes the header, when synced
+// is false the leading bytes are skipped until something looks like a message header
+func readMessage(r io.Reader, synced bool) (header MsgHeader, raw []byte, received time.Time, err error) {
+	if synced {
+		err = binary.Read(r, binary.LittleEndian, &header)
+		if err == nil && !validHeader(header) {
+			err = errInvalidHeader
+		}
 	} else {
-		docsStr = toJson(docs)
+		header, err = resync(r)
+	}
+	if err != nil {
+		return header, nil, received, err
+	}
+
+	received = time.Now()
+	if tr, ok := r.(timedReader); ok {
+		received = tr.readTime()
 	}
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("INSERT id:%d coll:%s flag:%b docs:%v\n",
-		header.RequestID, fullCollectionName, flag, docsStr), nil)
-}
 
-func (parser *Parser) parseUpdate(header msgHeader, r io.Reader) {
-	_ = mustReadInt32(r)
-	fullCollectionName := readCString(r)
-	flag := mustReadInt32(r)
-	selector := toJson(readDocument(r))
-	update := toJson(readDocument(r))
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("UPDATE id:%d coll:%s flag:%b sel:%v update:%v\n",
-		header.RequestID, fullCollectionName, flag, selector, update), nil)
+	raw = make([]byte, header.MessageLength)
+	putHeader(raw, header)
+	if _, err = io.ReadFull(r, raw[4*4:]); err != nil {
+		return header, nil, received, err
+	}
+	return header, raw, received, nil
 }
 
-func (parser *Parser) parseGetMore(header msgHeader, r io.Reader) {
-	_ = mustReadInt32(r)
-	fullCollectionName := readCString(r)
-	numberToReturn := mustReadInt32(r)
-	cursorID := readInt64(r)
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("GETMORE id:%d coll:%s toret:%d curID:%d\n",
-		header.RequestID, fullCollectionName, numberToReturn, cursorID), nil)
+// putHeader write header to the first 16 bytes of b in wire format
+func putHeader(b []byte, header MsgHeader) {
+	binary.LittleEndian.PutUint32(b[0:], uint32(header.MessageLength))
+	binary.LittleEndian.PutUint32(b[4:], uint32(header.RequestID))
+	binary.LittleEndian.PutUint32(b[8:], uint32(header.ResponseTo))
+	binary.LittleEndian.PutUint32(b[12:], uint32(header.OpCode))
 }
 
-func (parser *Parser) parseDelete(header msgHeader, r io.Reader) {
-	_ = mustReadInt32(r)
-	fullCollectionName := readCString(r)
-	flag := mustReadInt32(r)
-	selector := toJson(readDocument(r))
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("DELETE id:%d coll:%s flag:%b sel:%v \n",
-		header.RequestID, fullCollectionName, flag, selector), nil)
+// timedReader is implemented by readers which know when the data was received
+type timedReader interface {
+	readTime() time.Time
 }
 
-func (parser *Parser) parseKillCursors(header msgHeader, r io.Reader) {
-	_ = mustReadInt32(r)
-	numberOfCursorIDs := mustReadInt32(r)
-	var cursorIDs []int64
+// resync scan r byte by byte for the next valid message header
+func resync(r io.Reader) (header MsgHeader, err error) {
+	window := make([]byte, 4*4)
+	filled := 0
 	for {
-		n := readInt64(r)
-		if n != nil {
-			cursorIDs = append(cursorIDs, *n)
+		if filled < len(window) {
+			n, err := io.ReadFull(r, window[filled:])
+			filled += n
+			if err != nil && err != errGap {
+				return header, err
+			}
 			continue
 		}
-		break
+
+		header = MsgHeader{
+			MessageLength: int32(binary.LittleEndian.Uint32(window[0:])),
+			RequestID:     int32(binary.LittleEndian.Uint32(window[4:])),
+			ResponseTo:    int32(binary.LittleEndian.Uint32(window[8:])),
+			OpCode:        int32(binary.LittleEndian.Uint32(window[12:])),
+		}
+		if validHeader(header) {
+			return header, nil
+		}
+
+		copy(window, window[1:])
+		filled--
 	}
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("KILLCURSORS id:%d numCurID:%d curIDs:%d\n",
-		header.RequestID, numberOfCursorIDs, cursorIDs), nil)
 }
 
-func (parser *Parser) parseReply(header msgHeader, r io.Reader) {
-	flag := mustReadInt32(r)
-	cursorID := readInt64(r)
-	startingFrom := mustReadInt32(r)
-	numberReturned := mustReadInt32(r)
-	docs := readDocuments(r)
-	var docsStr string
-	if len(docs) == 1 {
-		docsStr = toJson(docs[0])
-	} else {
-		docsStr = toJson(docs)
+func validHeader(header MsgHeader) bool {
+	if header.MessageLength < 4*4 || header.MessageLength > maxMessageSize {
+		return false
 	}
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("REPLY to:%d flag:%b curID:%d from:%d reted:%d docs:%v\n",
-		header.ResponseTo,
-		flag,
-		cursorID,
-		startingFrom,
-		numberReturned,
-		docsStr), nil)
+
+	_, ok := opCodeNames[header.OpCode]
+	return ok
 }
 
-func (parser *Parser) parseMsg(header msgHeader, r io.Reader) {
-	msg := readCString(r)
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("MSG %d %s\n", header.RequestID, msg), log.Fields{
-		"msg": msg,
-	})
+// decode decode the body of one message, a panic while decoding is
+// reported as a DecodeError so that the following messages can still be parsed
+func decode(header MsgHeader, body []byte) (msg Message, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = &DecodeError{
+				OpCode:     header.OpCode,
+				RequestID:  header.RequestID,
+				ResponseTo: header.ResponseTo,
+				Field:      "message",
+				Err:        fmt.Errorf("panic: %v", e),
+			}
+		}
+	}()
+
+	d := newDecoder(header, body)
+	switch header.OpCode {
+	case opQuery:
+		return parseQuery(d)
+	case opInsert:
+		return parseInsert(d)
+	case opDelete:
+		return parseDelete(d)
+	case opUpdate:
+		return parseUpdate(d)
+	case opMsg:
+		return parseMsg(d)
+	case opReply:
+		return parseReply(d)
+	case opGetMore:
+		return parseGetMore(d)
+	case opKillCursors:
+		return parseKillCursors(d)
+	case opReserved, opCommandDeprecated, opCommandReplyDeprecated:
+		return parseRaw(d)
+	case opCommand:
+		return parseCommand(d)
+	case opCommandReply:
+		return parseCommandReply(d)
+	case opCompressed:
+		return parseCompressed(d)
+	case opMsgNew:
+		return parseMsgNew(d)
+	default:
+		d.fail("opCode", fmt.Errorf("unknown OpCode: %d", header.OpCode))
+		return nil, d.err
+	}
 }
-func (parser *Parser) parseReserved(header msgHeader) {
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("RESERVED header:%v data:%v\n", header.RequestID, toJson(header)), nil)
+
+func parseQuery(d *decoder) (Message, error) {
+	msg := &OpQuery{message: message{header: d.header}}
+	msg.Flags = d.int32("flags")
+	msg.FullCollectionName = d.cstring("fullCollectionName")
+	msg.NumberToSkip = d.int32("numberToSkip")
+	msg.NumberToReturn = d.int32("numberToReturn")
+	msg.Query, msg.command, msg.document = d.command("query")
+	if !strings.HasSuffix(msg.FullCollectionName, ".$cmd") {
+		// a plain query, the first key is a field of the filter
+		msg.command = ""
+	}
+	msg.ReturnFieldsSelector = d.optionalDocument("returnFieldsSelector")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
 }
 
-func (parser *Parser) parseCommandDeprecated(header msgHeader, r io.Reader) {
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("msgHeader %v\n", toJson(header)), nil)
-	// TODO: no document, current not understand
-	_, err := io.Copy(ioutil.Discard, r)
-	if err != nil {
-		parser.writeErrorMessage(fmt.Sprintf("read failed: %v", err))
-		return
+func parseInsert(d *decoder) (Message, error) {
+	msg := &OpInsert{message: message{header: d.header}}
+	msg.Flags = d.int32("flags")
+	msg.FullCollectionName = d.cstring("fullCollectionName")
+	msg.Documents = d.documents("documents")
+	if d.err != nil {
+		return nil, d.err
 	}
+	return msg, nil
 }
-func (parser *Parser) parseCommandReplyDeprecated(header msgHeader, r io.Reader) {
-	parser.writeParsedMessage(header.OpCode, fmt.Sprintf("msgHeader %v\n", toJson(header)), nil)
-	// TODO: no document, current not understand
-	_, err := io.Copy(ioutil.Discard, r)
-	if err != nil {
-		parser.writeErrorMessage(fmt.Sprintf("read failed: %v", err))
-		return
-	}
-}
-func (parser *Parser) parseCommand(header msgHeader, r io.Reader) {
-	database := readCString(r)
-	commandName := readCString(r)
-	metadata := toJson(readDocument(r))
-	commandArgs := toJson(readDocument(r))
-	inputDocs := toJson(readDocuments(r))
-	parser.writeParsedMessage(
-		header.OpCode,
-		fmt.Sprintf("COMMAND id:%v db:%v meta:%v cmd:%v args:%v docs %v\n",
-			header.RequestID,
-			database,
-			metadata,
-			commandName,
-			commandArgs,
-			inputDocs),
-		nil)
-}
-
-func (parser *Parser) parseMsgNew(header msgHeader, r io.Reader) {
-	mustReadInt32(r)
-	for {
-		t := readBytes(r, 1)
-		if t == nil {
-			break
-		}
-		switch t[0] {
+
+func parseUpdate(d *decoder) (Message, error) {
+	msg := &OpUpdate{message: message{header: d.header}}
+	_ = d.int32("ZERO")
+	msg.FullCollectionName = d.cstring("fullCollectionName")
+	msg.Flags = d.int32("flags")
+	msg.Selector = d.document("selector")
+	msg.Update = d.document("update")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseGetMore(d *decoder) (Message, error) {
+	msg := &OpGetMore{message: message{header: d.header}}
+	_ = d.int32("ZERO")
+	msg.FullCollectionName = d.cstring("fullCollectionName")
+	msg.NumberToReturn = d.int32("numberToReturn")
+	msg.CursorID = d.int64("cursorID")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseDelete(d *decoder) (Message, error) {
+	msg := &OpDelete{message: message{header: d.header}}
+	_ = d.int32("ZERO")
+	msg.FullCollectionName = d.cstring("fullCollectionName")
+	msg.Flags = d.int32("flags")
+	msg.Selector = d.document("selector")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseKillCursors(d *decoder) (Message, error) {
+	msg := &OpKillCursors{message: message{header: d.header}}
+	_ = d.int32("ZERO")
+	numberOfCursorIDs := d.int32("numberOfCursorIDs")
+	for i := int32(0); i < numberOfCursorIDs && d.err == nil; i++ {
+		msg.CursorIDs = append(msg.CursorIDs, d.int64("cursorIDs"))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseReply(d *decoder) (Message, error) {
+	msg := &OpReply{message: message{header: d.header}}
+	msg.ResponseFlags = d.int32("responseFlags")
+	msg.CursorID = d.int64("cursorID")
+	msg.StartingFrom = d.int32("startingFrom")
+	msg.NumberReturned = d.int32("numberReturned")
+	msg.Documents = d.documents("documents")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseMsg(d *decoder) (Message, error) {
+	msg := &OpLegacyMsg{message: message{header: d.header}}
+	msg.Message = d.cstring("message")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+// parseRaw is used for the messages whose body is not understood:
+// OP_RESERVED and the deprecated command opCodes
+func parseRaw(d *decoder) (Message, error) {
+	msg := &OpRaw{message: message{header: d.header}}
+	msg.Body = d.rest("body")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseCommand(d *decoder) (Message, error) {
+	msg := &OpCommand{message: message{header: d.header}}
+	msg.Database = d.cstring("database")
+	msg.CommandName = d.cstring("commandName")
+	msg.command = msg.CommandName
+	msg.Metadata = d.document("metadata")
+	msg.CommandArgs, _, msg.document = d.command("commandArgs")
+	msg.InputDocs = d.documents("inputDocs")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseMsgNew(d *decoder) (Message, error) {
+	msg := &OpMsg{message: message{header: d.header}}
+	msg.FlagBits = uint32(d.int32("flagBits"))
+
+	sections := d
+	if msg.ChecksumPresent() {
+		sections = d.section("sections", int32(d.r.Len()-4))
+		msg.Checksum = d.checksum("checksum")
+	}
+	for sections.more() {
+		switch kind := sections.uint8("kind"); kind {
 		case 0: // body
-			body := toJson(readDocument(r))
-			checksum, _ := readUint32(r)
-			parser.writeParsedMessage(
-				header.OpCode,
-				fmt.Sprintf("MSG id: %v checksum: %v", header.RequestID, checksum),
-				log.Fields{
-					"type": 0,
-					"body": body,
-				},
-			)
+			body, command, raw := sections.command("body")
+			msg.Sections = append(msg.Sections, Section{Kind: 0, Body: body})
+			msg.command, msg.document = command, raw
 		case 1:
-			sectionSize := mustReadInt32(r)
-			r1 := io.LimitReader(r, int64(sectionSize))
-			documentSequenceIdentifier := readCString(r1)
-			objects := toJson(readDocuments(r1))
-
-			parser.writeParsedMessage(
-				header.OpCode,
-				fmt.Sprintf("MSG id: %v objects: %v",
-					header.RequestID,
-					objects,
-				),
-				log.Fields{
-					"type":                       1,
-					"documentSequenceIdentifier": documentSequenceIdentifier,
-					"objects":                    objects,
-				},
-			)
+			sectionSize := sections.int32("sectionSize")
+			section := sections.section("documentSequence", sectionSize-4)
+			identifier := section.cstring("identifier")
+			documents := section.documents("documents")
+			sections.err = section.err
+			msg.Sections = append(msg.Sections, Section{Kind: 1, Identifier: identifier, Documents: documents})
 		default:
-			parser.writeErrorMessage(fmt.Sprintf("unknown body kind: %v", t[0]))
+			if sections.err == nil {
+				sections.fail("kind", fmt.Errorf("unknown body kind: %v", kind))
+			}
 		}
 	}
+	if d.err == nil {
+		d.err = sections.err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func parseCommandReply(d *decoder) (Message, error) {
+	msg := &OpCommandReply{message: message{header: d.header}}
+	msg.Metadata = d.document("metadata")
+	msg.CommandReply = d.document("commandReply")
+	msg.OutputDocs = d.documents("outputDocs")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
 }
 
-func (parser *Parser) parseCommandReply(header msgHeader, r io.Reader) {
-	metadata := toJson(readDocument(r))
-	commandReply := toJson(readDocument(r))
-	outputDocs := toJson(readDocument(r))
-	parser.writeParsedMessage(
-		header.OpCode,
-		fmt.Sprintf("COMMANDREPLY to:%d id:%v meta:%v cmdReply:%v outputDocs:%v\n",
-			header.ResponseTo, header.RequestID, metadata, commandReply, outputDocs),
-		log.Fields{
-			"meta":          metadata,
-			"command_reply": commandReply,
-			"output_docs":   outputDocs,
-		},
-	)
+func parseCompressed(d *decoder) (Message, error) {
+	originalOpCode := d.int32("originalOpcode")
+	uncompressedSize := d.int32("uncompressedSize")
+	compressorID := d.uint8("compressorId")
+	compressed := d.rest("compressedMessage")
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if originalOpCode == opCompressed {
+		d.fail("originalOpcode", fmt.Errorf("nested compressed message"))
+		return nil, d.err
+	}
+
+	data, err := decompress(compressorID, compressed, uncompressedSize)
+	if err != nil {
+		d.fail("compressedMessage", err)
+		return nil, d.err
+	}
+
+	original := MsgHeader{
+		MessageLength: uncompressedSize + 4*4,
+		RequestID:     d.header.RequestID,
+		ResponseTo:    d.header.ResponseTo,
+		OpCode:        originalOpCode,
+	}
+	msg, err := decode(original, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ratio float64
+	if len(compressed) > 0 {
+		ratio = float64(uncompressedSize) / float64(len(compressed))
+	}
+	msg.base().compression = &Compression{
+		Compressor:     compressorName(compressorID),
+		CompressedSize: len(compressed),
+		Ratio:          float64(int(ratio*100+0.5)) / 100,
+	}
+	return msg, nil
 }
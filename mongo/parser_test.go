@@ -0,0 +1,173 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// testParseAll returns the messages and the errors parsed from the writes
+func testParseAll(writes ...[]byte) (messages []Message, errs []error) {
+	p := NewBlockingParser("test", func(msg Message, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		messages = append(messages, msg)
+	})
+	for _, b := range writes {
+		_, _ = p.Write(b)
+	}
+	p.Close()
+	p.Wait()
+	return messages, errs
+}
+
+// testChecksum returns the OP_MSG b with the checksumPresent flag and its CRC-32C appended
+func testChecksum(b []byte) []byte {
+	b = append([]byte{}, b...)
+	b[4*4] |= MsgChecksumPresent
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)+4))
+	return appendInt32(b, int32(crc32.Checksum(b, castagnoli)))
+}
+
+func TestParserErrors(t *testing.T) {
+	valid := testEvent{0, "find", 2, 0}.message(t).Raw()
+	// the body document claims more bytes than the message has
+	truncated := testEvent{0, "find", 1, 0}.message(t).Raw()
+	binary.LittleEndian.PutUint32(truncated[4*4+4+1:], 1000)
+	oversized := make([]byte, 4*4+8)
+	putHeader(oversized, MsgHeader{MessageLength: maxMessageSize + 1, RequestID: 1, OpCode: opMsgNew})
+	tooShort := make([]byte, 4*4)
+	putHeader(tooShort, MsgHeader{MessageLength: 8, RequestID: 1, OpCode: opMsgNew})
+	unknownOpCode := make([]byte, 4*4)
+	putHeader(unknownOpCode, MsgHeader{MessageLength: 4 * 4, RequestID: 1, OpCode: 1234})
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{"truncated document", truncated, "decode OP_MSG id:1 to:0 failed at"},
+		{"garbage", []byte("this is not a mongodb message, only garbage"), "invalid message header, 0 bytes dropped in total, resynchronizing"},
+		{"oversized", oversized, "invalid message header"},
+		{"length shorter than the header", tooShort, "invalid message header"},
+		{"unknown opCode", unknownOpCode, "invalid message header"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, errs := testParseAll(test.frame, valid)
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("errors %v, expect %q", errs, test.err)
+			}
+			// the parser goes on with the message after the bad frame
+			if len(messages) != 1 || messages[0].Header().RequestID != 2 {
+				t.Fatalf("parsed %v, expect the valid message", messages)
+			}
+			if CommandName(messages[0]) != "find" {
+				t.Errorf("parsed %s", messages[0])
+			}
+		})
+	}
+}
+
+func TestParserDecodeError(t *testing.T) {
+	// a legacy query without its query document
+	query := testLegacyMsg(t, opQuery, int32(0), "shop.users", int32(0), int32(0))
+	binary.LittleEndian.PutUint32(query[4:], 7)
+	valid := testEvent{0, "find", 2, 0}.message(t).Raw()
+
+	messages, errs := testParseAll(query, valid, valid)
+	if len(messages) != 2 || len(errs) != 1 {
+		t.Fatalf("parsed %v, errors %v", messages, errs)
+	}
+	var decodeErr *DecodeError
+	if !errors.As(errs[0], &decodeErr) {
+		t.Fatalf("error %v is not a DecodeError", errs[0])
+	}
+	if decodeErr.OpCode != opQuery || decodeErr.RequestID != 7 || decodeErr.Field != "query" {
+		t.Errorf("decode error %+v", decodeErr)
+	}
+}
+
+func TestParserTruncatedAtEOF(t *testing.T) {
+	valid := testEvent{0, "find", 2, 0}.message(t).Raw()
+	messages, errs := testParseAll(valid, valid[:len(valid)-5])
+	if len(messages) != 1 {
+		t.Errorf("parsed %v", messages)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "unexpected EOF") {
+		t.Errorf("errors %v", errs)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	valid := testEvent{0, "find", 2, 0}.message(t)
+	if !valid.Received().Equal(testStart) {
+		t.Errorf("received %v, expect %v", valid.Received(), testStart)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"truncated", valid.Raw()[:len(valid.Raw())-5], "unexpected EOF"},
+		{"empty", nil, "no message decoded"},
+	}
+	for _, test := range tests {
+		if msg, err := ParseMessage(test.b, testStart); msg != nil || err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: parsed %v, error %v, expect %q", test.name, msg, err, test.err)
+		}
+	}
+}
+
+func TestParserChecksum(t *testing.T) {
+	body := bson.D{{Name: "insert", Value: "users"}, {Name: "$db", Value: "shop"}}
+	checksummed := testChecksum(testMsg(t, body, "documents", bson.M{"_id": 1}, bson.M{"_id": 2}))
+	mismatch := append([]byte{}, checksummed...)
+	mismatch[len(mismatch)-1] ^= 0xff
+	// the flag is set, the checksum is missing
+	missing := testMsg(t, body, "")
+	missing[4*4] |= MsgChecksumPresent
+	noSections := make([]byte, 4*4+4)
+	putHeader(noSections, MsgHeader{MessageLength: int32(len(noSections)), RequestID: 1, OpCode: opMsgNew})
+	noSections[4*4] = MsgChecksumPresent
+	valid := testEvent{0, "find", 2, 0}.message(t).Raw()
+
+	messages, errs := testParseAll(checksummed)
+	if len(messages) != 1 || len(errs) != 0 {
+		t.Fatalf("parsed %v, errors %v", messages, errs)
+	}
+	m := messages[0].(*OpMsg)
+	if !m.ChecksumPresent() || m.Checksum != binary.LittleEndian.Uint32(checksummed[len(checksummed)-4:]) {
+		t.Errorf("checksum %08x, present %v", m.Checksum, m.ChecksumPresent())
+	}
+	if len(m.Sections) != 2 || len(m.Sections[1].Documents) != 2 || CommandName(m) != "insert" {
+		t.Errorf("sections %+v", m.Sections)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{"mismatch", mismatch, "failed at checksum: checksum mismatch"},
+		{"missing", missing, "failed at"},
+		{"no sections", noSections, "failed at sections: invalid section size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, errs := testParseAll(test.frame, valid)
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("errors %v, expect %q", errs, test.err)
+			}
+			if len(messages) != 1 || messages[0].Header().RequestID != 2 {
+				t.Errorf("parsed %v, expect the valid message", messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package mongo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Redacted replaces the values removed by the redaction rules
+const Redacted = "REDACTED"
+
+// authCommands are the commands whose credentials are redacted, by lower case name
+var authCommands = map[string]bool{"saslstart": true, "saslcontinue": true, "authenticate": true}
+
+// dupKey matches the key of a duplicate key error message, such as
+// dup key: { email: "a@example.com" }, and dupKeyValue its values
+var (
+	dupKey      = regexp.MustCompile(`dup key: \{(?:"(?:[^"\\]|\\.)*"|[^"}])*\}`)
+	dupKeyValue = regexp.MustCompile(`: (?:"(?:[^"\\]|\\.)*"|[^,}]*[^,}\s])`)
+)
+
+// authFields are the fields of the authentication commands holding credentials
+var authFields = map[string]bool{"payload": true, "key": true, "nonce": true}
+
+type redactRule struct {
+	// path is set for the rules on fields, it is the glob split by dots
+	path []string
+	// value is set for the rules on string values
+	value *regexp.Regexp
+	hash  bool
+}
+
+// Redactor removes sensitive values from the documents of messages with rules
+// such as
+//
+//	field=GLOB   replace the fields whose path matches, such as documents.password
+//	hash=GLOB    replace the fields whose path matches with a hash of their value
+//	value=REGEX  replace the parts of string values which match, such as emails
+//
+// A path is made of the field names from the command, query or reply document,
+// arrays are crossed without index. In globs * matches within a field name and
+// ** matches any number of fields, **.password matches password at any depth.
+type Redactor struct {
+	rules []redactRule
+	// auth is set when the credentials of the authentication commands and
+	// their replies are redacted
+	auth bool
+}
+
+// NewRedactor create a redactor from rules, the authentication credentials are
+// redacted when auth is set, even without rules
+func NewRedactor(rules []string, auth bool) (*Redactor, error) {
+	r := &Redactor{auth: auth}
+	for _, rule := range rules {
+		i := strings.IndexByte(rule, '=')
+		if i <= 0 || i == len(rule)-1 {
+			return nil, fmt.Errorf("invalid redaction rule: %s", rule)
+		}
+		kind, arg := rule[:i], rule[i+1:]
+		switch kind {
+		case "field", "hash":
+			glob := strings.Split(arg, ".")
+			for _, name := range glob {
+				if _, err := path.Match(name, ""); err != nil {
+					return nil, fmt.Errorf("invalid field glob in redaction rule %s: %v", rule, err)
+				}
+			}
+			r.rules = append(r.rules, redactRule{path: glob, hash: kind == "hash"})
+		case "value":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression in redaction rule %s: %v", rule, err)
+			}
+			r.rules = append(r.rules, redactRule{value: re})
+		default:
+			return nil, fmt.Errorf("unknown redaction rule: %s", rule)
+		}
+	}
+	return r, nil
+}
+
+// Enabled reports whether the redactor may change anything
+func (r *Redactor) Enabled() bool {
+	return r.auth || len(r.rules) > 0
+}
+
+// Message returns a copy of msg with the sensitive values redacted, or msg
+// itself when nothing is redacted, the copy has no raw bytes
+func (r *Redactor) Message(msg Message) Message {
+	auth := r.auth && IsAuthCommand(msg)
+	changed := false
+	doc := func(prefix []string, d bson.M) bson.M {
+		redacted, ok := r.document(prefix, d, auth)
+		if !ok {
+			return d
+		}
+		changed = true
+		return redacted
+	}
+	docs := func(prefix []string, ds []bson.M) []bson.M {
+		redacted := make([]bson.M, len(ds))
+		for i, d := range ds {
+			redacted[i] = doc(prefix, d)
+		}
+		return redacted
+	}
+
+	var copied Message
+	switch m := msg.(type) {
+	case *OpQuery:
+		c := *m
+		c.Query = doc(nil, m.Query)
+		// the fields of the selector are those of the projection of find
+		c.ReturnFieldsSelector = doc([]string{"projection"}, m.ReturnFieldsSelector)
+		copied = &c
+	case *OpReply:
+		c := *m
+		c.Documents = docs(nil, m.Documents)
+		copied = &c
+	case *OpMsg:
+		c := *m
+		c.Sections = make([]Section, len(m.Sections))
+		for i, section := range m.Sections {
+			c.Sections[i] = section
+			if section.Kind == 0 {
+				c.Sections[i].Body = doc(nil, section.Body)
+			} else {
+				c.Sections[i].Documents = docs([]string{section.Identifier}, section.Documents)
+			}
+		}
+		copied = &c
+	case *OpInsert:
+		c := *m
+		c.Documents = docs([]string{"documents"}, m.Documents)
+		copied = &c
+	case *OpUpdate:
+		// the paths are those of the statements of the update command
+		c := *m
+		c.Selector = doc([]string{"q"}, m.Selector)
+		c.Update = doc([]string{"u"}, m.Update)
+		copied = &c
+	case *OpDelete:
+		c := *m
+		c.Selector = doc([]string{"q"}, m.Selector)
+		copied = &c
+	case *OpCommand:
+		c := *m
+		c.CommandArgs = doc(nil, m.CommandArgs)
+		c.InputDocs = docs(nil, m.InputDocs)
+		copied = &c
+	case *OpCommandReply:
+		c := *m
+		c.CommandReply = doc(nil, m.CommandReply)
+		c.OutputDocs = docs(nil, m.OutputDocs)
+		copied = &c
+	}
+	if !changed {
+		return msg
+	}
+
+	base := copied.base()
+	base.raw = nil
+	if base.document != nil {
+		base.document = r.raw(base.document, auth)
+	}
+	return copied
+}
+
+// String returns s with the parts matching the value rules redacted, such as
+// the key of a duplicate key error message
+func (r *Redactor) String(s string) string {
+	for _, rule := range r.rules {
+		if rule.value == nil {
+			continue
+		}
+		s = rule.value.ReplaceAllStringFunc(s, func(match string) string {
+			return redactedValue(match, rule.hash)
+		})
+	}
+	return s
+}
+
+// ErrMsg returns the error message s redacted by String, the values of the key
+// of a duplicate key error are redacted as well when there are field or hash
+// rules: the message doesn't tell the path of the fields they come from
+func (r *Redactor) ErrMsg(s string) string {
+	s = r.String(s)
+	for _, rule := range r.rules {
+		if rule.path == nil {
+			continue
+		}
+		return dupKey.ReplaceAllStringFunc(s, func(key string) string {
+			return "dup key: " + dupKeyValue.ReplaceAllString(key[len("dup key: "):], ": "+Redacted)
+		})
+	}
+	return s
+}
+
+// raw redact a document in bson keeping the order of its fields, it returns
+// nil if the document can't be decoded again
+func (r *Redactor) raw(document []byte, auth bool) []byte {
+	var doc bson.D
+	if err := bson.Unmarshal(document, &doc); err != nil {
+		return nil
+	}
+	redacted, ok := r.value(nil, doc, auth)
+	if !ok {
+		return document
+	}
+	b, err := bson.Marshal(redacted)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// document returns d, a document of a message found at fieldPath such as the
+// documents of an insert, redacted and true, or d and false when nothing is
+// redacted. It stays a document: a rule matching fieldPath itself redacts every
+// field of d
+func (r *Redactor) document(fieldPath []string, d bson.M, auth bool) (bson.M, bool) {
+	if rule := r.fieldRule(fieldPath); rule != nil {
+		if len(d) == 0 {
+			return d, false
+		}
+		redacted := make(bson.M, len(d))
+		for name, v := range d {
+			redacted[name] = redactedValue(v, rule.hash)
+		}
+		return redacted, true
+	}
+	redacted, ok := r.walk(fieldPath, d, auth)
+	if !ok {
+		return d, false
+	}
+	return redacted.(bson.M), true
+}
+
+// fieldRule returns the first field or hash rule matching fieldPath, the root
+// document is never matched
+func (r *Redactor) fieldRule(fieldPath []string) *redactRule {
+	if len(fieldPath) == 0 {
+		return nil
+	}
+	for i, rule := range r.rules {
+		if rule.path != nil && matchFieldPath(rule.path, fieldPath) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+// value returns v redacted at fieldPath and true, or v and false when nothing
+// is redacted, the documents and arrays are copied when they change, auth is set
+// when v is the document of an authentication command
+func (r *Redactor) value(fieldPath []string, v interface{}, auth bool) (interface{}, bool) {
+	if rule := r.fieldRule(fieldPath); rule != nil {
+		return redactedValue(v, rule.hash), true
+	}
+	return r.walk(fieldPath, v, auth)
+}
+
+// walk redact the fields and elements of v at fieldPath, v keeps its type
+func (r *Redactor) walk(fieldPath []string, v interface{}, auth bool) (interface{}, bool) {
+	switch v := v.(type) {
+	case bson.M:
+		var redacted bson.M
+		for name, field := range v {
+			rv, ok := r.field(fieldPath, v, name, field, auth)
+			if !ok {
+				continue
+			}
+			if redacted == nil {
+				redacted = make(bson.M, len(v))
+				for name, field := range v {
+					redacted[name] = field
+				}
+			}
+			redacted[name] = rv
+		}
+		if redacted != nil {
+			return redacted, true
+		}
+	case bson.D:
+		var redacted bson.D
+		m := v.Map()
+		for i, elem := range v {
+			rv, ok := r.field(fieldPath, m, elem.Name, elem.Value, auth)
+			if !ok {
+				continue
+			}
+			if redacted == nil {
+				redacted = append(bson.D{}, v...)
+			}
+			redacted[i].Value = rv
+		}
+		if redacted != nil {
+			return redacted, true
+		}
+	case []interface{}:
+		var redacted []interface{}
+		for i, elem := range v {
+			rv, ok := r.value(fieldPath, elem, false)
+			if !ok {
+				continue
+			}
+			if redacted == nil {
+				redacted = append([]interface{}{}, v...)
+			}
+			redacted[i] = rv
+		}
+		if redacted != nil {
+			return redacted, true
+		}
+	case string:
+		s := r.String(v)
+		if len(fieldPath) > 0 && fieldPath[len(fieldPath)-1] == "errmsg" {
+			// such as the errmsg of the reply or of its writeErrors
+			s = r.ErrMsg(v)
+		}
+		if s != v {
+			return s, true
+		}
+	}
+	return v, false
+}
+
+// field redact the field name of doc at fieldPath
+func (r *Redactor) field(fieldPath []string, doc bson.M, name string, v interface{}, auth bool) (interface{}, bool) {
+	if len(fieldPath) == 0 {
+		if name == "$query" {
+			// the command of a legacy driver wrapped with its read preference
+			return r.value(nil, v, auth)
+		}
+		if r.auth && isCredential(doc, name, auth) {
+			return Redacted, true
+		}
+	}
+	return r.value(append(fieldPath[:len(fieldPath):len(fieldPath)], name), v, false)
+}
+
+// isCredential reports whether the root field name of doc holds credentials, that
+// is a credential of an authentication command, the payload of a SASL reply or
+// the speculative authentication of a handshake and its reply
+func isCredential(doc bson.M, name string, auth bool) bool {
+	switch {
+	case auth && authFields[name]:
+		return true
+	case name == "speculativeAuthenticate":
+		return true
+	case name == "payload":
+		_, conversation := doc["conversationId"]
+		return conversation
+	}
+	return false
+}
+
+// matchFieldPath reports whether fieldPath matches glob, a ** element of glob
+// matches any number of fields
+func matchFieldPath(glob []string, fieldPath []string) bool {
+	if len(glob) == 0 {
+		return len(fieldPath) == 0
+	}
+	if glob[0] == "**" {
+		for i := 0; i <= len(fieldPath); i++ {
+			if matchFieldPath(glob[1:], fieldPath[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(fieldPath) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(glob[0], fieldPath[0]); !ok {
+		return false
+	}
+	return matchFieldPath(glob[1:], fieldPath[1:])
+}
+
+// redactedValue returns the replacement of v, the hash lets equal values be
+// told apart from different ones without showing them
+func redactedValue(v interface{}, hash bool) string {
+	if !hash {
+		return Redacted
+	}
+	s, ok := v.(string)
+	if !ok {
+		s = ExtJSON(v, Canonical)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,190 @@
+package mongo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// testMsg returns an OP_MSG with body and, when identifier is set, a document sequence
+func testMsg(t *testing.T, body bson.D, identifier string, docs ...bson.M) []byte {
+	b := make([]byte, 4*4+4, 256)
+	b = append(b, 0)
+	b = append(b, testBSON(t, body)...)
+	if identifier != "" {
+		var seq []byte
+		for _, d := range docs {
+			seq = append(seq, testBSON(t, d)...)
+		}
+		b = append(b, 1)
+		b = appendInt32(b, int32(4+len(identifier)+1+len(seq)))
+		b = append(append(b, identifier...), 0)
+		b = append(b, seq...)
+	}
+	putHeader(b, MsgHeader{MessageLength: int32(len(b)), RequestID: 1, OpCode: opMsgNew})
+	return b
+}
+
+// testLegacyMsg returns a message of opCode made of parts, int32, int64 and
+// string parts are written as such and cstring, documents as bson
+func testLegacyMsg(t *testing.T, opCode int32, parts ...interface{}) []byte {
+	b := make([]byte, 4*4, 256)
+	for _, part := range parts {
+		switch part := part.(type) {
+		case int32:
+			b = appendInt32(b, part)
+		case int64:
+			b = appendInt64(b, part)
+		case string:
+			b = append(append(b, part...), 0)
+		default:
+			b = append(b, testBSON(t, part)...)
+		}
+	}
+	putHeader(b, MsgHeader{MessageLength: int32(len(b)), RequestID: 1, OpCode: opCode})
+	return b
+}
+
+func testBSON(t *testing.T, doc interface{}) []byte {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testParse returns the message decoded from b
+func testParse(t *testing.T, b []byte) Message {
+	msg, err := ParseMessage(b, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestRedactMessage(t *testing.T) {
+	insertMsg := testMsg(t, bson.D{{Name: "insert", Value: "users"}, {Name: "$db", Value: "shop"}}, "documents",
+		bson.M{"name": "ann", "password": "secret", "email": "ann@example.com"})
+	legacyInsert := testLegacyMsg(t, opInsert, int32(0), "shop.users", bson.M{"name": "ann", "password": "secret"})
+	legacyUpdate := testLegacyMsg(t, opUpdate, int32(0), "shop.users", int32(0),
+		bson.M{"password": "secret"}, bson.M{"$set": bson.M{"password": "secret2"}})
+	legacyDelete := testLegacyMsg(t, opDelete, int32(0), "shop.users", int32(0), bson.M{"password": "secret"})
+	legacyQuery := testLegacyMsg(t, opQuery, int32(0), "shop.users", int32(0), int32(0),
+		bson.M{"name": "ann"}, bson.M{"tags": bson.M{"$elemMatch": bson.M{"code": "secret"}}})
+	dupKeyReply := testMsg(t, bson.D{{Name: "n", Value: 0}, {Name: "writeErrors", Value: []bson.M{{"index": 0, "code": 11000,
+		"errmsg": `E11000 duplicate key error collection: shop.users index: email_1 dup key: { email: "ann@example.com" }`}}},
+		{Name: "ok", Value: 1.0}}, "")
+
+	tests := []struct {
+		name string
+		rule string
+		msg  []byte
+		// hidden must not be in the redacted message, kept must be
+		hidden []string
+		kept   []string
+	}{
+		{"field in sequence", "field=documents.password", insertMsg, []string{"secret"}, []string{"ann@example.com"}},
+		{"whole sequence", "field=documents", insertMsg, []string{"secret", "ann"}, []string{"users"}},
+		{"hash whole sequence", "hash=documents", insertMsg, []string{"secret", "ann"}, []string{"sha256:"}},
+		{"any depth", "hash=**.email", insertMsg, []string{"ann@example.com"}, []string{"secret"}},
+		{"everything", "field=**", insertMsg, []string{"secret", "ann", "users"}, nil},
+		{"legacy insert", "field=documents", legacyInsert, []string{"secret", "ann"}, nil},
+		{"legacy insert any depth", "field=**", legacyInsert, []string{"secret", "ann"}, nil},
+		{"legacy update query", "field=q", legacyUpdate, []string{`"secret"`}, []string{"secret2"}},
+		{"legacy update", "field=u", legacyUpdate, []string{"secret2"}, []string{`"secret"`}},
+		{"legacy delete", "field=q", legacyDelete, []string{"secret"}, nil},
+		{"legacy query selector", "field=projection.tags", legacyQuery, []string{"secret"}, []string{"ann"}},
+		{"value", "value=ann@[a-z.]+", insertMsg, []string{"ann@example.com"}, []string{"secret"}},
+		{"duplicate key error", "field=**.email", dupKeyReply, []string{"ann@example.com"}, []string{"index: email_1 dup key: { email: REDACTED }"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewRedactor([]string{test.rule}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := testParse(t, test.msg)
+			original := msg.String()
+			redacted := r.Message(msg)
+			s := redacted.String()
+			for _, hidden := range test.hidden {
+				if strings.Contains(s, hidden) {
+					t.Errorf("%s not redacted: %s", hidden, s)
+				}
+			}
+			for _, kept := range test.kept {
+				if !strings.Contains(s, kept) {
+					t.Errorf("%s missing: %s", kept, s)
+				}
+			}
+			if redacted.Raw() != nil {
+				t.Error("redacted message has raw bytes")
+			}
+			if msg.String() != original {
+				t.Error("original message changed")
+			}
+		})
+	}
+}
+
+func TestRedactAuth(t *testing.T) {
+	r, err := NewRedactor(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := testParse(t, testMsg(t, bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "SCRAM-SHA-256"},
+		{Name: "payload", Value: []byte("n,,n=ann,r=nonce")}, {Name: "$db", Value: "admin"}}, ""))
+	if s := r.Message(start).String(); !strings.Contains(s, "SCRAM-SHA-256") || !strings.Contains(s, Redacted) {
+		t.Errorf("saslStart not redacted: %s", s)
+	}
+	reply := testParse(t, testMsg(t, bson.D{{Name: "conversationId", Value: 1}, {Name: "done", Value: false},
+		{Name: "payload", Value: []byte("r=nonce")}, {Name: "ok", Value: 1.0}}, ""))
+	if s := r.Message(reply).String(); !strings.Contains(s, Redacted) {
+		t.Errorf("SASL reply not redacted: %s", s)
+	}
+
+	off, err := NewRedactor(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off.Enabled() || off.Message(start) != start {
+		t.Error("redacted without rules nor auth")
+	}
+}
+
+func TestRedactErrMsg(t *testing.T) {
+	tests := []struct {
+		rule     string
+		errMsg   string
+		expected string
+	}{
+		{"field=**.email", `E11000 duplicate key error collection: shop.users index: email_1 dup key: { email: "ann@example.com" }`,
+			`E11000 duplicate key error collection: shop.users index: email_1 dup key: { email: REDACTED }`},
+		{"hash=**.code", `E11000 duplicate key error collection: shop.users index: code_1_n_1 dup key: { code: "a, }", n: 12 }`,
+			`E11000 duplicate key error collection: shop.users index: code_1_n_1 dup key: { code: REDACTED, n: REDACTED }`},
+		{"field=**.email", `E11000 duplicate key error index: shop.users.$email_1 dup key: { : "ann@example.com" }`,
+			`E11000 duplicate key error index: shop.users.$email_1 dup key: { : REDACTED }`},
+		{"field=**.email", "cursor id 7 not found", "cursor id 7 not found"},
+		// without field rules only the values matching are redacted
+		{"value=ann@[a-z.]+", `dup key: { email: "ann@example.com", name: "ann" }`, `dup key: { email: "REDACTED", name: "ann" }`},
+	}
+	for _, test := range tests {
+		r, err := NewRedactor([]string{test.rule}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errMsg := r.ErrMsg(test.errMsg); errMsg != test.expected {
+			t.Errorf("%s redacted %q, expect %q", test.rule, errMsg, test.expected)
+		}
+	}
+}
+
+func TestRedactRuleErrors(t *testing.T) {
+	for _, rule := range []string{"field", "field=", "=x", "hash=[", "value=(", "other=x"} {
+		if _, err := NewRedactor([]string{rule}, false); err == nil {
+			t.Errorf("%s accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package mongo
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Credential is a user authenticating with SCRAM-SHA-1 or SCRAM-SHA-256 on
+// the Source database
+type Credential struct {
+	Username  string
+	Password  string
+	Source    string
+	Mechanism string
+}
+
+// scramNonce returns the client nonce of a conversation
+var scramNonce = func() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Authenticate runs the saslStart and saslContinue conversation of c, run sends
+// a command on the connection to authenticate and returns its reply. The
+// password of SCRAM-SHA-256 is used as is, without SASLprep
+func Authenticate(c Credential, run func(cmd bson.D) (Message, error)) error {
+	var newHash func() hash.Hash
+	password := c.Password
+	switch c.Mechanism {
+	case "SCRAM-SHA-1":
+		newHash = sha1.New
+		// the server keeps the digest of the password of MONGODB-CR
+		sum := md5.Sum([]byte(c.Username + ":mongo:" + c.Password))
+		password = hex.EncodeToString(sum[:])
+	case "SCRAM-SHA-256":
+		newHash = sha256.New
+	default:
+		return fmt.Errorf("unsupported authentication mechanism: %s", c.Mechanism)
+	}
+	nonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+
+	clientFirst := "n=" + scramEscape(c.Username) + ",r=" + nonce
+	reply, err := runSASL(run, bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: c.Mechanism},
+		{Name: "payload", Value: []byte("n,," + clientFirst)},
+		{Name: "autoAuthorize", Value: 1},
+		{Name: "options", Value: bson.M{"skipEmptyExchange": true}},
+		{Name: "$db", Value: c.Source},
+	})
+	if err != nil {
+		return err
+	}
+	serverFirst := string(saslPayload(reply))
+	fields := scramFields(serverFirst)
+	if !strings.HasPrefix(fields["r"], nonce) || len(fields["r"]) == len(nonce) {
+		return fmt.Errorf("invalid SCRAM server nonce: %q", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM salt: %q", serverFirst)
+	}
+	iterations, err := strconv.Atoi(fields["i"])
+	if err != nil || iterations <= 0 {
+		return fmt.Errorf("invalid SCRAM iteration count: %q", serverFirst)
+	}
+
+	salted := scramSaltPassword(newHash, password, salt, iterations)
+	clientFinal := "c=biws,r=" + fields["r"]
+	authMessage := clientFirst + "," + serverFirst + "," + clientFinal
+	clientKey := scramHMAC(newHash, salted, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	proof := scramHMAC(newHash, h.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	conversationID := reply["conversationId"]
+	reply, err = runSASL(run, bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: conversationID},
+		{Name: "payload", Value: []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof))},
+		{Name: "$db", Value: c.Source},
+	})
+	if err != nil {
+		return err
+	}
+
+	serverFinal := scramFields(string(saslPayload(reply)))
+	if e, failed := serverFinal["e"]; failed {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+	serverSignature := scramHMAC(newHash, scramHMAC(newHash, salted, "Server Key"), authMessage)
+	if !hmac.Equal([]byte(serverFinal["v"]), []byte(base64.StdEncoding.EncodeToString(serverSignature))) {
+		return fmt.Errorf("invalid SCRAM server signature")
+	}
+	// servers without skipEmptyExchange wait for an empty message to end the conversation
+	if done, _ := reply["done"].(bool); !done {
+		_, err = runSASL(run, bson.D{
+			{Name: "saslContinue", Value: 1},
+			{Name: "conversationId", Value: conversationID},
+			{Name: "payload", Value: []byte{}},
+			{Name: "$db", Value: c.Source},
+		})
+	}
+	return err
+}
+
+// runSASL returns the reply document of cmd, an error when the command failed
+func runSASL(run func(cmd bson.D) (Message, error), cmd bson.D) (bson.M, error) {
+	msg, err := run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if ok, errMsg, code := ReplyStatus(msg); !ok {
+		return nil, fmt.Errorf("%s failed: %s (code %d)", cmd[0].Name, errMsg, code)
+	}
+	return ReplyDocument(msg), nil
+}
+
+// saslPayload returns the payload of a saslStart or saslContinue reply
+func saslPayload(reply bson.M) []byte {
+	switch payload := reply["payload"].(type) {
+	case []byte:
+		return payload
+	case bson.Binary:
+		return payload.Data
+	}
+	return nil
+}
+
+// scramFields returns the attributes of a SCRAM message such as r=...,s=...,i=...
+func scramFields(message string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) > 2 && field[1] == '=' {
+			fields[field[:1]] = field[2:]
+		}
+	}
+	return fields
+}
+
+// scramEscape escape the = and , of a user name
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func scramHMAC(newHash func() hash.Hash, key []byte, message string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramSaltPassword returns Hi(password, salt, iterations) of RFC 5802, which is PBKDF2 with one block
+func scramSaltPassword(newHash func() hash.Hash, password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	salted := append([]byte(nil), u...)
+	for n := 1; n < iterations; n++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range salted {
+			salted[i] ^= u[i]
+		}
+	}
+	return salted
+}
@@ -0,0 +1,97 @@
+package mongo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// the conversation of RFC 7677
+const (
+	testClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	testServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	testClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	testServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+// testSCRAMServer answers the commands of a conversation with replies, the
+// payloads received are appended to sent
+type testSCRAMServer struct {
+	t       *testing.T
+	replies []bson.D
+	sent    []string
+}
+
+func (s *testSCRAMServer) run(cmd bson.D) (Message, error) {
+	for _, e := range cmd {
+		if e.Name == "payload" {
+			s.sent = append(s.sent, string(e.Value.([]byte)))
+		}
+	}
+	if len(s.replies) == 0 {
+		s.t.Fatalf("unexpected %s", cmd[0].Name)
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	return testParse(s.t, testMsg(s.t, reply, "")), nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer func(nonce func() (string, error)) { scramNonce = nonce }(scramNonce)
+	scramNonce = func() (string, error) { return testClientNonce, nil }
+	c := Credential{Username: "user", Password: "pencil", Source: "admin", Mechanism: "SCRAM-SHA-256"}
+
+	tests := []struct {
+		name    string
+		replies []bson.D
+		sent    int
+		err     string
+	}{
+		{"skip empty exchange", []bson.D{
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(testServerFirst)}, {Name: "ok", Value: 1.0}},
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: true}, {Name: "payload", Value: []byte(testServerFinal)}, {Name: "ok", Value: 1.0}},
+		}, 2, ""},
+		{"empty exchange", []bson.D{
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(testServerFirst)}, {Name: "ok", Value: 1.0}},
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(testServerFinal)}, {Name: "ok", Value: 1.0}},
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: true}, {Name: "payload", Value: []byte{}}, {Name: "ok", Value: 1.0}},
+		}, 3, ""},
+		{"wrong server signature", []bson.D{
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(testServerFirst)}, {Name: "ok", Value: 1.0}},
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: true}, {Name: "payload", Value: []byte("v=AAAA")}, {Name: "ok", Value: 1.0}},
+		}, 2, "invalid SCRAM server signature"},
+		{"authentication failed", []bson.D{
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(testServerFirst)}, {Name: "ok", Value: 1.0}},
+			{{Name: "ok", Value: 0.0}, {Name: "errmsg", Value: "Authentication failed."}, {Name: "code", Value: 18}},
+		}, 2, "saslContinue failed: Authentication failed. (code 18)"},
+		{"nonce not extended", []bson.D{
+			{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")}, {Name: "ok", Value: 1.0}},
+		}, 1, "invalid SCRAM server nonce"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSCRAMServer{t: t, replies: test.replies}
+			err := Authenticate(c, s.run)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, expect %q", err, test.err)
+			}
+			if len(s.sent) != test.sent {
+				t.Fatalf("sent %q", s.sent)
+			}
+			if s.sent[0] != "n,,n=user,r="+testClientNonce {
+				t.Errorf("client first %q", s.sent[0])
+			}
+			if len(s.sent) > 1 && s.sent[1] != testClientFinal {
+				t.Errorf("client final %q, expect %q", s.sent[1], testClientFinal)
+			}
+		})
+	}
+
+	if err := Authenticate(Credential{Mechanism: "PLAIN"}, nil); err == nil {
+		t.Error("PLAIN accepted")
+	}
+}
@@ -0,0 +1,161 @@
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// shapePlaceholder replaces the literal values of a shape
+const shapePlaceholder = "?"
+
+// Shape returns the operation with the literal values of the filter, update
+// and pipeline replaced by ?, operations which differ only by values have the
+// same shape, such as find test.orders filter={"qty":{"$gt":?}} sort={"qty":-1}
+//
+// arrays of values such as the list of $in count as one value, field paths such
+// as "$sku" and the keys of projection and sort are kept
+func (op *Operation) Shape() string {
+	var buf bytes.Buffer
+	buf.WriteString(op.Command)
+	if ns := op.Namespace(); ns != "" {
+		buf.WriteString(" " + ns)
+	}
+	if op.Key != "" {
+		buf.WriteString(" key=" + op.Key)
+	}
+	if op.Filter != nil {
+		buf.WriteString(" filter=")
+		writeShape(&buf, op.Filter)
+	}
+	if op.Projection != nil {
+		buf.WriteString(" projection=" + ExtJSON(op.Projection, Relaxed))
+	}
+	if op.Sort != nil {
+		buf.WriteString(" sort=" + ExtJSON(op.Sort, Relaxed))
+	}
+	if op.Skip != 0 {
+		buf.WriteString(" skip=" + shapePlaceholder)
+	}
+	if op.Limit != 0 {
+		buf.WriteString(" limit=" + shapePlaceholder)
+	}
+	if op.Pipeline != nil {
+		buf.WriteString(" pipeline=")
+		writeShape(&buf, op.Pipeline)
+	}
+	if op.Update != nil {
+		buf.WriteString(" update=")
+		writeShape(&buf, op.Update)
+	}
+	return buf.String()
+}
+
+// Fingerprint returns a hash of the shape in 16 hex digits
+func (op *Operation) Fingerprint() string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(op.Shape()))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func writeShape(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bson.M:
+		writeShapeMap(buf, v)
+	case map[string]interface{}:
+		writeShapeMap(buf, v)
+	case bson.D:
+		buf.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeJSONString(buf, elem.Name)
+			buf.WriteString(":")
+			writeShape(buf, elem.Value)
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		if !hasDocument(v) {
+			buf.WriteString("[" + shapePlaceholder + "]")
+			return
+		}
+		// a list of expressions such as $or or the stages of a pipeline
+		buf.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeShape(buf, elem)
+		}
+		buf.WriteString("]")
+	case string:
+		if strings.HasPrefix(v, "$") {
+			// a field path or a variable of an aggregation expression
+			writeJSONString(buf, v)
+			return
+		}
+		buf.WriteString(shapePlaceholder)
+	default:
+		buf.WriteString(shapePlaceholder)
+	}
+}
+
+func writeShapeMap(buf *bytes.Buffer, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		writeJSONString(buf, k)
+		buf.WriteString(":")
+		writeShape(buf, m[k])
+	}
+	buf.WriteString("}")
+}
+
+func hasDocument(values []interface{}) bool {
+	for _, v := range values {
+		switch v.(type) {
+		case bson.M, map[string]interface{}, bson.D:
+			return true
+		}
+	}
+	return false
+}
+
+// ReplyBatch returns the cursor id and the number of documents in the reply of a
+// query, find, aggregate, getMore or other command returning a cursor, id is 0
+// when the cursor is exhausted
+func ReplyBatch(req Message, reply Message) (id int64, documents int) {
+	if r, ok := reply.(*OpReply); ok {
+		switch q := req.(type) {
+		case *OpGetMore:
+			return r.CursorID, int(r.NumberReturned)
+		case *OpQuery:
+			if q.command == "" {
+				return r.CursorID, int(r.NumberReturned)
+			}
+		}
+	}
+
+	cursor, _ := ReplyDocument(reply)["cursor"].(bson.M)
+	if cursor == nil {
+		return 0, 0
+	}
+	batch, ok := cursor["firstBatch"].([]interface{})
+	if !ok {
+		batch, _ = cursor["nextBatch"].([]interface{})
+	}
+	return toInt64(cursor["id"]), len(batch)
+}
@@ -0,0 +1,188 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// maxTopologyReply is the size beyond which a reply is passed without looking
+// for member addresses, hello replies are a few KB
+const maxTopologyReply = 1 << 20
+
+// topologyHostLists are the fields of a hello reply listing member addresses
+var topologyHostLists = map[string]bool{"hosts": true, "passives": true, "arbiters": true}
+
+// RewriteTopology returns a copy of msg, a reply in wire format, with the member
+// addresses of a hello or isMaster reply replaced by rewrite, that is hosts,
+// passives, arbiters, primary and me, ok is false when msg is not such a reply.
+// rewrite is called with the field and the address, me first, the checksum of
+// OP_MSG is removed as it no longer matches
+func RewriteTopology(msg []byte, rewrite func(field string, host string) string) (rewritten []byte, ok bool) {
+	if len(msg) < 4*4 {
+		return nil, false
+	}
+	// prefix is the part of msg before the reply document
+	var prefix, doc, suffix []byte
+	switch int32(binary.LittleEndian.Uint32(msg[12:])) {
+	case opMsgNew:
+		if len(msg) < 4*4+4+1+4 || msg[4*4+4] != 0 {
+			return nil, false
+		}
+		flags := binary.LittleEndian.Uint32(msg[4*4:])
+		end := len(msg)
+		if flags&MsgChecksumPresent != 0 {
+			end -= 4
+		}
+		size := int(binary.LittleEndian.Uint32(msg[4*4+4+1:]))
+		if 4*4+4+1+size != end {
+			// more sections follow the body, hello replies have none
+			return nil, false
+		}
+		prefix = append([]byte{}, msg[:4*4+4+1]...)
+		binary.LittleEndian.PutUint32(prefix[4*4:], flags&^MsgChecksumPresent)
+		doc = msg[4*4+4+1 : end]
+	case opReply:
+		const start = 4*4 + 4 + 8 + 4 + 4
+		if len(msg) < start+4 {
+			return nil, false
+		}
+		size := int(binary.LittleEndian.Uint32(msg[start:]))
+		if size < 5 || start+size > len(msg) {
+			return nil, false
+		}
+		prefix, doc, suffix = msg[:start], msg[start:start+size], msg[start+size:]
+	default:
+		return nil, false
+	}
+
+	var reply bson.D
+	if err := bson.Unmarshal(doc, &reply); err != nil || !isTopologyReply(reply) {
+		return nil, false
+	}
+	for i, elem := range reply {
+		if host, isString := elem.Value.(string); isString && elem.Name == "me" {
+			reply[i].Value = rewrite(elem.Name, host)
+		}
+	}
+	for i, elem := range reply {
+		switch {
+		case elem.Name == "primary":
+			if host, isString := elem.Value.(string); isString {
+				reply[i].Value = rewrite(elem.Name, host)
+			}
+		case topologyHostLists[elem.Name]:
+			hosts, _ := elem.Value.([]interface{})
+			rewritten := make([]interface{}, len(hosts))
+			for j, host := range hosts {
+				rewritten[j] = host
+				if host, isString := host.(string); isString {
+					rewritten[j] = rewrite(elem.Name, host)
+				}
+			}
+			reply[i].Value = rewritten
+		}
+	}
+	doc, err := bson.Marshal(reply)
+	if err != nil {
+		return nil, false
+	}
+
+	rewritten = make([]byte, 0, len(prefix)+len(doc)+len(suffix))
+	rewritten = append(append(append(rewritten, prefix...), doc...), suffix...)
+	binary.LittleEndian.PutUint32(rewritten, uint32(len(rewritten)))
+	return rewritten, true
+}
+
+// isTopologyReply reports whether reply answers hello or isMaster with member addresses
+func isTopologyReply(reply bson.D) bool {
+	var handshake, members bool
+	for _, elem := range reply {
+		switch elem.Name {
+		case "ismaster", "isWritablePrimary":
+			handshake = true
+		case "hosts", "passives", "arbiters", "primary", "me":
+			members = true
+		}
+	}
+	return handshake && members
+}
+
+// TopologyRewriter splits the replies written to it in messages and writes
+// them to w with the member addresses of hello and isMaster replies rewritten
+type TopologyRewriter struct {
+	w       io.Writer
+	rewrite func(field string, host string) string
+	buf     []byte
+	// passing is the rest of a large message which is written as it comes
+	passing int
+	// lost is set when the stream can't be split in messages any more, it is then written as is
+	lost bool
+}
+
+// NewTopologyRewriter create a rewriter writing to w, see RewriteTopology for rewrite
+func NewTopologyRewriter(w io.Writer, rewrite func(field string, host string) string) *TopologyRewriter {
+	return &TopologyRewriter{w: w, rewrite: rewrite}
+}
+
+func (t *TopologyRewriter) Write(p []byte) (int, error) {
+	if t.lost {
+		return t.w.Write(p)
+	}
+
+	written := len(p)
+	var out []byte
+	for len(p) > 0 {
+		if t.passing > 0 {
+			n := t.passing
+			if n > len(p) {
+				n = len(p)
+			}
+			out = append(out, p[:n]...)
+			p, t.passing = p[n:], t.passing-n
+			continue
+		}
+
+		t.buf = append(t.buf, p...)
+		p = nil
+		for len(t.buf) >= 4 {
+			size := int(int32(binary.LittleEndian.Uint32(t.buf)))
+			if size < 4*4 || size > maxMessageSize {
+				t.lost = true
+				out = append(out, t.buf...)
+				t.buf = nil
+				break
+			}
+			if size > maxTopologyReply {
+				n := size
+				if n > len(t.buf) {
+					n = len(t.buf)
+				}
+				out = append(out, t.buf[:n]...)
+				// the rest of the buffer after the message is split again
+				p, t.passing, t.buf = t.buf[n:], size-n, nil
+				break
+			}
+			if len(t.buf) < size {
+				break
+			}
+			msg := t.buf[:size]
+			if rewritten, ok := RewriteTopology(msg, t.rewrite); ok {
+				msg = rewritten
+			}
+			out = append(out, msg...)
+			t.buf = t.buf[size:]
+		}
+	}
+	if len(t.buf) > 0 {
+		// don't keep the large array of p alive
+		t.buf = append([]byte{}, t.buf...)
+	}
+	if len(out) > 0 {
+		if _, err := t.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return written, nil
+}
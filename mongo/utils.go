@@ -1,8 +1,8 @@
 package mongo
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -20,21 +20,11 @@ func IsClosedErr(err error) bool {
 	return false
 }
 
-func mustReadUInt32(r io.Reader) (n uint32) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
+func readUInt8(r io.Reader) (n uint8, err error) {
+	err = binary.Read(r, binary.LittleEndian, &n)
 	return
 }
 
-func mustReadInt32(r io.Reader) (n int32) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
-	return
-}
 func readInt32(r io.Reader) (n int32, err error) {
 	err = binary.Read(r, binary.LittleEndian, &n)
 	return
@@ -45,92 +35,97 @@ func readUint32(r io.Reader) (n uint32, err error) {
 	return
 }
 
-func readInt64(r io.Reader) *int64 {
-	var n int64
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		if err == io.EOF {
-			return nil
-		}
-		panic(err)
-	}
-	return &n
-}
-
-func readBytes(r io.Reader, n int) []byte {
-	b := make([]byte, n)
-	_, err := r.Read(b)
-	if err != nil {
-		if err == io.EOF {
-			return nil
-		}
-		panic(err)
-	}
-	return b
+func readInt64(r io.Reader) (n int64, err error) {
+	err = binary.Read(r, binary.LittleEndian, &n)
+	return
 }
 
-func readCString(r io.Reader) string {
+func readCString(r io.Reader) (string, error) {
 	var b []byte
 	var one = make([]byte, 1)
 	for {
-		_, err := r.Read(one)
-		if err != nil {
-			panic(err)
+		if _, err := io.ReadFull(r, one); err != nil {
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
 		}
 		if one[0] == '\x00' {
 			break
 		}
 		b = append(b, one[0])
 	}
-	return string(b)
+	return string(b), nil
 }
 
-func readOne(r io.Reader) []byte {
+// readOne read the raw bytes of one bson document, io.EOF is returned
+// only when there is nothing left in r
+func readOne(r io.Reader) ([]byte, error) {
 	docLen, err := readInt32(r)
 	if err != nil {
-		if err == io.EOF {
-			return nil
-		}
-		panic(err)
+		return nil, err
+	}
+	if docLen < 5 || docLen > maxMessageSize {
+		return nil, fmt.Errorf("invalid document size: %d", docLen)
 	}
 	buf := make([]byte, int(docLen))
 	binary.LittleEndian.PutUint32(buf, uint32(docLen))
 	if _, err := io.ReadFull(r, buf[4:]); err != nil {
-		if err == io.ErrUnexpectedEOF || err == io.EOF {
-			return nil
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
 		}
-		panic(err)
+		return nil, err
 	}
-	return buf
+	return buf, nil
 }
 
-func readDocument(r io.Reader) (m bson.M) {
-	if one := readOne(r); one != nil {
-		err := bson.Unmarshal(one, &m)
-		if err != nil {
-			panic(err)
-		}
+func readDocument(r io.Reader) (m bson.M, err error) {
+	one, err := readOne(r)
+	if err != nil {
+		return nil, err
 	}
-	return m
+	if err := bson.Unmarshal(one, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func readDocuments(r io.Reader) (ms []bson.M) {
-	for {
-		m := readDocument(r)
-		if m == nil {
-			break
-		}
-		ms = append(ms, m)
+// firstKey returns the name of the first element of a bson document, bson.M
+// doesn't keep the order of the elements
+func firstKey(doc []byte) string {
+	// int32 document size, element type byte, then the element name
+	if len(doc) < 6 {
+		return ""
 	}
-	return
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
 }
 
-func toJson(v interface{}) string {
-	b, err := json.Marshal(v)
-	if err != nil {
-		return fmt.Sprintf("{\"error\":%s}", err.Error())
+// commandName returns the first key of a command document, legacy drivers
+// wrap the command in $query when they add $readPreference
+func commandName(doc []byte) string {
+	name := firstKey(doc)
+	if name == "$query" && doc[4] == 0x03 {
+		return firstKey(doc[4+1+len(name)+1:])
+	}
+	return name
+}
+
+// readDocuments read bson documents until the end of r
+func readDocuments(r io.Reader) (ms []bson.M, err error) {
+	for {
+		m, err := readDocument(r)
+		if err != nil {
+			if err == io.EOF {
+				return ms, nil
+			}
+			return ms, err
+		}
+		ms = append(ms, m)
 	}
-	return string(b)
 }
 
 func currentTime() string {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/ma6174/mgosniff/pcap"
+	"github.com/mylxsw/asteria/log"
+)
+
+// analyzePcap parse the mongodb traffic in a pcap or pcapng file, the output
+// is the same as the proxy mode with the capture timestamps
+func analyzePcap(args []string) {
+	fs := flag.NewFlagSet("pcap", flag.ExitOnError)
+	ports := fs.String("p", "27017", "comma separated ports of mongodb servers")
+	fs.DurationVar(timeout, "t", mongo.DefaultReplyTimeout, "report requests without reply after this timeout")
+	fs.StringVar(format, "o", "log", "output format, log, json (one JSON object per message) or none")
+	fs.StringVar(jsonMode, "j", "relaxed", "how documents are written, relaxed or canonical extended JSON, or shell")
+	fs.IntVar(digestTop, "digest", 0, "report the top N query shapes by total time at the end, 0 to disable")
+	fs.DurationVar(slowThreshold, "slow", 0, "only write the operations slower than this, 0 writes every message")
+	fs.StringVar(filterExpr, "filter", "", "only write the operations matching this expression, such as 'db=shop !cmd=hello or error'")
+	fs.Var(&redactRules, "redact", redactUsage)
+	fs.BoolVar(redactAuth, "redact-auth", true, "redact the credentials of saslStart, saslContinue and authenticate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s pcap [options] <capture file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := setupOutput(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(2)
+	}
+
+	serverPorts := make(map[uint16]bool)
+	for _, p := range strings.Split(*ports, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil {
+			log.Errorf("invalid port %q: %v", p, err)
+			os.Exit(2)
+		}
+		serverPorts[uint16(port)] = true
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Errorf("open capture file failed: %v", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	reader, err := pcap.NewReader(f)
+	if err != nil {
+		log.Errorf("read capture file failed: %v", err)
+		os.Exit(1)
+	}
+
+	handler := newPcapHandler(serverPorts)
+	assembler := pcap.NewAssembler(handler)
+	for {
+		packet, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("read capture file failed: %v", err)
+			}
+			break
+		}
+
+		seg, ok := pcap.DecodeTCP(packet)
+		if !ok || (!serverPorts[seg.SrcPort] && !serverPorts[seg.DstPort]) {
+			continue
+		}
+		assembler.Assemble(seg)
+	}
+	assembler.Flush()
+	handler.wait()
+	reportDigest()
+}
+
+// pcapSession is a session rebuilt from a capture file
+type pcapSession struct {
+	*session
+	closed int
+}
+
+// pcapHandler feeds the reassembled TCP streams into sessions, one session for each connection
+type pcapHandler struct {
+	serverPorts map[uint16]bool
+	sessions    map[pcap.Flow]*pcapSession
+	lastConnID  uint64
+	wg          sync.WaitGroup
+}
+
+func newPcapHandler(serverPorts map[uint16]bool) *pcapHandler {
+	return &pcapHandler{
+		serverPorts: serverPorts,
+		sessions:    make(map[pcap.Flow]*pcapSession),
+	}
+}
+
+// lookup returns the session of the connection flow belongs to, and whether flow is from the client
+func (h *pcapHandler) lookup(flow pcap.Flow) (*pcapSession, bool) {
+	fromClient := h.isServer(flow.Dst)
+	key := flow
+	if !fromClient {
+		key = flow.Reverse()
+	}
+
+	s, ok := h.sessions[key]
+	if !ok {
+		log.Debugf("[%s] new client connected: %v -> %v\n", key.Src, key.Src, key.Dst)
+		h.lastConnID++
+		s = &pcapSession{session: newSession(h.lastConnID, key.Src, true, output)}
+		h.sessions[key] = s
+	}
+	return s, fromClient
+}
+
+func (h *pcapHandler) isServer(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && h.serverPorts[uint16(n)]
+}
+
+func (h *pcapHandler) Data(flow pcap.Flow, data []byte, ts time.Time) {
+	s, fromClient := h.lookup(flow)
+	if fromClient {
+		_, _ = s.client.WriteWithTime(data, ts)
+	} else {
+		_, _ = s.server.WriteWithTime(data, ts)
+	}
+}
+
+func (h *pcapHandler) Gap(flow pcap.Flow) {
+	s, fromClient := h.lookup(flow)
+	log.Warningf("[%s] data missing from capture: %s -> %s\n", s.remoteAddr, flow.Src, flow.Dst)
+	if fromClient {
+		s.client.Gap()
+	} else {
+		s.server.Gap()
+	}
+}
+
+func (h *pcapHandler) Close(flow pcap.Flow) {
+	key := flow
+	if !h.isServer(flow.Dst) {
+		key = flow.Reverse()
+	}
+	s, ok := h.sessions[key]
+	if !ok {
+		return
+	}
+
+	s.closed++
+	if s.closed == 2 {
+		log.Debugf("[%s] close connection\n", s.remoteAddr)
+		delete(h.sessions, key)
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			s.close()
+		}()
+	}
+}
+
+// wait close the remaining sessions and wait until all of them are parsed
+func (h *pcapHandler) wait() {
+	for key, s := range h.sessions {
+		delete(h.sessions, key)
+		h.wg.Add(1)
+		go func(s *pcapSession) {
+			defer h.wg.Done()
+			s.close()
+		}(s)
+	}
+	h.wg.Wait()
+}
@@ -0,0 +1,160 @@
+package pcap
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultMaxBuffered is the max bytes of out of order segments kept for one stream,
+// when exceeded the missing data is given up and reported as a gap
+const DefaultMaxBuffered = 4 * 1024 * 1024
+
+// Flow identifies one direction of a TCP connection
+type Flow struct {
+	Src string
+	Dst string
+}
+
+// Reverse returns the flow of the other direction
+func (flow Flow) Reverse() Flow {
+	return Flow{Src: flow.Dst, Dst: flow.Src}
+}
+
+// Handler receives the reassembled data of TCP streams
+type Handler interface {
+	// Data is called with the in order payload of a flow
+	Data(flow Flow, data []byte, ts time.Time)
+	// Gap is called when some data of a flow is missing from the capture
+	Gap(flow Flow)
+	// Close is called when a flow is finished by FIN or RST, or at Flush
+	Close(flow Flow)
+}
+
+type stream struct {
+	started  bool
+	nextSeq  uint32
+	pending  []*Segment
+	buffered int
+}
+
+// Assembler reassembles TCP streams from segments
+type Assembler struct {
+	MaxBuffered int
+
+	handler Handler
+	streams map[Flow]*stream
+}
+
+// NewAssembler create an assembler which passes stream data to handler
+func NewAssembler(handler Handler) *Assembler {
+	return &Assembler{
+		MaxBuffered: DefaultMaxBuffered,
+		handler:     handler,
+		streams:     make(map[Flow]*stream),
+	}
+}
+
+// Assemble add a segment to its stream, segments must be added in capture order
+func (a *Assembler) Assemble(seg *Segment) {
+	flow := Flow{Src: seg.Src(), Dst: seg.Dst()}
+	s, ok := a.streams[flow]
+	if !ok {
+		if len(seg.Payload) == 0 && seg.Flags&FlagSYN == 0 {
+			// a pure ack or the end of a stream already closed
+			return
+		}
+		s = &stream{}
+		a.streams[flow] = s
+	}
+
+	if seg.Flags&FlagSYN != 0 {
+		s.started = true
+		s.nextSeq = seg.Seq + 1
+		return
+	}
+	if !s.started {
+		// the capture started in the middle of the connection
+		s.started = true
+		s.nextSeq = seg.Seq
+	}
+
+	if len(seg.Payload) > 0 {
+		a.add(flow, s, seg)
+	}
+
+	if seg.Flags&(FlagFIN|FlagRST) != 0 {
+		a.close(flow, s)
+	}
+}
+
+// Flush deliver the buffered segments of all streams and close them
+func (a *Assembler) Flush() {
+	for flow, s := range a.streams {
+		a.close(flow, s)
+	}
+}
+
+func (a *Assembler) add(flow Flow, s *stream, seg *Segment) {
+	if diff := int32(seg.Seq - s.nextSeq); diff > 0 {
+		// a segment from the future, keep it until the missing data arrives
+		payload := append([]byte(nil), seg.Payload...)
+		s.pending = append(s.pending, &Segment{Seq: seg.Seq, Timestamp: seg.Timestamp, Payload: payload})
+		s.buffered += len(payload)
+		if s.buffered > a.MaxBuffered {
+			a.skip(flow, s)
+		}
+		return
+	}
+
+	a.deliver(flow, s, seg)
+	a.drain(flow, s)
+}
+
+// deliver pass the part of seg after nextSeq to the handler
+func (a *Assembler) deliver(flow Flow, s *stream, seg *Segment) {
+	overlap := int(int32(s.nextSeq - seg.Seq))
+	if overlap < 0 || overlap >= len(seg.Payload) {
+		// retransmission of data already delivered
+		return
+	}
+	payload := seg.Payload[overlap:]
+	s.nextSeq += uint32(len(payload))
+	a.handler.Data(flow, payload, seg.Timestamp)
+}
+
+// drain deliver pending segments which became in order
+func (a *Assembler) drain(flow Flow, s *stream) {
+	for len(s.pending) > 0 {
+		sort.Slice(s.pending, func(i, j int) bool {
+			return int32(s.pending[i].Seq-s.pending[j].Seq) < 0
+		})
+		first := s.pending[0]
+		if int32(first.Seq-s.nextSeq) > 0 {
+			return
+		}
+		s.pending = s.pending[1:]
+		s.buffered -= len(first.Payload)
+		a.deliver(flow, s, first)
+	}
+}
+
+// skip give up the missing data before the first pending segment
+func (a *Assembler) skip(flow Flow, s *stream) {
+	if len(s.pending) == 0 {
+		return
+	}
+	sort.Slice(s.pending, func(i, j int) bool {
+		return int32(s.pending[i].Seq-s.pending[j].Seq) < 0
+	})
+	a.handler.Gap(flow)
+	s.nextSeq = s.pending[0].Seq
+	a.drain(flow, s)
+}
+
+func (a *Assembler) close(flow Flow, s *stream) {
+	for len(s.pending) > 0 {
+		a.skip(flow, s)
+	}
+	delete(a.streams, flow)
+	a.handler.Close(flow)
+}
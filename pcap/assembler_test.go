@@ -0,0 +1,124 @@
+package pcap
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandler writes the events of the streams to a log, data as is, gaps
+// as | and the end of a stream as $
+type testHandler struct {
+	log map[Flow]*strings.Builder
+}
+
+func (h *testHandler) stream(flow Flow) *strings.Builder {
+	if h.log == nil {
+		h.log = make(map[Flow]*strings.Builder)
+	}
+	if h.log[flow] == nil {
+		h.log[flow] = &strings.Builder{}
+	}
+	return h.log[flow]
+}
+
+func (h *testHandler) Data(flow Flow, data []byte, ts time.Time) { h.stream(flow).Write(data) }
+func (h *testHandler) Gap(flow Flow)                             { h.stream(flow).WriteString("|") }
+func (h *testHandler) Close(flow Flow)                           { h.stream(flow).WriteString("$") }
+
+// testSegment is a segment of the client flow, seq is relative to the SYN
+type testSegment struct {
+	seq     uint32
+	flags   uint8
+	payload string
+}
+
+func TestAssembler(t *testing.T) {
+	const isn = 0xfffffffa // the sequence numbers wrap around during the stream
+	syn := testSegment{0, FlagSYN, ""}
+	tests := []struct {
+		name     string
+		segments []testSegment
+		expected string
+	}{
+		{"in order", []testSegment{syn, {1, 0, "hello "}, {7, 0, "world"}, {12, FlagFIN, ""}}, "hello world$"},
+		{"out of order", []testSegment{syn, {7, 0, "world"}, {1, 0, "hello "}, {12, FlagFIN, ""}}, "hello world$"},
+		{"reversed", []testSegment{syn, {9, 0, "c"}, {5, 0, "b"}, {1, 0, "aaaa"}, {6, 0, "bbb"}}, "aaaabbbbc$"},
+		{"retransmitted", []testSegment{syn, {1, 0, "hello "}, {1, 0, "hello "}, {7, 0, "world"}, {1, 0, "hello "}}, "hello world$"},
+		{"overlapping retransmission", []testSegment{syn, {1, 0, "hel"}, {1, 0, "hello "}, {4, 0, "lo world"}}, "hello world$"},
+		{"retransmitted out of order", []testSegment{syn, {7, 0, "world"}, {7, 0, "world"}, {1, 0, "hello "}}, "hello world$"},
+		{"mid-stream", []testSegment{{100, 0, "lo "}, {103, 0, "world"}}, "lo world$"},
+		{"mid-stream out of order", []testSegment{{103, 0, "world"}, {100, 0, "lo "}}, "world$"},
+		{"missing data", []testSegment{syn, {1, 0, "hello "}, {10, FlagFIN, "ld"}}, "hello |ld$"},
+		{"reset", []testSegment{syn, {1, 0, "hello"}, {6, FlagRST, ""}, {6, 0, " again"}}, "hello$ again$"},
+		{"ack only", []testSegment{{1, 0, ""}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &testHandler{}
+			a := NewAssembler(h)
+			for _, s := range test.segments {
+				a.Assemble(testClientSegment(t, isn+s.seq, s.flags, s.payload))
+			}
+			a.Flush()
+			var got string
+			if log := h.log[testClientFlow]; log != nil {
+				got = log.String()
+			}
+			if got != test.expected {
+				t.Errorf("stream %q, expect %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestAssemblerMaxBuffered(t *testing.T) {
+	h := &testHandler{}
+	a := NewAssembler(h)
+	a.MaxBuffered = 8
+	a.Assemble(testClientSegment(t, 0, FlagSYN, ""))
+	a.Assemble(testClientSegment(t, 1, 0, "ab"))
+	// the segment at 3 is lost, the later ones are given up waiting for it
+	a.Assemble(testClientSegment(t, 5, 0, "efgh"))
+	a.Assemble(testClientSegment(t, 9, 0, "ijkl"))
+	a.Assemble(testClientSegment(t, 13, 0, "m"))
+	if got := h.log[testClientFlow].String(); got != "ab|efghijklm" {
+		t.Errorf("stream %q", got)
+	}
+}
+
+func TestAssemblerFlows(t *testing.T) {
+	h := &testHandler{}
+	a := NewAssembler(h)
+	a.Assemble(testClientSegment(t, 0, FlagSYN, ""))
+	a.Assemble(testServerSegment(t, 500, FlagSYN, ""))
+	a.Assemble(testClientSegment(t, 1, 0, "ping"))
+	a.Assemble(testServerSegment(t, 501, 0, "pong"))
+	a.Assemble(testClientSegment(t, 5, FlagFIN, ""))
+	if got := h.log[testClientFlow].String(); got != "ping$" {
+		t.Errorf("client stream %q", got)
+	}
+	if got := h.log[testClientFlow.Reverse()].String(); got != "pong" {
+		t.Errorf("server stream %q before flush", got)
+	}
+	a.Flush()
+	if got := h.log[testClientFlow.Reverse()].String(); got != "pong$" {
+		t.Errorf("server stream %q", got)
+	}
+}
+
+var testClientFlow = Flow{Src: "10.0.0.1:52117", Dst: "10.0.0.2:27017"}
+
+func testClientSegment(t *testing.T, seq uint32, flags uint8, payload string) *Segment {
+	return testFlowSegment(t, testClientFlow, seq, flags, payload)
+}
+
+func testServerSegment(t *testing.T, seq uint32, flags uint8, payload string) *Segment {
+	return testFlowSegment(t, testClientFlow.Reverse(), seq, flags, payload)
+}
+
+func testFlowSegment(t *testing.T, flow Flow, seq uint32, flags uint8, payload string) *Segment {
+	srcIP, srcPort := testAddr(t, flow.Src)
+	dstIP, dstPort := testAddr(t, flow.Dst)
+	return &Segment{SrcIP: srcIP, DstIP: dstIP, SrcPort: srcPort, DstPort: dstPort, Seq: seq, Flags: flags, Payload: []byte(payload)}
+}
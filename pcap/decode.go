@@ -0,0 +1,195 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protocolTCP = 6
+)
+
+// TCP flags
+const (
+	FlagFIN = 1 << 0
+	FlagSYN = 1 << 1
+	FlagRST = 1 << 2
+)
+
+// Segment is a decoded TCP segment
+type Segment struct {
+	Timestamp time.Time
+	SrcIP     net.IP
+	DstIP     net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	Seq       uint32
+	Flags     uint8
+	Payload   []byte
+}
+
+// Src returns the source address as host:port
+func (seg *Segment) Src() string {
+	return net.JoinHostPort(seg.SrcIP.String(), strconv.Itoa(int(seg.SrcPort)))
+}
+
+// Dst returns the destination address as host:port
+func (seg *Segment) Dst() string {
+	return net.JoinHostPort(seg.DstIP.String(), strconv.Itoa(int(seg.DstPort)))
+}
+
+// DecodeTCP decode the TCP segment carried by a packet, ok is false
+// when the packet is not a TCP packet over IPv4 or IPv6
+func DecodeTCP(packet *Packet) (seg *Segment, ok bool) {
+	data := packet.Data
+	var etherType uint16
+	switch packet.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:]), data[20:]
+	case LinkTypeNull, LinkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		// the address family is in host byte order for NULL and network byte order for LOOP
+		family := binary.LittleEndian.Uint32(data)
+		if packet.LinkType == LinkTypeLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		data = data[4:]
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30:
+			etherType = etherTypeIPv6
+		}
+	case LinkTypeRaw, linkTypeRawBSD, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) == 0 {
+			return nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	default:
+		return nil, false
+	}
+
+	seg = &Segment{Timestamp: packet.Timestamp}
+	switch etherType {
+	case etherTypeIPv4:
+		data, ok = decodeIPv4(seg, data)
+	case etherTypeIPv6:
+		data, ok = decodeIPv6(seg, data)
+	}
+	if !ok {
+		return nil, false
+	}
+	return seg, decodeTCP(seg, data)
+}
+
+// decodeIPv4 returns the payload of a non fragmented IPv4 TCP packet
+func decodeIPv4(seg *Segment, data []byte) ([]byte, bool) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return nil, false
+	}
+
+	headerLength := int(data[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(data[2:]))
+	fragment := binary.BigEndian.Uint16(data[6:])
+	if headerLength < 20 || totalLength < headerLength || data[9] != protocolTCP {
+		return nil, false
+	}
+	if fragment&0x2000 != 0 || fragment&0x1fff != 0 {
+		// fragmented packets are not reassembled
+		return nil, false
+	}
+	if totalLength < len(data) {
+		// remove the ethernet padding
+		data = data[:totalLength]
+	}
+	if len(data) < headerLength {
+		return nil, false
+	}
+
+	seg.SrcIP = net.IP(append([]byte(nil), data[12:16]...))
+	seg.DstIP = net.IP(append([]byte(nil), data[16:20]...))
+	return data[headerLength:], true
+}
+
+// decodeIPv6 returns the payload of an IPv6 TCP packet, skipping the extension headers
+func decodeIPv6(seg *Segment, data []byte) ([]byte, bool) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return nil, false
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(data[4:]))
+	nextHeader := data[6]
+	seg.SrcIP = net.IP(append([]byte(nil), data[8:24]...))
+	seg.DstIP = net.IP(append([]byte(nil), data[24:40]...))
+	data = data[40:]
+	if payloadLength > 0 && payloadLength < len(data) {
+		data = data[:payloadLength]
+	}
+
+	for {
+		switch nextHeader {
+		case protocolTCP:
+			return data, true
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return nil, false
+			}
+			length := (int(data[1]) + 1) * 8
+			if len(data) < length {
+				return nil, false
+			}
+			nextHeader, data = data[0], data[length:]
+		default:
+			// fragments and other protocols are not handled
+			return nil, false
+		}
+	}
+}
+
+func decodeTCP(seg *Segment, data []byte) bool {
+	if len(data) < 20 {
+		return false
+	}
+
+	headerLength := int(data[12]>>4) * 4
+	if headerLength < 20 || headerLength > len(data) {
+		return false
+	}
+
+	seg.SrcPort = binary.BigEndian.Uint16(data[0:])
+	seg.DstPort = binary.BigEndian.Uint16(data[2:])
+	seg.Seq = binary.BigEndian.Uint32(data[4:])
+	seg.Flags = data[13] & (FlagFIN | FlagSYN | FlagRST)
+	seg.Payload = data[headerLength:]
+	return true
+}
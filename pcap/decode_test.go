@@ -0,0 +1,147 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// testTCP returns the TCP header of a segment from src to dst followed by payload
+func testTCP(t *testing.T, src, dst string, seq uint32, flags uint8, payload string) []byte {
+	_, srcPort := testAddr(t, src)
+	_, dstPort := testAddr(t, dst)
+	b := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(b[0:], srcPort)
+	binary.BigEndian.PutUint16(b[2:], dstPort)
+	binary.BigEndian.PutUint32(b[4:], seq)
+	b[12] = 5 << 4
+	b[13] = flags
+	return append(b, payload...)
+}
+
+// testIPv4 returns an IPv4 packet carrying a TCP segment from src to dst
+func testIPv4(t *testing.T, src, dst string, seq uint32, flags uint8, payload string) []byte {
+	srcIP, _ := testAddr(t, src)
+	dstIP, _ := testAddr(t, dst)
+	tcp := testTCP(t, src, dst, seq, flags, payload)
+	b := make([]byte, 20, 20+len(tcp))
+	b[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(b[2:], uint16(20+len(tcp)))
+	b[9] = protocolTCP
+	copy(b[12:], srcIP.To4())
+	copy(b[16:], dstIP.To4())
+	return append(b, tcp...)
+}
+
+// testIPv6 returns an IPv6 packet carrying a TCP segment from src to dst after
+// a hop-by-hop options header
+func testIPv6(t *testing.T, src, dst string, seq uint32, payload string) []byte {
+	srcIP, _ := testAddr(t, src)
+	dstIP, _ := testAddr(t, dst)
+	tcp := testTCP(t, src, dst, seq, 0, payload)
+	b := make([]byte, 40+8, 40+8+len(tcp))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(tcp)))
+	b[6] = 0
+	copy(b[8:], srcIP.To16())
+	copy(b[24:], dstIP.To16())
+	b[40] = protocolTCP
+	return append(b, tcp...)
+}
+
+// testEthernet wraps packet in an ethernet frame, with a VLAN tag when vlan is set
+func testEthernet(etherType uint16, vlan bool, packet []byte) []byte {
+	b := make([]byte, 12, 12+4+2+len(packet)+8)
+	if vlan {
+		b = append(b, 0x81, 0x00, 0, 1)
+	}
+	b = append(b, byte(etherType>>8), byte(etherType))
+	b = append(b, packet...)
+	// ethernet padding
+	return append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func testAddr(t *testing.T, addr string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.ParseIP(host), uint16(n)
+}
+
+func TestDecodeTCP(t *testing.T) {
+	const client, server = "10.0.0.1:52117", "10.0.0.2:27017"
+	const client6, server6 = "[fd00::1]:52117", "[fd00::2]:27017"
+	ipv4 := testIPv4(t, client, server, 1000, FlagFIN, "hello")
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	sll2 := append([]byte{0x08, 0x00}, make([]byte, 18)...)
+
+	tests := []struct {
+		name     string
+		linkType uint32
+		data     []byte
+		src, dst string
+	}{
+		{"ethernet", LinkTypeEthernet, testEthernet(etherTypeIPv4, false, ipv4), client, server},
+		{"ethernet vlan", LinkTypeEthernet, testEthernet(etherTypeIPv4, true, ipv4), client, server},
+		{"ethernet ipv6", LinkTypeEthernet, testEthernet(etherTypeIPv6, false, testIPv6(t, client6, server6, 1000, "hello")), client6, server6},
+		{"raw", LinkTypeRaw, ipv4, client, server},
+		{"raw ipv6", LinkTypeIPv6, testIPv6(t, client6, server6, 1000, "hello"), client6, server6},
+		{"linux sll", LinkTypeLinuxSLL, append(sll, ipv4...), client, server},
+		{"linux sll2", LinkTypeLinuxSLL2, append(sll2, ipv4...), client, server},
+		{"null", LinkTypeNull, append([]byte{2, 0, 0, 0}, ipv4...), client, server},
+		{"loop", LinkTypeLoop, append([]byte{0, 0, 0, 2}, ipv4...), client, server},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seg, ok := DecodeTCP(&Packet{LinkType: test.linkType, Data: test.data})
+			if !ok {
+				t.Fatal("not decoded")
+			}
+			if seg.Src() != test.src || seg.Dst() != test.dst {
+				t.Errorf("flow %s > %s, expect %s > %s", seg.Src(), seg.Dst(), test.src, test.dst)
+			}
+			if seg.Seq != 1000 || string(seg.Payload) != "hello" {
+				t.Errorf("seq %d payload %q", seg.Seq, seg.Payload)
+			}
+		})
+	}
+
+	seg, _ := DecodeTCP(&Packet{LinkType: LinkTypeRaw, Data: ipv4})
+	if seg.Flags != FlagFIN {
+		t.Errorf("flags %x, expect FIN", seg.Flags)
+	}
+}
+
+func TestDecodeTCPIgnored(t *testing.T) {
+	ipv4 := testIPv4(t, "10.0.0.1:52117", "10.0.0.2:27017", 1000, 0, "hello")
+	udp := append([]byte{}, ipv4...)
+	udp[9] = 17
+	fragment := append([]byte{}, ipv4...)
+	fragment[6] = 0x20 // more fragments
+
+	tests := []struct {
+		name     string
+		linkType uint32
+		data     []byte
+	}{
+		{"udp", LinkTypeRaw, udp},
+		{"fragment", LinkTypeRaw, fragment},
+		{"arp", LinkTypeEthernet, testEthernet(0x0806, false, ipv4)},
+		{"unknown link type", 147, ipv4},
+		{"short ethernet", LinkTypeEthernet, make([]byte, 10)},
+		{"short ipv4", LinkTypeRaw, ipv4[:19]},
+		{"short tcp", LinkTypeRaw, ipv4[:30]},
+		{"empty", LinkTypeRaw, nil},
+	}
+	for _, test := range tests {
+		if _, ok := DecodeTCP(&Packet{LinkType: test.linkType, Data: test.data}); ok {
+			t.Errorf("%s decoded", test.name)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// link layer types, see https://www.tcpdump.org/linktypes.html
+const (
+	LinkTypeNull      = 0
+	LinkTypeEthernet  = 1
+	LinkTypeRaw       = 101
+	LinkTypeLoop      = 108
+	LinkTypeLinuxSLL  = 113
+	LinkTypeIPv4      = 228
+	LinkTypeIPv6      = 229
+	LinkTypeLinuxSLL2 = 276
+	// linkTypeRawBSD is the value some BSDs use in place of LinkTypeRaw
+	linkTypeRawBSD = 12
+)
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+
+	pcapngInterfaceDescription = 0x00000001
+	pcapngSimplePacket         = 0x00000003
+	pcapngEnhancedPacket       = 0x00000006
+
+	// maxRecordSize protects against allocating huge buffers for corrupted files
+	maxRecordSize = 256 * 1024 * 1024
+)
+
+// Packet is a captured link layer frame
+type Packet struct {
+	Timestamp time.Time
+	LinkType  uint32
+	Data      []byte
+}
+
+// Reader reads packets from a capture file
+type Reader interface {
+	// Next returns the next packet, io.EOF is returned at the end of the file
+	Next() (*Packet, error)
+}
+
+// NewReader create a reader for a pcap or pcapng file, the format is detected by its magic number
+func NewReader(r io.Reader) (Reader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read file header failed: %v", err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapngSectionHeader:
+		return &pcapngReader{r: br}, nil
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicroseconds,
+		binary.LittleEndian.Uint32(magic) == pcapMagicNanoseconds,
+		binary.BigEndian.Uint32(magic) == pcapMagicMicroseconds,
+		binary.BigEndian.Uint32(magic) == pcapMagicNanoseconds:
+		return newPcapReader(br)
+	}
+	return nil, fmt.Errorf("unknown capture file format, magic: %x", magic)
+}
+
+// pcapReader reads the classic libpcap format
+type pcapReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	nanosecond bool
+	linkType   uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read pcap header failed: %v", err)
+	}
+
+	reader := &pcapReader{r: r, order: binary.LittleEndian}
+	magic := binary.LittleEndian.Uint32(header)
+	if magic != pcapMagicMicroseconds && magic != pcapMagicNanoseconds {
+		reader.order = binary.BigEndian
+		magic = binary.BigEndian.Uint32(header)
+	}
+	reader.nanosecond = magic == pcapMagicNanoseconds
+	reader.linkType = reader.order.Uint32(header[20:]) & 0x0fffffff
+	return reader, nil
+}
+
+func (reader *pcapReader) Next() (*Packet, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	sec := reader.order.Uint32(header[0:])
+	frac := reader.order.Uint32(header[4:])
+	capturedLength := reader.order.Uint32(header[8:])
+	if capturedLength > maxRecordSize {
+		return nil, fmt.Errorf("invalid packet length: %d", capturedLength)
+	}
+
+	data := make([]byte, capturedLength)
+	if _, err := io.ReadFull(reader.r, data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	if !reader.nanosecond {
+		frac *= 1000
+	}
+	return &Packet{
+		Timestamp: time.Unix(int64(sec), int64(frac)),
+		LinkType:  reader.linkType,
+		Data:      data,
+	}, nil
+}
+
+type pcapngInterface struct {
+	linkType uint32
+	// tsUnit is the duration of one timestamp tick
+	tsUnit time.Duration
+	// tsPerSecond is used instead of tsUnit for resolutions finer than a nanosecond
+	tsPerSecond uint64
+}
+
+// pcapngReader reads the pcapng format, see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+func (reader *pcapngReader) Next() (*Packet, error) {
+	for {
+		blockType, body, err := reader.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case pcapngSectionHeader:
+			// interface ids are scoped to a section
+			reader.interfaces = nil
+		case pcapngInterfaceDescription:
+			if err := reader.addInterface(body); err != nil {
+				return nil, err
+			}
+		case pcapngEnhancedPacket:
+			return reader.enhancedPacket(body)
+		case pcapngSimplePacket:
+			return reader.simplePacket(body)
+		}
+	}
+}
+
+// readBlock read a whole block, body excludes the type, the lengths and the padding
+func (reader *pcapngReader) readBlock() (blockType uint32, body []byte, err error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header) == pcapngSectionHeader {
+		// the byte order of a section is defined by the byte-order magic following the length
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(reader.r, magic); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+			reader.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+			reader.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte-order magic: %x", magic)
+		}
+		header = append(header, magic...)
+	}
+	if reader.order == nil {
+		return 0, nil, errors.New("pcapng block before section header")
+	}
+
+	blockType = reader.order.Uint32(header[0:])
+	totalLength := reader.order.Uint32(header[4:])
+	if totalLength < 12 || totalLength > maxRecordSize || totalLength%4 != 0 {
+		return 0, nil, fmt.Errorf("invalid pcapng block length: %d", totalLength)
+	}
+
+	rest := make([]byte, int(totalLength)-len(header))
+	if _, err := io.ReadFull(reader.r, rest); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	// the body starts after the fixed 8 bytes header and ends before the trailing length
+	block := append(header, rest...)
+	return blockType, block[8 : len(block)-4], nil
+}
+
+func (reader *pcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("invalid pcapng interface description block")
+	}
+
+	iface := pcapngInterface{
+		linkType: uint32(reader.order.Uint16(body[0:])),
+		tsUnit:   time.Microsecond,
+	}
+	// options are encoded as code(2) length(2) value padded to 4 bytes
+	options := body[8:]
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options[0:])
+		length := int(reader.order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == 9 && length >= 1 { // if_tsresol
+			iface.tsUnit, iface.tsPerSecond = timestampResolution(options[4])
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	reader.interfaces = append(reader.interfaces, iface)
+	return nil
+}
+
+// timestampResolution decode if_tsresol, the high bit selects a power of 2
+// instead of a power of 10
+func timestampResolution(resol byte) (time.Duration, uint64) {
+	perSecond := uint64(1)
+	for i := 0; i < int(resol&0x7f) && perSecond < 1<<62; i++ {
+		if resol&0x80 != 0 {
+			perSecond *= 2
+		} else {
+			perSecond *= 10
+		}
+	}
+	if perSecond <= uint64(time.Second) && uint64(time.Second)%perSecond == 0 {
+		return time.Second / time.Duration(perSecond), 0
+	}
+	return 0, perSecond
+}
+
+func (reader *pcapngReader) enhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("invalid pcapng enhanced packet block")
+	}
+
+	interfaceID := reader.order.Uint32(body[0:])
+	if int(interfaceID) >= len(reader.interfaces) {
+		return nil, fmt.Errorf("pcapng packet refers to unknown interface %d", interfaceID)
+	}
+	iface := reader.interfaces[interfaceID]
+
+	ts := uint64(reader.order.Uint32(body[4:]))<<32 | uint64(reader.order.Uint32(body[8:]))
+	capturedLength := reader.order.Uint32(body[12:])
+	if int(capturedLength) > len(body)-20 {
+		return nil, fmt.Errorf("invalid pcapng packet length: %d", capturedLength)
+	}
+
+	var timestamp time.Time
+	if iface.tsPerSecond > 0 {
+		// the fraction times 1e9 overflows 64 bits for resolutions finer than a nanosecond
+		hi, lo := bits.Mul64(ts%iface.tsPerSecond, uint64(time.Second))
+		nsec, _ := bits.Div64(hi, lo, iface.tsPerSecond)
+		timestamp = time.Unix(int64(ts/iface.tsPerSecond), int64(nsec))
+	} else {
+		timestamp = time.Unix(0, 0).Add(time.Duration(ts) * iface.tsUnit)
+	}
+
+	return &Packet{
+		Timestamp: timestamp,
+		LinkType:  iface.linkType,
+		Data:      body[20 : 20+capturedLength],
+	}, nil
+}
+
+// simplePacket decode a simple packet block, it carries no timestamp
+func (reader *pcapngReader) simplePacket(body []byte) (*Packet, error) {
+	if len(body) < 4 || len(reader.interfaces) == 0 {
+		return nil, errors.New("invalid pcapng simple packet block")
+	}
+
+	data := body[4:]
+	if originalLength := reader.order.Uint32(body[0:]); int(originalLength) < len(data) {
+		data = data[:originalLength]
+	}
+	return &Packet{
+		LinkType: reader.interfaces[0].linkType,
+		Data:     data,
+	}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
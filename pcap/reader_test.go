@@ -0,0 +1,274 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPcap returns a pcap file of packets captured one second apart from
+// start, the timestamps are in nanoseconds when magic says so
+func testPcap(order binary.ByteOrder, magic uint32, linkType uint32, start time.Time, packets ...[]byte) []byte {
+	b := make([]byte, 24)
+	order.PutUint32(b[0:], magic)
+	order.PutUint16(b[4:], 2)
+	order.PutUint16(b[6:], 4)
+	order.PutUint32(b[16:], 65535)
+	order.PutUint32(b[20:], linkType)
+	for i, packet := range packets {
+		ts := start.Add(time.Duration(i) * time.Second)
+		frac := uint32(ts.Nanosecond())
+		if magic == pcapMagicMicroseconds {
+			frac /= 1000
+		}
+		header := make([]byte, 16)
+		order.PutUint32(header[0:], uint32(ts.Unix()))
+		order.PutUint32(header[4:], frac)
+		order.PutUint32(header[8:], uint32(len(packet)))
+		order.PutUint32(header[12:], uint32(len(packet)))
+		b = append(append(b, header...), packet...)
+	}
+	return b
+}
+
+// testBlock returns a pcapng block of blockType with body padded to 4 bytes
+func testBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	padded := (len(body) + 3) / 4 * 4
+	b := make([]byte, 8+padded+4)
+	order.PutUint32(b[0:], blockType)
+	order.PutUint32(b[4:], uint32(len(b)))
+	copy(b[8:], body)
+	order.PutUint32(b[8+padded:], uint32(len(b)))
+	return b
+}
+
+func testSectionHeader(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body[0:], pcapngByteOrderMagic)
+	order.PutUint16(body[4:], 1)
+	order.PutUint64(body[8:], ^uint64(0))
+	return testBlock(order, pcapngSectionHeader, body)
+}
+
+// testInterface returns an interface description block, with the if_tsresol
+// option when tsresol is not 0
+func testInterface(order binary.ByteOrder, linkType uint16, tsresol byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:], linkType)
+	order.PutUint32(body[4:], 65535)
+	if tsresol != 0 {
+		option := make([]byte, 8)
+		order.PutUint16(option[0:], 9)
+		order.PutUint16(option[2:], 1)
+		option[4] = tsresol
+		body = append(body, option...)
+		// opt_endofopt
+		body = append(body, 0, 0, 0, 0)
+	}
+	return testBlock(order, pcapngInterfaceDescription, body)
+}
+
+func testEnhancedPacket(order binary.ByteOrder, interfaceID uint32, ts uint64, packet []byte) []byte {
+	body := make([]byte, 20, 20+len(packet))
+	order.PutUint32(body[0:], interfaceID)
+	order.PutUint32(body[4:], uint32(ts>>32))
+	order.PutUint32(body[8:], uint32(ts))
+	order.PutUint32(body[12:], uint32(len(packet)))
+	order.PutUint32(body[16:], uint32(len(packet)))
+	return testBlock(order, pcapngEnhancedPacket, append(body, packet...))
+}
+
+func testSimplePacket(order binary.ByteOrder, packet []byte) []byte {
+	body := make([]byte, 4, 4+len(packet))
+	order.PutUint32(body[0:], uint32(len(packet)))
+	return testBlock(order, pcapngSimplePacket, append(body, packet...))
+}
+
+// readAll returns the packets of a capture file
+func readAll(t *testing.T, file []byte) []*Packet {
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []*Packet
+	for {
+		packet, err := r.Next()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	start := time.Unix(1645344931, 402113000)
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		magic uint32
+	}{
+		{"little endian", binary.LittleEndian, pcapMagicMicroseconds},
+		{"big endian", binary.BigEndian, pcapMagicMicroseconds},
+		{"little endian nanoseconds", binary.LittleEndian, pcapMagicNanoseconds},
+		{"big endian nanoseconds", binary.BigEndian, pcapMagicNanoseconds},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := testPcap(test.order, test.magic, LinkTypeEthernet, start, []byte("first"), []byte("second"))
+			packets := readAll(t, file)
+			if len(packets) != 2 {
+				t.Fatalf("%d packets, expect 2", len(packets))
+			}
+			for i, data := range []string{"first", "second"} {
+				if string(packets[i].Data) != data || packets[i].LinkType != LinkTypeEthernet {
+					t.Errorf("packet %d: %q link type %d", i, packets[i].Data, packets[i].LinkType)
+				}
+				if ts := start.Add(time.Duration(i) * time.Second); !packets[i].Timestamp.Equal(ts) {
+					t.Errorf("packet %d: timestamp %v, expect %v", i, packets[i].Timestamp, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPcapTruncated(t *testing.T) {
+	file := testPcap(binary.LittleEndian, pcapMagicMicroseconds, LinkTypeRaw, time.Unix(0, 0), []byte("first"), []byte("second"))
+	// the last packet is cut, the packets before it are read
+	packets := readAll(t, file[:len(file)-3])
+	if len(packets) != 1 || string(packets[0].Data) != "first" {
+		t.Errorf("packets %v", packets)
+	}
+}
+
+func TestReadPcapng(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			var file []byte
+			file = append(file, testSectionHeader(order)...)
+			// microseconds by default, then nanoseconds
+			file = append(file, testInterface(order, LinkTypeEthernet, 0)...)
+			file = append(file, testInterface(order, LinkTypeRaw, 9)...)
+			file = append(file, testEnhancedPacket(order, 0, 1645344931402113, []byte("micro"))...)
+			file = append(file, testEnhancedPacket(order, 1, 1645344931402113999, []byte("nano"))...)
+			file = append(file, testSimplePacket(order, []byte("simple"))...)
+			// a new section resets the interfaces
+			file = append(file, testSectionHeader(order)...)
+			file = append(file, testInterface(order, LinkTypeLinuxSLL, 0)...)
+			file = append(file, testEnhancedPacket(order, 0, 0, []byte("second section"))...)
+
+			packets := readAll(t, file)
+			expected := []struct {
+				data     string
+				linkType uint32
+				ts       time.Time
+			}{
+				{"micro", LinkTypeEthernet, time.Unix(1645344931, 402113000)},
+				{"nano", LinkTypeRaw, time.Unix(1645344931, 402113999)},
+				{"simple", LinkTypeEthernet, time.Time{}},
+				{"second section", LinkTypeLinuxSLL, time.Unix(0, 0)},
+			}
+			if len(packets) != len(expected) {
+				t.Fatalf("%d packets, expect %d", len(packets), len(expected))
+			}
+			for i, e := range expected {
+				p := packets[i]
+				if string(p.Data) != e.data || p.LinkType != e.linkType || !p.Timestamp.Equal(e.ts) {
+					t.Errorf("packet %d: %q link type %d at %v, expect %q link type %d at %v",
+						i, p.Data, p.LinkType, p.Timestamp, e.data, e.linkType, e.ts)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPcapngFineTimestamps(t *testing.T) {
+	le := binary.LittleEndian
+	var file []byte
+	file = append(file, testSectionHeader(le)...)
+	// picoseconds and 2^-40 seconds
+	file = append(file, testInterface(le, LinkTypeRaw, 12)...)
+	file = append(file, testInterface(le, LinkTypeRaw, 0x80|40)...)
+	file = append(file, testEnhancedPacket(le, 0, 10*1000000000000+402113999999, []byte("pico"))...)
+	file = append(file, testEnhancedPacket(le, 1, 5<<40|1<<39, []byte("binary"))...)
+
+	packets := readAll(t, file)
+	if len(packets) != 2 {
+		t.Fatalf("%d packets, expect 2", len(packets))
+	}
+	for i, ts := range []time.Time{time.Unix(10, 402113999), time.Unix(5, 500000000)} {
+		if !packets[i].Timestamp.Equal(ts) {
+			t.Errorf("packet %d: timestamp %v, expect %v", i, packets[i].Timestamp, ts)
+		}
+	}
+}
+
+func TestTimestampResolution(t *testing.T) {
+	tests := []struct {
+		resol     byte
+		unit      time.Duration
+		perSecond uint64
+	}{
+		{6, time.Microsecond, 0},
+		{9, time.Nanosecond, 0},
+		{3, time.Millisecond, 0},
+		{12, 0, 1000000000000},
+		{0x80 | 10, 0, 1024},
+	}
+	for _, test := range tests {
+		unit, perSecond := timestampResolution(test.resol)
+		if unit != test.unit || perSecond != test.perSecond {
+			t.Errorf("resolution %x: %v %d, expect %v %d", test.resol, unit, perSecond, test.unit, test.perSecond)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	le := binary.LittleEndian
+	header := append(testSectionHeader(le), testInterface(le, LinkTypeRaw, 0)...)
+	badLength := append([]byte{}, header...)
+	badLength = append(badLength, 6, 0, 0, 0, 13, 0, 0, 0)
+	badOrder := testSectionHeader(le)
+	copy(badOrder[8:], []byte{1, 2, 3, 4})
+	hugePacket := testPcap(le, pcapMagicMicroseconds, LinkTypeRaw, time.Unix(0, 0), []byte("x"))
+	le.PutUint32(hugePacket[24+8:], maxRecordSize+1)
+
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"empty", nil, "read file header failed"},
+		{"unknown magic", []byte("not a capture file"), "unknown capture file format"},
+		{"short pcap header", testPcap(le, pcapMagicMicroseconds, LinkTypeRaw, time.Unix(0, 0))[:20], "read pcap header failed"},
+		{"huge packet", hugePacket, "invalid packet length"},
+		{"pcapng block length", badLength, "invalid pcapng block length: 13"},
+		{"pcapng byte order", badOrder, "invalid pcapng byte-order magic"},
+		{"pcapng unknown interface", append(append([]byte{}, header...), testEnhancedPacket(le, 1, 0, []byte("x"))...),
+			"unknown interface 1"},
+		{"pcapng short packet block", append(append([]byte{}, header...), testBlock(le, pcapngEnhancedPacket, make([]byte, 8))...),
+			"invalid pcapng enhanced packet block"},
+		{"pcapng simple packet without interface", append(testSectionHeader(le), testSimplePacket(le, []byte("x"))...),
+			"invalid pcapng simple packet block"},
+		{"pcapng short interface", append(testSectionHeader(le), testBlock(le, pcapngInterfaceDescription, make([]byte, 4))...),
+			"invalid pcapng interface description block"},
+		{"pcapng truncated block", append(append([]byte{}, header...), testEnhancedPacket(le, 0, 0, []byte("x"))[:20]...),
+			"unexpected EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(test.file))
+			for err == nil {
+				_, err = r.Next()
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %q, expect %q", err, test.err)
+			}
+		})
+	}
+}
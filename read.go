@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/mylxsw/asteria/log"
+)
+
+// readCapture parse a capture file recorded with -w, the output is the same
+// as the proxy mode with the recorded timestamps
+func readCapture(args []string) {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	fs.DurationVar(timeout, "t", mongo.DefaultReplyTimeout, "report requests without reply after this timeout")
+	fs.StringVar(format, "o", "log", "output format, log, json (one JSON object per message) or none")
+	fs.StringVar(jsonMode, "j", "relaxed", "how documents are written, relaxed or canonical extended JSON, or shell")
+	fs.IntVar(digestTop, "digest", 0, "report the top N query shapes by total time at the end, 0 to disable")
+	fs.DurationVar(slowThreshold, "slow", 0, "only write the operations slower than this, 0 writes every message")
+	fs.StringVar(filterExpr, "filter", "", "only write the operations matching this expression, such as 'db=shop !cmd=hello or error'")
+	fs.Var(&redactRules, "redact", redactUsage)
+	fs.BoolVar(redactAuth, "redact-auth", true, "redact the credentials of saslStart, saslContinue and authenticate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s read [options] <capture file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := setupOutput(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Errorf("open capture file failed: %v", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		log.Errorf("read capture file failed: %v", err)
+		os.Exit(1)
+	}
+
+	var wg sync.WaitGroup
+	closeSession := func(s *session) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.close()
+		}()
+	}
+
+	sessions := make(map[uint64]*session)
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("read capture file failed: %v", err)
+			}
+			break
+		}
+
+		if record.Kind == capture.KindOpen {
+			remoteAddr := string(record.Data)
+			log.Debugf("[%s] new client connected\n", remoteAddr)
+			if s, ok := sessions[record.ConnID]; ok {
+				closeSession(s)
+			}
+			sessions[record.ConnID] = newSession(record.ConnID, remoteAddr, true, output)
+			continue
+		}
+
+		s, ok := sessions[record.ConnID]
+		if !ok {
+			// the connection was opened before the recording started
+			continue
+		}
+		parser := s.client
+		if record.Direction == capture.ServerToClient {
+			parser = s.server
+		}
+
+		switch record.Kind {
+		case capture.KindData:
+			_, _ = parser.WriteWithTime(record.Data, record.Time)
+		case capture.KindGap:
+			log.Warningf("[%s] data missing from capture: %s\n", s.remoteAddr, record.Direction)
+			parser.Gap()
+		case capture.KindClose:
+			log.Debugf("[%s] close connection\n", s.remoteAddr)
+			delete(sessions, record.ConnID)
+			closeSession(s)
+		}
+	}
+
+	for _, s := range sessions {
+		closeSession(s)
+	}
+	wg.Wait()
+	reportDigest()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ma6174/mgosniff/config"
+	"github.com/mylxsw/asteria/log"
+)
+
+var (
+	adminAddr = flag.String("admin", "", "serve the admin API on this address, such as 127.0.0.1:9217, POST /reload reloads the config file")
+	// reloadLock serializes the reloads
+	reloadLock sync.Mutex
+	// loadedConfig is the config file applied last, nil when the route comes from the flags
+	loadedConfig *config.Config
+	// running are the routes served by listen address
+	running map[string]*route
+)
+
+// reload read the config file again and apply it: the routes whose listen
+// address is still in the file get the new settings, the new ones listen and
+// the removed ones stop listening. The connections open are kept, nothing
+// changes when the file or one of its routes is invalid
+func reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	if loadedConfig == nil {
+		return fmt.Errorf("no config file to reload, start the proxy with -c")
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// the new routes listen before anything changes, a busy address aborts the reload
+	updates := make(map[*route]*routeSettings)
+	var added []*route
+	var listeners []net.Listener
+	abort := func(err error) error {
+		for _, r := range added {
+			r.close()
+		}
+		for _, settings := range updates {
+			if settings.explainer != nil {
+				settings.explainer.close()
+			}
+		}
+		return err
+	}
+	for _, c := range cfg.Routes {
+		r, ok := running[c.Listen]
+		if !ok {
+			if r, err = newRoute(c); err != nil {
+				return abort(err)
+			}
+			ln, err := r.listen(c.Listen)
+			if err != nil {
+				return abort(routeError(c, err))
+			}
+			added, listeners = append(added, r), append(listeners, ln)
+			continue
+		}
+		prev := r.current()
+		if c.ReplicaSet != prev.ReplicaSet || c.ReplicaSet && (c.Advertise != prev.Advertise || c.Upstream != prev.Upstream) {
+			return abort(routeError(c, fmt.Errorf("replica_set, advertise and the upstream of a replica set can't change without restart")))
+		}
+		settings, err := newRouteSettings(c)
+		if err != nil {
+			return abort(err)
+		}
+		updates[r] = settings
+	}
+
+	if cfg.Metrics != loadedConfig.Metrics || cfg.Admin != loadedConfig.Admin ||
+		cfg.Digest != loadedConfig.Digest || cfg.Timeout != loadedConfig.Timeout {
+		log.Warningf("metrics, admin, digest and timeout are only read at start, restart to change them")
+	}
+	for r, settings := range updates {
+		r.update(settings)
+	}
+	for addr, r := range running {
+		if _, ok := updates[r]; !ok {
+			log.Debugf("stop listening at %s, the connections open are kept\n", addr)
+			r.close()
+			delete(running, addr)
+		}
+	}
+	for i, r := range added {
+		log.Debugf("%s listen at %s, proxy to mongodb server %s\n", os.Args[0], r.addr, r.current().Upstream)
+		running[r.addr] = r
+		go accept(listeners[i], r, "")
+	}
+	loadedConfig = cfg
+	log.Infof("config reloaded from %s, %d routes", *configFile, len(cfg.Routes))
+	return nil
+}
+
+// handleReloadSignal reload the config file on SIGHUP
+func handleReloadSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := reload(); err != nil {
+				log.Errorf("reload failed, the previous config is kept: %v", err)
+			}
+		}
+	}()
+}
+
+// serveAdmin serve the admin API on -admin
+func serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "reload needs POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			log.Errorf("reload failed, the previous config is kept: %v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
+	go func() {
+		if err := http.ListenAndServe(*adminAddr, mux); err != nil {
+			log.Errorf("serve admin API failed: %v", err)
+		}
+	}()
+}
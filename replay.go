@@ -0,0 +1,626 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/ma6174/mgosniff/sink"
+	"github.com/mylxsw/asteria/log"
+)
+
+// replayCapture send the client requests of a capture file recorded with -w to
+// another server, one connection for each recorded connection, and compare the
+// replies with the recorded ones
+func replayCapture(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("d", "127.0.0.1:27017", "replay to dest addr")
+	speed := fs.Float64("speed", 1, "replay speed relative to the recording, 2 is twice as fast, 0 is as fast as possible")
+	fs.DurationVar(timeout, "t", mongo.DefaultReplyTimeout, "give up waiting for a reply after this timeout")
+	fs.Var(&redactRules, "redact", redactUsage)
+	fs.BoolVar(redactAuth, "redact-auth", true, "redact the credentials of saslStart, saslContinue and authenticate")
+	username := fs.String("u", "", "authenticate each replayed connection as this user")
+	password := fs.String("p", "", "password of -u")
+	authSource := fs.String("auth-db", "admin", "database of -u")
+	authMechanism := fs.String("auth-mechanism", "SCRAM-SHA-256", "authentication mechanism of -u, SCRAM-SHA-1 or SCRAM-SHA-256")
+	addUpstreamTLSFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [options] <capture file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	redactor, err := newRedactor(redactRules, *redactAuth)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(2)
+	}
+	var credential *mongo.Credential
+	if *username != "" {
+		if *authMechanism != "SCRAM-SHA-1" && *authMechanism != "SCRAM-SHA-256" {
+			log.Errorf("unsupported authentication mechanism: %s", *authMechanism)
+			os.Exit(2)
+		}
+		credential = &mongo.Credential{Username: *username, Password: *password, Source: *authSource, Mechanism: *authMechanism}
+	}
+	var dialTLS *tls.Config
+	if u := flagUpstreamTLS(); u.Enabled {
+		if dialTLS, err = newDialTLS(u.CA, u.Cert, u.Key, u.SNI, u.Insecure); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(2)
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Errorf("open capture file failed: %v", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		log.Errorf("read capture file failed: %v", err)
+		os.Exit(1)
+	}
+
+	log.Debugf("replay %s to mongodb server %s, speed %v\n", fs.Arg(0), *target, *speed)
+	r := newReplayer(*target, *speed, redactor)
+	r.dialTLS, r.credential = dialTLS, credential
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("read capture file failed: %v", err)
+			}
+			break
+		}
+		r.add(record)
+	}
+	r.wait()
+	r.report(os.Stdout)
+}
+
+// replayer runs one replayConn for each recorded connection
+type replayer struct {
+	target string
+	clock  *replayClock
+	// redactor redacts the logged requests and replies when it is set
+	redactor *mongo.Redactor
+	// dialTLS is set when the target is connected with TLS
+	dialTLS *tls.Config
+	// credential authenticates the connections to the target when it is set
+	credential *mongo.Credential
+	conns      map[uint64]*replayConn
+	wg         sync.WaitGroup
+
+	lock  sync.Mutex
+	stats map[string]*replayStats
+}
+
+func newReplayer(target string, speed float64, redactor *mongo.Redactor) *replayer {
+	return &replayer{
+		target:   target,
+		clock:    &replayClock{speed: speed},
+		redactor: redactor,
+		conns:    make(map[uint64]*replayConn),
+		stats:    make(map[string]*replayStats),
+	}
+}
+
+func (r *replayer) add(record *capture.Record) {
+	r.clock.begin(record.Time)
+
+	if record.Kind == capture.KindOpen {
+		if c, ok := r.conns[record.ConnID]; ok {
+			r.close(c)
+		}
+		c := newReplayConn(string(record.Data))
+		r.conns[record.ConnID] = c
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			c.run(r)
+		}()
+		return
+	}
+
+	c, ok := r.conns[record.ConnID]
+	if !ok {
+		// the connection was opened before the recording started
+		return
+	}
+	parser := c.client
+	if record.Direction == capture.ServerToClient {
+		parser = c.server
+	}
+
+	switch record.Kind {
+	case capture.KindData:
+		_, _ = parser.WriteWithTime(record.Data, record.Time)
+	case capture.KindGap:
+		log.Warningf("[%s] data missing from capture: %s\n", c.remoteAddr, record.Direction)
+		parser.Gap()
+	case capture.KindClose:
+		delete(r.conns, record.ConnID)
+		r.close(c)
+	}
+}
+
+// close stop feeding c, the results are collected once all its requests are replayed
+func (r *replayer) close(c *replayConn) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		c.close()
+		r.collect(c)
+	}()
+}
+
+// wait close the remaining connections and wait until all of them are replayed
+func (r *replayer) wait() {
+	for id, c := range r.conns {
+		delete(r.conns, id)
+		r.close(c)
+	}
+	r.wg.Wait()
+}
+
+// collect compare the replayed requests of c with the recording
+func (r *replayer) collect(c *replayConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, result := range c.results {
+		recorded := c.recorded[result.request.Header().RequestID]
+		result.log(c.remoteAddr, recorded, r.redactor)
+
+		name := mongo.OpName(result.request)
+		stats, ok := r.stats[name]
+		if !ok {
+			stats = &replayStats{}
+			r.stats[name] = stats
+		}
+		stats.add(result, recorded)
+	}
+}
+
+// report write the latency and errors of the replay for each opCode
+func (r *replayer) report(out io.Writer) {
+	names := make([]string, 0, len(r.stats))
+	for name := range r.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tCOUNT\tSKIPPED\tERRORS\tRECORDED ERRORS\tRECORDED P50/P95/P99\tREPLAYED P50/P95/P99\tMEAN DIFF")
+	for _, name := range names {
+		stats := r.stats[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", name, stats.count, stats.skipped, stats.errors, stats.recordedErrors,
+			percentiles(stats.recorded), percentiles(stats.replayed), meanDiff(stats.recorded, stats.replayed))
+	}
+	w.Flush()
+}
+
+// replayClock schedules the requests at the recorded time divided by speed
+type replayClock struct {
+	speed float64
+	once  sync.Once
+	first time.Time
+	start time.Time
+}
+
+// begin sets the time of the first record, it is replayed immediately
+func (clock *replayClock) begin(t time.Time) {
+	clock.once.Do(func() {
+		clock.first = t
+		clock.start = time.Now()
+	})
+}
+
+// wait blocks until the request recorded at t should be sent
+func (clock *replayClock) wait(t time.Time) {
+	if clock.speed == 0 {
+		return
+	}
+	offset := time.Duration(float64(t.Sub(clock.first)) / clock.speed)
+	if d := time.Until(clock.start.Add(offset)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// replayResult is the outcome of replaying one request
+type replayResult struct {
+	request  mongo.Message
+	reply    mongo.Message
+	duration time.Duration
+	// err is set when the request could not be sent or no reply arrived
+	err    error
+	ok     bool
+	errMsg string
+	code   int32
+	// skipped is set for the authentication commands, which are not replayed
+	skipped bool
+}
+
+// failed reports whether the replayed request got an error
+func (result *replayResult) failed() bool {
+	return result.err != nil || (result.reply != nil && !result.ok)
+}
+
+// log write the replayed request redacted by redactor when it is set, differences
+// from the recorded exchange are warned
+func (result *replayResult) log(remoteAddr string, recorded *mongo.Exchange, redactor *mongo.Redactor) {
+	fields := log.Fields{
+		"time":   result.request.Received().Format(sink.TimeLayout),
+		"opCode": result.request.Header().OpCode,
+	}
+	if result.reply != nil {
+		fields["duration"] = result.duration.String()
+		fields["ok"] = result.ok
+	}
+	request, reply, errMsg := result.request, result.reply, result.errMsg
+	if redactor != nil {
+		request, errMsg = redactor.Message(request), redactor.String(errMsg)
+		if reply != nil {
+			reply = redactor.Message(reply)
+		}
+	}
+	if recorded != nil && recorded.Response != nil {
+		fields["recordedDuration"] = recorded.Duration.String()
+		fields["recordedOK"] = recorded.OK
+	}
+
+	switch {
+	case result.skipped:
+		log.WithFields(fields).Debugf("[%s] %s => not replayed, recorded authentication can't succeed again", remoteAddr, request)
+	case result.err != nil:
+		log.WithFields(fields).Errorf("[%s] %s => replay failed: %v", remoteAddr, request, result.err)
+	case result.reply != nil && !result.ok && (recorded == nil || recorded.OK):
+		fields["errmsg"] = errMsg
+		fields["code"] = result.code
+		log.WithFields(fields).Warningf("[%s] %s => %s", remoteAddr, request, reply)
+	case result.reply != nil && result.ok && recorded != nil && recorded.Response != nil && !recorded.OK:
+		fields["recordedErrmsg"] = recorded.ErrMsg
+		if redactor != nil {
+			fields["recordedErrmsg"] = redactor.String(recorded.ErrMsg)
+		}
+		fields["recordedCode"] = recorded.Code
+		log.WithFields(fields).Warningf("[%s] %s => %s", remoteAddr, request, reply)
+	default:
+		log.WithFields(fields).Debugf("[%s] %s => %v", remoteAddr, request, reply)
+	}
+}
+
+// replayStats holds the results of one opCode
+type replayStats struct {
+	count          int
+	skipped        int
+	errors         int
+	recordedErrors int
+	recorded       []time.Duration
+	replayed       []time.Duration
+}
+
+func (stats *replayStats) add(result *replayResult, recorded *mongo.Exchange) {
+	stats.count++
+	if result.skipped {
+		stats.skipped++
+		return
+	}
+	if result.failed() {
+		stats.errors++
+	}
+	if recorded != nil && recorded.Response != nil && !recorded.OK {
+		stats.recordedErrors++
+	}
+	// latencies are only compared for requests answered in both runs
+	if result.reply != nil && recorded != nil && recorded.Response != nil && recorded.Request != nil {
+		stats.recorded = append(stats.recorded, recorded.Duration)
+		stats.replayed = append(stats.replayed, result.duration)
+	}
+}
+
+// percentiles format p50, p95 and p99 of durations
+func percentiles(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1)+0.5)].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("%v/%v/%v", at(0.50), at(0.95), at(0.99))
+}
+
+// meanDiff format how much the mean of replayed differs from the mean of recorded
+func meanDiff(recorded, replayed []time.Duration) string {
+	if len(recorded) == 0 {
+		return "-"
+	}
+	var recordedSum, replayedSum time.Duration
+	for i := range recorded {
+		recordedSum += recorded[i]
+		replayedSum += replayed[i]
+	}
+	if recordedSum == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (float64(replayedSum)/float64(recordedSum)-1)*100)
+}
+
+// replayConn parses one recorded connection and sends its requests to the target in order
+type replayConn struct {
+	remoteAddr string
+	client     *mongo.Parser
+	server     *mongo.Parser
+	correlator *mongo.Correlator
+	// requests passes the recorded requests from the client parser to run
+	requests chan mongo.Message
+	done     chan struct{}
+
+	lock     sync.Mutex
+	recorded map[int32]*mongo.Exchange
+	// changed is closed and replaced when an exchange is recorded
+	changed chan struct{}
+	results []*replayResult
+}
+
+func newReplayConn(remoteAddr string) *replayConn {
+	c := &replayConn{
+		remoteAddr: remoteAddr,
+		requests:   make(chan mongo.Message, 1024),
+		done:       make(chan struct{}),
+		recorded:   make(map[int32]*mongo.Exchange),
+		changed:    make(chan struct{}),
+	}
+	c.correlator = mongo.NewCorrelator(remoteAddr, *timeout, c.addRecorded)
+	c.client = mongo.NewBlockingParser(remoteAddr, newRecorder(remoteAddr, func(msg mongo.Message) {
+		c.correlator.Request(msg)
+		c.requests <- msg
+	}))
+	c.server = mongo.NewBlockingParser(remoteAddr, newRecorder(remoteAddr, c.correlator.Response))
+	return c
+}
+
+func (c *replayConn) addRecorded(ex *mongo.Exchange) {
+	if ex.Request == nil {
+		return
+	}
+	c.lock.Lock()
+	c.recorded[ex.Request.Header().RequestID] = ex
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.lock.Unlock()
+}
+
+// close stop the parsers after the data written is parsed and wait until all the requests are replayed
+func (c *replayConn) close() {
+	c.client.Close()
+	c.server.Close()
+	c.client.Wait()
+	c.server.Wait()
+	c.correlator.Close()
+	close(c.requests)
+	<-c.done
+}
+
+// run send the requests to the target of r one by one, the next request is sent
+// after the reply of the previous one like a driver does. The cursor ids of
+// getMore and killCursors are replaced by those the target returned, the
+// authentication commands are skipped as the recorded conversations can't
+// succeed again, the connection authenticates with the credential of r instead
+func (c *replayConn) run(r *replayer) {
+	defer close(c.done)
+
+	conn, err := dialUpstream(r.target, r.dialTLS, *timeout)
+	if err != nil {
+		log.Errorf("[%s] connect to %s failed: %v\n", c.remoteAddr, r.target, err)
+		for msg := range c.requests {
+			c.results = append(c.results, &replayResult{request: msg, err: err})
+		}
+		return
+	}
+	defer conn.Close()
+
+	replies := make(chan mongo.Message, 16)
+	parser := mongo.NewBlockingParser(c.remoteAddr, newRecorder(c.remoteAddr, func(msg mongo.Message) {
+		select {
+		case replies <- msg:
+		case <-c.done:
+		}
+	}))
+	// closed is closed after the replies of the server are all parsed
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(parser, conn)
+		parser.Close()
+		parser.Wait()
+		close(closed)
+	}()
+
+	// broken is set once the connection can't be used anymore, the
+	// remaining requests are reported as failed
+	var broken error
+	if r.credential != nil {
+		if broken = c.authenticate(conn, replies, closed, r.credential); broken != nil {
+			log.Errorf("[%s] authenticate to %s failed: %v\n", c.remoteAddr, r.target, broken)
+		}
+	}
+	cursors := newReplayCursors(c)
+	for msg := range c.requests {
+		result := &replayResult{request: msg, err: broken}
+		c.results = append(c.results, result)
+		if broken != nil {
+			continue
+		}
+		if mongo.IsAuthCommand(msg) {
+			result.skipped = true
+			continue
+		}
+
+		r.clock.wait(msg.Received())
+		raw := msg.Raw()
+		if rewritten, ok := mongo.RewriteCursorIDs(msg, cursors.replayed); ok {
+			raw = rewritten
+		}
+		start := time.Now()
+		if _, err := conn.Write(raw); err != nil {
+			result.err, broken = err, err
+			continue
+		}
+		if !mongo.ExpectsReply(msg) {
+			continue
+		}
+		result.reply, result.err = waitReply(replies, closed, msg.Header().RequestID)
+		result.duration = time.Since(start)
+		if result.err == errReplayConnClosed {
+			broken = result.err
+		}
+		if result.reply != nil {
+			result.ok, result.errMsg, result.code = mongo.ReplyStatus(result.reply)
+			cursors.opened(msg.Header().RequestID, result.reply)
+		}
+	}
+}
+
+// authenticate run the conversation of credential on conn, before the recorded requests
+func (c *replayConn) authenticate(conn net.Conn, replies <-chan mongo.Message, closed <-chan struct{}, credential *mongo.Credential) error {
+	var requestID int32
+	return mongo.Authenticate(*credential, func(cmd bson.D) (mongo.Message, error) {
+		requestID++
+		raw, err := mongo.EncodeMsg(requestID, cmd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(raw); err != nil {
+			return nil, err
+		}
+		return waitReply(replies, closed, requestID)
+	})
+}
+
+// replayCursors maps the cursor ids of the recording to those returned by the
+// target for the same requests
+type replayCursors struct {
+	conn *replayConn
+	// ids are the replayed cursor ids by recorded cursor id
+	ids map[int64]int64
+	// pending are the replayed cursor ids by request id whose recorded reply is
+	// not parsed yet
+	pending map[int32]int64
+}
+
+func newReplayCursors(conn *replayConn) *replayCursors {
+	return &replayCursors{
+		conn:    conn,
+		ids:     make(map[int64]int64),
+		pending: make(map[int32]int64),
+	}
+}
+
+// opened add the cursor returned by the target to requestID
+func (cursors *replayCursors) opened(requestID int32, reply mongo.Message) {
+	if id := mongo.ReplyCursorID(reply); id != 0 {
+		cursors.pending[requestID] = id
+	}
+}
+
+// replayed returns the replayed cursor id of the recorded id, or id itself when
+// the cursor was not opened by a replayed request. The recorded replies are parsed
+// apart from the requests, so it waits for those still pending up to the timeout
+func (cursors *replayCursors) replayed(id int64) int64 {
+	if id == 0 {
+		return id
+	}
+	var timer *time.Timer
+	for {
+		changed := cursors.resolve()
+		if replayed, ok := cursors.ids[id]; ok {
+			return replayed
+		}
+		if len(cursors.pending) == 0 {
+			return id
+		}
+		if timer == nil {
+			timer = time.NewTimer(*timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			// the recorded replies are missing from the capture
+			cursors.pending = make(map[int32]int64)
+			return id
+		}
+	}
+}
+
+// resolve map the pending cursors whose recorded reply is parsed, it returns the
+// channel closed when the next exchange is recorded
+func (cursors *replayCursors) resolve() <-chan struct{} {
+	c := cursors.conn
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for requestID, replayed := range cursors.pending {
+		ex, ok := c.recorded[requestID]
+		if !ok {
+			continue
+		}
+		delete(cursors.pending, requestID)
+		if ex.Response == nil {
+			continue
+		}
+		if recorded := mongo.ReplyCursorID(ex.Response); recorded != 0 {
+			cursors.ids[recorded] = replayed
+		}
+	}
+	return c.changed
+}
+
+var errReplayConnClosed = errors.New("connection closed by server")
+
+// waitReply returns the reply to requestID, replies to other requests such as
+// the remaining replies of an exhaust cursor are skipped
+func waitReply(replies <-chan mongo.Message, closed <-chan struct{}, requestID int32) (mongo.Message, error) {
+	timer := time.NewTimer(*timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-replies:
+			if reply.Header().ResponseTo == requestID {
+				return reply, nil
+			}
+		case <-closed:
+			// the replies parsed before the connection was closed may not be read yet
+			for {
+				select {
+				case reply := <-replies:
+					if reply.Header().ResponseTo == requestID {
+						return reply, nil
+					}
+				default:
+					return nil, errReplayConnClosed
+				}
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("no reply after %v", *timeout)
+		}
+	}
+}
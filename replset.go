@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/ma6174/mgosniff/config"
+	"github.com/mylxsw/asteria/log"
+)
+
+// maxListenAttempts is how many ports are tried for the listener of a member
+const maxListenAttempts = 100
+
+var (
+	replSetMode   = flag.Bool("rs", false, "replica set mode, listen on the next ports of -l for each member in the hello replies and give their addresses to the clients")
+	advertiseHost = flag.String("advertise", "", "host of the member addresses given to the clients in replica set mode, the host of -l or localhost by default")
+)
+
+// replicaSet listens for each member of a replica set found in the hello and
+// isMaster replies, so the drivers connect to the members through the proxy
+type replicaSet struct {
+	// route is the route of the seed member, the connections to the other members share its output
+	route *route
+	// listenHost is the host of the route, the listeners of the members listen on it
+	listenHost string
+	// advertise is the host of the proxy addresses given to the clients
+	advertise string
+
+	lock sync.Mutex
+	// proxies are the proxy addresses given to the clients by member address
+	proxies  map[string]string
+	nextPort int
+}
+
+// newReplicaSet create the replica set of r, its seed member is the upstream
+// of c, the other members listen on the following ports
+func newReplicaSet(r *route, c config.Route) (*replicaSet, error) {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port: %s", port)
+	}
+	advertise := c.Advertise
+	if advertise == "" {
+		advertise = host
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			advertise = "localhost"
+		}
+	}
+	return &replicaSet{
+		route:      r,
+		listenHost: host,
+		advertise:  advertise,
+		proxies:    map[string]string{c.Upstream: net.JoinHostPort(advertise, port)},
+		nextPort:   portNum + 1,
+	}, nil
+}
+
+// rewriter returns the rewrite of the member addresses in the replies of upstream
+func (rs *replicaSet) rewriter(upstream string) func(field string, host string) string {
+	return func(field string, host string) string {
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		if addr, ok := rs.proxies[host]; ok {
+			return addr
+		}
+		if addr, ok := rs.proxies[upstream]; ok && field == "me" {
+			// the member the connection runs on, named differently than in the upstream
+			rs.proxies[host] = addr
+			return addr
+		}
+		addr, err := rs.listen(host)
+		if err != nil {
+			log.Errorf("listen for member %s failed, its clients bypass the proxy: %v", host, err)
+			return host
+		}
+		rs.proxies[host] = addr
+		return addr
+	}
+}
+
+// listen proxy member on the next free port and returns the address given to
+// the clients, rs.lock must be held
+func (rs *replicaSet) listen(member string) (string, error) {
+	var err error
+	for i := 0; i < maxListenAttempts; i++ {
+		port := strconv.Itoa(rs.nextPort)
+		rs.nextPort++
+		var ln net.Listener
+		if ln, err = rs.route.listen(net.JoinHostPort(rs.listenHost, port)); err != nil {
+			continue
+		}
+		log.Debugf("listen at %s, proxy to replica set member %s\n", ln.Addr(), member)
+		go accept(ln, rs.route, member)
+		return net.JoinHostPort(rs.advertise, port), nil
+	}
+	return "", err
+}
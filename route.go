@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ma6174/mgosniff/config"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/ma6174/mgosniff/sink"
+	"github.com/mylxsw/asteria/log"
+)
+
+var configFile = flag.String("c", "", "config file defining the routes, each with its listen address, dest addr, TLS and output, instead of -l, -d and the other flags of a route")
+
+// routeFlags are the flags of the route of -l and -d, the routes of -c are
+// only defined by the config file
+var routeFlags = map[string]bool{
+	"l": true, "d": true, "o": true, "j": true, "filter": true, "slow": true, "explain": true,
+	"redact": true, "redact-auth": true, "rs": true, "advertise": true,
+	"tls-cert": true, "tls-key": true, "tls-client-ca": true,
+	"upstream-tls": true, "upstream-ca": true, "upstream-cert": true, "upstream-key": true,
+	"upstream-sni": true, "upstream-insecure": true,
+}
+
+var errRouteClosed = errors.New("route closed")
+
+// route is a listener proxied to an upstream with its own output, the settings
+// of a route are replaced on reload without closing its connections
+type route struct {
+	// addr is the listen address, it identifies the route across reloads
+	addr string
+	// output receives the messages and exchanges of the connections of the route
+	output sink.Sink
+	// swap passes to the output of the current settings
+	swap *sink.Swap
+	// topology maps the members to their listeners in replica set mode
+	topology *replicaSet
+	// settings holds the current *routeSettings
+	settings atomic.Value
+
+	lock sync.Mutex
+	// listeners are the listener of the route and those of the replica set members
+	listeners []net.Listener
+	closed    bool
+}
+
+// routeSettings are what a reload of a route replaces, the connections read
+// them when they open
+type routeSettings struct {
+	config.Route
+	// listenerTLS is set when the listener accepts TLS clients
+	listenerTLS *tls.Config
+	// dialTLS is set when the proxy connects to the upstream with TLS
+	dialTLS *tls.Config
+	// explainer explains the slow operations when explain is set
+	explainer *explainer
+	output    sink.Sink
+}
+
+// flagRoute returns the route defined by the flags of the proxy
+func flagRoute() config.Route {
+	c := config.DefaultRoute()
+	c.Listen, c.Upstream = *listenAddr, *dstAddr
+	c.Output, c.JSON = *format, *jsonMode
+	c.Filter, c.Slow, c.Explain = *filterExpr, *slowThreshold, *explainSlow
+	c.Redact, c.RedactAuth = redactRules, *redactAuth
+	c.ReplicaSet, c.Advertise = *replSetMode, *advertiseHost
+	c.TLS = config.ListenerTLS{Cert: *tlsCert, Key: *tlsKey, ClientCA: *tlsClientCA}
+	c.UpstreamTLS = flagUpstreamTLS()
+	return c
+}
+
+// flagUpstreamTLS returns the TLS settings of the dest addr defined by the flags
+func flagUpstreamTLS() config.UpstreamTLS {
+	return config.UpstreamTLS{
+		Enabled:  *upstreamTLS || *upstreamCA != "" || *upstreamCert != "" || *upstreamSNI != "" || *upstreamInsecure,
+		CA:       *upstreamCA,
+		Cert:     *upstreamCert,
+		Key:      *upstreamKey,
+		SNI:      *upstreamSNI,
+		Insecure: *upstreamInsecure,
+	}
+}
+
+// newRoute load the certificates of a route and create its output
+func newRoute(c config.Route) (*route, error) {
+	settings, err := newRouteSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &route{addr: c.Listen, swap: sink.NewSwap(settings.output)}
+	r.output = withStats(r.swap)
+	r.settings.Store(settings)
+	if c.ReplicaSet {
+		if r.topology, err = newReplicaSet(r, c); err != nil {
+			return nil, routeError(c, err)
+		}
+	}
+	return r, nil
+}
+
+// newRouteSettings load the certificates of a route and create its output
+func newRouteSettings(c config.Route) (*routeSettings, error) {
+	s := &routeSettings{Route: c}
+	var err error
+	if c.TLS.Enabled() {
+		if s.listenerTLS, err = newListenerTLS(c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA); err != nil {
+			return nil, routeError(c, err)
+		}
+	}
+	if u := c.UpstreamTLS; u.Enabled {
+		if s.dialTLS, err = newDialTLS(u.CA, u.Cert, u.Key, u.SNI, u.Insecure); err != nil {
+			return nil, routeError(c, err)
+		}
+	}
+	if c.Slow > 0 && c.Explain {
+		s.explainer = newExplainer(c.Upstream, s.dialTLS)
+	}
+	if s.output, err = newOutput(c, s.explainer); err != nil {
+		return nil, routeError(c, err)
+	}
+	return s, nil
+}
+
+// routeError prefix err with the name of the route, routes defined by flags have none
+func routeError(c config.Route, err error) error {
+	if c.Name == "" {
+		return err
+	}
+	return fmt.Errorf("route %s: %v", c.Name, err)
+}
+
+// current returns the current settings of r
+func (r *route) current() *routeSettings {
+	return r.settings.Load().(*routeSettings)
+}
+
+// update replace the settings of r, the connections open keep their upstream
+// and the events they parse next go to the new output
+func (r *route) update(settings *routeSettings) {
+	prev := r.current()
+	r.settings.Store(settings)
+	r.swap.Set(settings.output)
+	if prev.explainer != nil {
+		prev.explainer.close()
+	}
+}
+
+// setupRoutes create the routes of -c, or the route of -l and -d when no
+// config file is given
+func setupRoutes() ([]*route, error) {
+	routes := []config.Route{flagRoute()}
+	if *configFile != "" {
+		var set []string
+		flag.Visit(func(f *flag.Flag) {
+			if routeFlags[f.Name] {
+				set = append(set, "-"+f.Name)
+			}
+		})
+		if len(set) > 0 {
+			return nil, fmt.Errorf("%s can't be used with -c, set them in the routes of the config file", strings.Join(set, ", "))
+		}
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		// the settings of the file take precedence over the flags
+		if cfg.Metrics != "" {
+			*metricsAddr = cfg.Metrics
+		}
+		if cfg.Admin != "" {
+			*adminAddr = cfg.Admin
+		}
+		if cfg.Digest > 0 {
+			*digestTop = cfg.Digest
+		}
+		if cfg.Timeout > 0 {
+			*timeout = cfg.Timeout
+		}
+		loadedConfig = cfg
+		routes = cfg.Routes
+	}
+
+	setupStats()
+	var rs []*route
+	for _, c := range routes {
+		r, err := newRoute(c)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// serve accept the connections of r and proxy them to its upstream, it only returns if it can't listen
+func serve(r *route) error {
+	ln, err := r.listen(r.addr)
+	if err != nil {
+		return err
+	}
+	accept(ln, r, "")
+	return nil
+}
+
+// listen on addr for the connections of r, the listener is closed with r
+func (r *route) listen(addr string) (net.Listener, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, errRouteClosed
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r.listeners = append(r.listeners, ln)
+	return ln, nil
+}
+
+// close stop accepting connections, the connections open keep going
+func (r *route) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	for _, ln := range r.listeners {
+		ln.Close()
+	}
+	r.listeners = nil
+	if explainer := r.current().explainer; explainer != nil {
+		explainer.close()
+	}
+}
+
+// accept proxy the connections of ln to upstream, or to the upstream of r when
+// it is empty, until ln is closed
+func accept(ln net.Listener, r *route, upstream string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if mongo.IsClosedErr(err) {
+				return
+			}
+			log.Errorf("accept connection failed: %v", err)
+			continue
+		}
+		go handleConn(conn, r, upstream)
+	}
+}
+
+// serveRoutes listen for all the routes before accepting on any, so a wrong
+// address is reported at start
+func serveRoutes(routes []*route) error {
+	listeners := make([]net.Listener, len(routes))
+	for i, r := range routes {
+		log.Debugf("%s listen at %s, proxy to mongodb server %s\n", os.Args[0], r.addr, r.current().Upstream)
+		var err error
+		if listeners[i], err = r.listen(r.addr); err != nil {
+			return err
+		}
+	}
+	running = make(map[string]*route)
+	for i, r := range routes {
+		running[r.addr] = r
+		go accept(listeners[i], r, "")
+	}
+	return nil
+}
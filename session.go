@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/ma6174/mgosniff/sink"
+	"github.com/mylxsw/asteria/log"
+)
+
+// session holds the parsers and the correlator of one client connection
+type session struct {
+	connID     uint64
+	remoteAddr string
+	client     *mongo.Parser
+	server     *mongo.Parser
+	correlator *mongo.Correlator
+	cursors    *mongo.CursorTracker
+	output     sink.Sink
+}
+
+// newSession create a session writing to output, the parsers of an offline
+// session never drop data
+func newSession(connID uint64, remoteAddr string, offline bool, output sink.Sink) *session {
+	newParser := mongo.NewParser
+	if offline {
+		newParser = mongo.NewBlockingParser
+	}
+
+	s := &session{connID: connID, remoteAddr: remoteAddr, output: output}
+	if c, ok := output.(sink.ConnSink); ok {
+		c.Open(connID, remoteAddr)
+	}
+	s.cursors = mongo.NewCursorTracker(remoteAddr, output.Cursor)
+	s.correlator = mongo.NewCorrelator(remoteAddr, *timeout, func(ex *mongo.Exchange) {
+		output.Exchange(ex)
+		s.cursors.Exchange(ex)
+	})
+	s.client = newParser(remoteAddr, newRecorder(remoteAddr, func(msg mongo.Message) {
+		output.Message(&sink.Event{ConnID: connID, RemoteAddr: remoteAddr, Direction: capture.ClientToServer, Message: msg})
+		s.correlator.Request(msg)
+	}))
+	s.server = newParser(remoteAddr, newRecorder(remoteAddr, func(msg mongo.Message) {
+		output.Message(&sink.Event{ConnID: connID, RemoteAddr: remoteAddr, Direction: capture.ServerToClient, Message: msg})
+		s.correlator.Response(msg)
+	}))
+	if metrics != nil {
+		metrics.Parsers(connID, s.client, s.server)
+	}
+	return s
+}
+
+// close stop the parsers after the data written is parsed, then report the
+// unanswered requests and the leaked cursors
+func (s *session) close() {
+	s.client.Close()
+	s.server.Close()
+	s.client.Wait()
+	s.server.Wait()
+	s.correlator.Close()
+	s.cursors.Close()
+	if c, ok := s.output.(sink.ConnSink); ok {
+		c.Close(s.connID, s.remoteAddr)
+	}
+
+	if writes, bytes := s.client.Dropped(); writes > 0 {
+		log.Warningf("[%s] parser fell behind, %d writes (%d bytes) from client dropped\n", s.remoteAddr, writes, bytes)
+	}
+	if writes, bytes := s.server.Dropped(); writes > 0 {
+		log.Warningf("[%s] parser fell behind, %d writes (%d bytes) from server dropped\n", s.remoteAddr, writes, bytes)
+	}
+}
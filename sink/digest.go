@@ -0,0 +1,171 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// maxSamples is the number of latencies kept for the percentiles of a shape,
+// beyond it they are sampled
+const maxSamples = 4096
+
+// ShapeStats is the aggregate of the operations with the same query shape
+type ShapeStats struct {
+	Fingerprint string
+	Shape       string
+	Count       int
+	Errors      int
+	// Total is the time spent in the operations and the getMore of their cursors
+	Total time.Duration
+	// Documents is the number of documents returned, including those of getMore
+	Documents int
+
+	// samples are the latencies of the operations, without getMore
+	samples []time.Duration
+}
+
+func (s *ShapeStats) add(d time.Duration) {
+	s.Count++
+	s.Total += d
+	if len(s.samples) < maxSamples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	// reservoir sampling keeps every latency with the same probability
+	if i := rand.Intn(s.Count); i < maxSamples {
+		s.samples[i] = d
+	}
+}
+
+// Percentile returns the latency below which p percent of the operations are
+func (s *ShapeStats) Percentile(p float64) time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(s.samples))
+	copy(sorted, s.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p/100)]
+}
+
+// Digest groups the operations by query shape, like pt-query-digest does for MySQL
+type Digest struct {
+	lock   sync.Mutex
+	shapes map[string]*ShapeStats
+	// cursors are the shapes of the operations which opened the cursors still open
+	cursors map[digestCursor]*ShapeStats
+}
+
+type digestCursor struct {
+	remoteAddr string
+	id         int64
+}
+
+// NewDigest create an empty digest
+func NewDigest() *Digest {
+	return &Digest{
+		shapes:  make(map[string]*ShapeStats),
+		cursors: make(map[digestCursor]*ShapeStats),
+	}
+}
+
+func (d *Digest) Message(ev *Event) {}
+
+// Exchange add an answered request to its shape, a getMore is added to the
+// shape of the operation which opened its cursor
+func (d *Digest) Exchange(ex *mongo.Exchange) {
+	if ex.Request == nil || ex.Response == nil {
+		return
+	}
+	op := mongo.Classify(ex.Request)
+	if op == nil {
+		return
+	}
+	id, documents := mongo.ReplyBatch(ex.Request, ex.Response)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if op.Command == "getMore" && len(op.CursorIDs) == 1 {
+		key := digestCursor{ex.RemoteAddr, op.CursorIDs[0]}
+		if stats, ok := d.cursors[key]; ok {
+			stats.Documents += documents
+			if ex.Sequence == 0 {
+				stats.Total += ex.Duration
+			}
+			if id == 0 {
+				delete(d.cursors, key)
+			}
+			return
+		}
+	}
+
+	fingerprint := op.Fingerprint()
+	stats, ok := d.shapes[fingerprint]
+	if !ok {
+		stats = &ShapeStats{Fingerprint: fingerprint, Shape: op.Shape()}
+		d.shapes[fingerprint] = stats
+	}
+	stats.Documents += documents
+	if ex.Sequence > 0 {
+		// a reply streamed to an exhaust request
+		return
+	}
+	stats.add(ex.Duration)
+	if !ex.OK {
+		stats.Errors++
+	}
+	if id != 0 {
+		d.cursors[digestCursor{ex.RemoteAddr, id}] = stats
+	}
+}
+
+// Cursor forget a cursor which was killed or leaked
+func (d *Digest) Cursor(c *mongo.Cursor) {
+	d.lock.Lock()
+	delete(d.cursors, digestCursor{c.RemoteAddr, c.ID})
+	d.lock.Unlock()
+}
+
+// Top returns the n shapes with the most total time, all shapes if n is 0
+func (d *Digest) Top(n int) []*ShapeStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	top := make([]*ShapeStats, 0, len(d.shapes))
+	for _, stats := range d.shapes {
+		copied := *stats
+		copied.samples = append([]time.Duration(nil), stats.samples...)
+		top = append(top, &copied)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Total != top[j].Total {
+			return top[i].Total > top[j].Total
+		}
+		return top[i].Fingerprint < top[j].Fingerprint
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Report write the n shapes with the most total time as a table
+func (d *Digest) Report(out io.Writer, n int) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tFINGERPRINT\tCOUNT\tERRORS\tTOTAL\tP50/P95/P99\tDOCS\tSHAPE")
+	for i, stats := range d.Top(n) {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%v\t%v/%v/%v\t%d\t%s\n",
+			i+1, stats.Fingerprint, stats.Count, stats.Errors, stats.Total.Round(time.Microsecond),
+			stats.Percentile(50).Round(time.Microsecond),
+			stats.Percentile(95).Round(time.Microsecond),
+			stats.Percentile(99).Round(time.Microsecond),
+			stats.Documents, stats.Shape)
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,134 @@
+package sink
+
+import (
+	"sync"
+
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/filter"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// Filter passes to Next the requests matching Expr with their replies, the
+// exchanges matching Expr and the cursors opened by a matching operation
+type Filter struct {
+	Next Sink
+	Expr *filter.Filter
+
+	lock sync.Mutex
+	// apps are the application names of the clients by address, read from their handshake
+	apps map[string]string
+	// passed are the requests passed by client address and RequestID, whose
+	// replies are passed too. The replies streamed to an exhaust request are
+	// passed by the RequestID of the reply they follow
+	passed map[string]map[int32]mongo.Message
+}
+
+// NewFilter create a filter sink
+func NewFilter(next Sink, expr *filter.Filter) *Filter {
+	return &Filter{
+		Next:   next,
+		Expr:   expr,
+		apps:   make(map[string]string),
+		passed: make(map[string]map[int32]mongo.Message),
+	}
+}
+
+func (f *Filter) Message(ev *Event) {
+	msg := ev.Message
+	if ev.Direction == capture.ClientToServer {
+		if op := mongo.Classify(msg); op != nil && op.AppName != "" {
+			f.lock.Lock()
+			f.apps[ev.RemoteAddr] = op.AppName
+			f.lock.Unlock()
+		}
+		if !f.Expr.MatchRequest(msg, ev.RemoteAddr, f.app(ev.RemoteAddr)) {
+			return
+		}
+		if mongo.ExpectsReply(msg) {
+			f.pass(ev.RemoteAddr, msg.Header().RequestID, msg)
+		}
+		f.Next.Message(ev)
+		return
+	}
+
+	f.lock.Lock()
+	req, passed := f.passed[ev.RemoteAddr][msg.Header().ResponseTo]
+	delete(f.passed[ev.RemoteAddr], msg.Header().ResponseTo)
+	f.lock.Unlock()
+	if !passed {
+		return
+	}
+	if mongo.MoreToCome(req, msg) {
+		// the next reply of the stream answers this one
+		f.pass(ev.RemoteAddr, msg.Header().RequestID, req)
+	}
+	f.Next.Message(ev)
+}
+
+func (f *Filter) Exchange(ex *mongo.Exchange) {
+	if f.Expr.MatchExchange(ex, f.app(ex.RemoteAddr)) {
+		f.Next.Exchange(ex)
+	}
+}
+
+func (f *Filter) Cursor(c *mongo.Cursor) {
+	if f.Expr.MatchCursor(c, f.app(c.RemoteAddr)) {
+		f.Next.Cursor(c)
+	}
+}
+
+func (f *Filter) Open(connID uint64, remoteAddr string) {
+	if c, ok := f.Next.(ConnSink); ok {
+		c.Open(connID, remoteAddr)
+	}
+}
+
+func (f *Filter) Close(connID uint64, remoteAddr string) {
+	f.lock.Lock()
+	delete(f.apps, remoteAddr)
+	delete(f.passed, remoteAddr)
+	f.lock.Unlock()
+	if c, ok := f.Next.(ConnSink); ok {
+		c.Close(connID, remoteAddr)
+	}
+}
+
+// carry copy the application names and passed requests of the connections
+// open on prev, a Filter replaced by f
+func (f *Filter) carry(prev Sink) {
+	p, ok := prev.(*Filter)
+	if !ok || p == f {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for remoteAddr, app := range p.apps {
+		f.apps[remoteAddr] = app
+	}
+	for remoteAddr, passed := range p.passed {
+		if f.passed[remoteAddr] == nil {
+			f.passed[remoteAddr] = make(map[int32]mongo.Message)
+		}
+		for requestID, req := range passed {
+			f.passed[remoteAddr][requestID] = req
+		}
+	}
+}
+
+func (f *Filter) app(remoteAddr string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.apps[remoteAddr]
+}
+
+// pass the reply to requestID of remoteAddr, req is the request which started the stream of replies
+func (f *Filter) pass(remoteAddr string, requestID int32, req mongo.Message) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.passed[remoteAddr] == nil {
+		f.passed[remoteAddr] = make(map[int32]mongo.Message)
+	}
+	f.passed[remoteAddr][requestID] = req
+}
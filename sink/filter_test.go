@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/filter"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// testSink records the request ids of the messages and the connections closed
+type testSink struct {
+	messages []int32
+	closed   []uint64
+}
+
+func (s *testSink) Message(ev *Event)                      { s.messages = append(s.messages, ev.Message.Header().RequestID) }
+func (s *testSink) Exchange(ex *mongo.Exchange)            {}
+func (s *testSink) Cursor(c *mongo.Cursor)                 {}
+func (s *testSink) Open(connID uint64, remoteAddr string)  {}
+func (s *testSink) Close(connID uint64, remoteAddr string) { s.closed = append(s.closed, connID) }
+
+// testMessage returns a legacy message of opCode with the header ids, int32,
+// int64 and string parts are written as such and cstring, documents as bson
+func testMessage(t *testing.T, requestID, responseTo, opCode int32, parts ...interface{}) mongo.Message {
+	b := make([]byte, 4*4)
+	for _, part := range parts {
+		switch part := part.(type) {
+		case int32:
+			var buf [4]byte
+			binary.LittleEndian.PutUint32(buf[:], uint32(part))
+			b = append(b, buf[:]...)
+		case int64:
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], uint64(part))
+			b = append(b, buf[:]...)
+		case string:
+			b = append(append(b, part...), 0)
+		default:
+			doc, err := bson.Marshal(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = append(b, doc...)
+		}
+	}
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(b[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(b[12:], uint32(opCode))
+
+	msg, err := mongo.ParseMessage(b, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestFilterLegacyExhaust(t *testing.T) {
+	const opReply, opQuery, exhaust = 1, 2004, 1 << 6
+	query := func(requestID int32, flags int32, ns string) mongo.Message {
+		return testMessage(t, requestID, 0, opQuery, flags, ns, int32(0), int32(0), bson.M{"status": "A"})
+	}
+	reply := func(requestID, responseTo int32, cursorID int64) mongo.Message {
+		return testMessage(t, requestID, responseTo, opReply, int32(0), cursorID, int32(0), int32(1), bson.M{"_id": 1})
+	}
+
+	expr, err := filter.Parse("db=shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &testSink{}
+	f := NewFilter(next, expr)
+	for _, ev := range []struct {
+		direction capture.Direction
+		msg       mongo.Message
+	}{
+		{capture.ClientToServer, query(1, exhaust, "shop.orders")},
+		// each reply of the stream answers the previous one
+		{capture.ServerToClient, reply(100, 1, 7)},
+		{capture.ServerToClient, reply(101, 100, 7)},
+		{capture.ServerToClient, reply(102, 101, 0)},
+		// the replies to a query not matching are dropped, exhaust or not
+		{capture.ClientToServer, query(2, exhaust, "other.orders")},
+		{capture.ServerToClient, reply(103, 2, 8)},
+		{capture.ServerToClient, reply(104, 103, 0)},
+		// without exhaust a reply with a cursor is the last one
+		{capture.ClientToServer, query(3, 0, "shop.orders")},
+		{capture.ServerToClient, reply(105, 3, 9)},
+		{capture.ServerToClient, reply(106, 105, 0)},
+	} {
+		f.Message(&Event{ConnID: 1, RemoteAddr: "10.0.0.1:52117", Direction: ev.direction, Message: ev.msg})
+	}
+
+	expected := []int32{1, 100, 101, 102, 3, 105}
+	if len(next.messages) != len(expected) {
+		t.Fatalf("passed %v, expect %v", next.messages, expected)
+	}
+	for i := range expected {
+		if next.messages[i] != expected[i] {
+			t.Fatalf("passed %v, expect %v", next.messages, expected)
+		}
+	}
+}
+
+func TestFilterClose(t *testing.T) {
+	expr, err := filter.Parse("slower=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &testSink{}
+	s := Sink(&Slow{Next: &Redact{Next: next, Redactor: &mongo.Redactor{}}})
+	s = NewFilter(s, expr)
+	s.(ConnSink).Open(1, "10.0.0.1:52117")
+	s.(ConnSink).Close(1, "10.0.0.1:52117")
+	if len(next.closed) != 1 || next.closed[0] != 1 {
+		t.Errorf("closed %v through filter, slow and redact", next.closed)
+	}
+}
+
+func TestFilterSwap(t *testing.T) {
+	const opReply, opQuery = 1, 2004
+	const remoteAddr = "10.0.0.1:52117"
+	isMaster := testMessage(t, 1, 0, opQuery, int32(0), "admin.$cmd", int32(0), int32(-1),
+		bson.D{{Name: "isMaster", Value: 1}, {Name: "client", Value: bson.M{"application": bson.M{"name": "shell"}}}})
+	find := testMessage(t, 2, 0, opQuery, int32(0), "shop.orders", int32(0), int32(0), bson.M{"status": "A"})
+	reply := testMessage(t, 100, 2, opReply, int32(0), int64(0), int32(0), int32(1), bson.M{"_id": 1})
+	newFilter := func(next Sink, expr string) *Filter {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewFilter(next, f)
+	}
+
+	next := &testSink{}
+	s := NewSwap(newFilter(next, "app=shell"))
+	s.Open(1, remoteAddr)
+	s.Message(&Event{ConnID: 1, RemoteAddr: remoteAddr, Direction: capture.ClientToServer, Message: isMaster})
+	s.Message(&Event{ConnID: 1, RemoteAddr: remoteAddr, Direction: capture.ClientToServer, Message: find})
+	// the reload happens while the find waits for its reply
+	s.Set(newFilter(next, "app=shell db=shop"))
+	s.Message(&Event{ConnID: 1, RemoteAddr: remoteAddr, Direction: capture.ServerToClient, Message: reply})
+	// the application name was sent before the reload
+	s.Message(&Event{ConnID: 1, RemoteAddr: remoteAddr, Direction: capture.ClientToServer, Message: find})
+
+	expected := []int32{1, 2, 100, 2}
+	if len(next.messages) != len(expected) {
+		t.Fatalf("passed %v, expect %v", next.messages, expected)
+	}
+	for i := range expected {
+		if next.messages[i] != expected[i] {
+			t.Fatalf("passed %v, expect %v", next.messages, expected)
+		}
+	}
+
+	s.Close(1, remoteAddr)
+	if f := s.current().(*Filter); len(f.apps) != 0 || len(f.passed) != 0 {
+		t.Errorf("state of a closed connection kept: %v %v", f.apps, f.passed)
+	}
+}
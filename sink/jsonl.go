@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/mylxsw/asteria/log"
+)
+
+// JSONLines writes every message as one JSON object per line, the body is
+// written as MongoDB Extended JSON, or as a string in the mongo shell syntax
+type JSONLines struct {
+	// Route is the name of the route written in every line, when set
+	Route string
+	mode  mongo.JSONMode
+	// exchanges is set when a line is written for each exchange instead of each message
+	exchanges bool
+	lock      sync.Mutex
+	enc       *json.Encoder
+}
+
+// NewJSONLines create a sink which writes to w with the documents rendered in mode
+func NewJSONLines(w io.Writer, mode mongo.JSONMode) *JSONLines {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSONLines{mode: mode, enc: enc}
+}
+
+// NewJSONExchanges create a sink which writes a line for each request with its
+// duration and reply status instead of a line for each message
+func NewJSONExchanges(w io.Writer, mode mongo.JSONMode) *JSONLines {
+	sink := NewJSONLines(w, mode)
+	sink.exchanges = true
+	return sink
+}
+
+type jsonEvent struct {
+	Time       string `json:"ts"`
+	Route      string `json:"route,omitempty"`
+	ConnID     uint64 `json:"connId"`
+	Client     string `json:"client"`
+	Direction  string `json:"direction"`
+	Op         string `json:"op"`
+	RequestID  int32  `json:"requestId"`
+	ResponseTo int32  `json:"responseTo"`
+	Namespace  string `json:"ns,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Compressor string `json:"compressor,omitempty"`
+	// Flags holds the names of the flag bits of OP_MSG
+	Flags []string `json:"flags,omitempty"`
+	// Summary and the fields after it are those of the classified operation of a request
+	Summary    string          `json:"summary,omitempty"`
+	Filter     json.RawMessage `json:"filter,omitempty"`
+	Projection json.RawMessage `json:"projection,omitempty"`
+	Sort       json.RawMessage `json:"sort,omitempty"`
+	Skip       int64           `json:"skip,omitempty"`
+	Limit      int64           `json:"limit,omitempty"`
+	Pipeline   json.RawMessage `json:"pipeline,omitempty"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (sink *JSONLines) Message(ev *Event) {
+	if sink.exchanges {
+		return
+	}
+	msg := ev.Message
+	event := &jsonEvent{
+		Time:       msg.Received().UTC().Format(time.RFC3339Nano),
+		Route:      sink.Route,
+		ConnID:     ev.ConnID,
+		Client:     ev.RemoteAddr,
+		Direction:  ev.Direction.String(),
+		Op:         mongo.OpName(msg),
+		RequestID:  msg.Header().RequestID,
+		ResponseTo: msg.Header().ResponseTo,
+		Namespace:  mongo.Namespace(msg),
+		Command:    mongo.CommandName(msg),
+		Body:       sink.json(messageBody(msg)),
+	}
+	if compression := msg.Compression(); compression != nil {
+		event.Compressor = compression.Compressor
+	}
+	if m, ok := msg.(*mongo.OpMsg); ok {
+		event.Flags = m.Flags()
+	}
+	if op := mongo.Classify(msg); op != nil {
+		event.Summary = op.Format(sink.mode)
+		if op.Filter != nil {
+			event.Filter = sink.json(op.Filter)
+		}
+		if op.Projection != nil {
+			event.Projection = sink.json(op.Projection)
+		}
+		if op.Sort != nil {
+			event.Sort = sink.json(op.Sort)
+		}
+		if op.Pipeline != nil {
+			event.Pipeline = sink.json(op.Pipeline)
+		}
+		event.Skip, event.Limit = op.Skip, op.Limit
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if err := sink.enc.Encode(event); err != nil {
+		log.Errorf("write event failed: %v", err)
+	}
+}
+
+// json render v in the mode of the sink
+func (sink *JSONLines) json(v interface{}) json.RawMessage {
+	b := json.RawMessage(mongo.ExtJSON(v, sink.mode))
+	if sink.mode == mongo.Shell {
+		// the shell syntax is not JSON
+		b, _ = json.Marshal(string(b))
+	}
+	return b
+}
+
+type jsonExchange struct {
+	Time       string          `json:"ts"`
+	Route      string          `json:"route,omitempty"`
+	Client     string          `json:"client"`
+	Op         string          `json:"op"`
+	RequestID  int32           `json:"requestId"`
+	Namespace  string          `json:"ns,omitempty"`
+	Command    string          `json:"command,omitempty"`
+	Summary    string          `json:"summary,omitempty"`
+	DurationMS float64         `json:"durationMs"`
+	Unanswered bool            `json:"unanswered,omitempty"`
+	OK         bool            `json:"ok"`
+	Code       int32           `json:"code,omitempty"`
+	ErrMsg     string          `json:"errmsg,omitempty"`
+	Plan       *jsonPlan       `json:"plan,omitempty"`
+	Request    json.RawMessage `json:"request"`
+}
+
+type jsonPlan struct {
+	Stages         []string `json:"stages"`
+	CollectionScan bool     `json:"collscan"`
+	KeysExamined   int64    `json:"keysExamined"`
+	DocsExamined   int64    `json:"docsExamined"`
+	Returned       int64    `json:"nReturned"`
+	ExecutionMS    int64    `json:"executionTimeMillis"`
+}
+
+// Exchange write a line with the request, its duration and the status of its
+// reply when the sink writes exchanges
+func (sink *JSONLines) Exchange(ex *mongo.Exchange) {
+	if !sink.exchanges || ex.Request == nil {
+		return
+	}
+	req := ex.Request
+	event := &jsonExchange{
+		Time:       req.Received().UTC().Format(time.RFC3339Nano),
+		Route:      sink.Route,
+		Client:     ex.RemoteAddr,
+		Op:         mongo.OpName(req),
+		RequestID:  req.Header().RequestID,
+		Namespace:  mongo.Namespace(req),
+		Command:    mongo.CommandName(req),
+		DurationMS: float64(ex.Duration) / float64(time.Millisecond),
+		Unanswered: ex.Unanswered,
+		OK:         ex.OK,
+		Code:       ex.Code,
+		ErrMsg:     ex.ErrMsg,
+		Request:    sink.json(messageBody(req)),
+	}
+	if op := mongo.Classify(req); op != nil {
+		event.Summary = op.Format(sink.mode)
+	}
+	if plan := ex.Plan; plan != nil {
+		event.Plan = &jsonPlan{
+			Stages:         plan.Stages,
+			CollectionScan: plan.CollectionScan(),
+			KeysExamined:   plan.KeysExamined,
+			DocsExamined:   plan.DocsExamined,
+			Returned:       plan.Returned,
+			ExecutionMS:    plan.ExecutionMilli,
+		}
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if err := sink.enc.Encode(event); err != nil {
+		log.Errorf("write event failed: %v", err)
+	}
+}
+
+type jsonCursor struct {
+	ID         int64   `json:"id"`
+	Namespace  string  `json:"ns"`
+	Command    string  `json:"command"`
+	State      string  `json:"state"`
+	Opened     string  `json:"opened"`
+	Documents  int     `json:"documents"`
+	Batches    int     `json:"batches"`
+	LifetimeMS float64 `json:"lifetimeMs"`
+}
+
+// Cursor write a line with the cursor object instead of the message fields
+func (sink *JSONLines) Cursor(c *mongo.Cursor) {
+	event := struct {
+		Time   string      `json:"ts"`
+		Route  string      `json:"route,omitempty"`
+		Client string      `json:"client"`
+		Cursor *jsonCursor `json:"cursor"`
+	}{
+		Time:   c.Closed.UTC().Format(time.RFC3339Nano),
+		Route:  sink.Route,
+		Client: c.RemoteAddr,
+		Cursor: &jsonCursor{
+			ID:         c.ID,
+			Namespace:  c.Namespace,
+			Command:    c.Command,
+			State:      string(c.State),
+			Opened:     c.Opened.UTC().Format(time.RFC3339Nano),
+			Documents:  c.Documents,
+			Batches:    c.Batches,
+			LifetimeMS: float64(c.Lifetime()) / float64(time.Millisecond),
+		},
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if err := sink.enc.Encode(event); err != nil {
+		log.Errorf("write event failed: %v", err)
+	}
+}
+
+// messageBody returns the fields of a message after the header, named as in
+// the wire protocol documentation, the sections of OP_MSG are merged into one command
+func messageBody(msg mongo.Message) bson.M {
+	switch m := msg.(type) {
+	case *mongo.OpQuery:
+		return bson.M{"flags": m.Flags, "fullCollectionName": m.FullCollectionName, "numberToSkip": m.NumberToSkip,
+			"numberToReturn": m.NumberToReturn, "query": m.Query, "returnFieldsSelector": m.ReturnFieldsSelector}
+	case *mongo.OpReply:
+		return bson.M{"responseFlags": m.ResponseFlags, "cursorID": m.CursorID, "startingFrom": m.StartingFrom,
+			"numberReturned": m.NumberReturned, "documents": m.Documents}
+	case *mongo.OpMsg:
+		return m.Command()
+	case *mongo.OpInsert:
+		return bson.M{"flags": m.Flags, "fullCollectionName": m.FullCollectionName, "documents": m.Documents}
+	case *mongo.OpUpdate:
+		return bson.M{"fullCollectionName": m.FullCollectionName, "flags": m.Flags, "selector": m.Selector, "update": m.Update}
+	case *mongo.OpDelete:
+		return bson.M{"fullCollectionName": m.FullCollectionName, "flags": m.Flags, "selector": m.Selector}
+	case *mongo.OpGetMore:
+		return bson.M{"fullCollectionName": m.FullCollectionName, "numberToReturn": m.NumberToReturn, "cursorID": m.CursorID}
+	case *mongo.OpKillCursors:
+		return bson.M{"cursorIDs": m.CursorIDs}
+	case *mongo.OpCommand:
+		return bson.M{"database": m.Database, "commandName": m.CommandName, "metadata": m.Metadata,
+			"commandArgs": m.CommandArgs, "inputDocs": m.InputDocs}
+	case *mongo.OpCommandReply:
+		return bson.M{"metadata": m.Metadata, "commandReply": m.CommandReply, "outputDocs": m.OutputDocs}
+	case *mongo.OpLegacyMsg:
+		return bson.M{"message": m.Message}
+	case *mongo.OpRaw:
+		return bson.M{"body": m.Body}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sink
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/mylxsw/asteria/log"
+)
+
+// Log writes every exchange as a log line
+type Log struct {
+	// Mode is how the documents of the messages are rendered
+	Mode mongo.JSONMode
+	// Route is the name of the route written with every line, when set
+	Route string
+}
+
+func (sink Log) Message(ev *Event) {}
+
+// Exchange write a request and its reply to log
+func (sink Log) Exchange(ex *mongo.Exchange) {
+	fields := sink.fields()
+	for _, msg := range []mongo.Message{ex.Response, ex.Request} {
+		if msg == nil {
+			continue
+		}
+		fields["time"] = msg.Received().Format(TimeLayout)
+		fields["opCode"] = msg.Header().OpCode
+		if compression := msg.Compression(); compression != nil {
+			fields["compressor"] = compression.Compressor
+			fields["compressionRatio"] = compression.Ratio
+		}
+	}
+
+	var request, response string
+	if ex.Request != nil {
+		request = sink.request(ex.Request)
+	}
+	if ex.Response != nil {
+		response = ex.Response.Format(sink.Mode)
+	}
+
+	switch {
+	case ex.Unanswered:
+		log.WithFields(fields).Warningf("[%s] %s => no reply", ex.RemoteAddr, request)
+	case ex.Response == nil:
+		log.WithFields(fields).Infof("[%s] %s", ex.RemoteAddr, request)
+	case ex.Request == nil:
+		log.WithFields(fields).Infof("[%s] unknown request => %s", ex.RemoteAddr, response)
+	default:
+		fields["duration"] = ex.Duration.String()
+		fields["ok"] = ex.OK
+		if ex.Sequence > 0 || ex.MoreToCome {
+			// one of the replies streamed to an exhaust request
+			fields["stream"] = ex.Sequence
+			fields["moreToCome"] = ex.MoreToCome
+		}
+		if !ex.OK {
+			fields["errmsg"] = ex.ErrMsg
+			fields["code"] = ex.Code
+		}
+		if ex.Plan != nil {
+			fields["plan"] = strings.Join(ex.Plan.Stages, " > ")
+			fields["keysExamined"] = ex.Plan.KeysExamined
+			fields["docsExamined"] = ex.Plan.DocsExamined
+			if ex.Plan.CollectionScan() {
+				log.WithFields(fields).Warningf("[%s] %s => %s", ex.RemoteAddr, request, response)
+				return
+			}
+		}
+		log.WithFields(fields).Infof("[%s] %s => %s", ex.RemoteAddr, request, response)
+	}
+}
+
+// request returns the summary of the operation of a request, or the whole
+// message when it is not classified
+func (sink Log) request(msg mongo.Message) string {
+	op := mongo.Classify(msg)
+	if op == nil {
+		return msg.Format(sink.Mode)
+	}
+	return fmt.Sprintf("%s id:%d %s", mongo.OpName(msg), msg.Header().RequestID, op.Format(sink.Mode))
+}
+
+// Cursor write the life of a cursor to log, leaked cursors are warned
+func (sink Log) Cursor(c *mongo.Cursor) {
+	fields := sink.fields()
+	fields["time"] = c.Closed.Format(TimeLayout)
+	fields["cursorID"] = c.ID
+	fields["ns"] = c.Namespace
+	fields["command"] = c.Command
+	fields["documents"] = c.Documents
+	fields["batches"] = c.Batches
+	fields["lifetime"] = c.Lifetime().String()
+	if c.State == mongo.CursorLeaked {
+		log.WithFields(fields).Warningf("[%s] cursor %d on %s leaked", c.RemoteAddr, c.ID, c.Namespace)
+		return
+	}
+	log.WithFields(fields).Infof("[%s] cursor %d on %s %s", c.RemoteAddr, c.ID, c.Namespace, c.State)
+}
+
+// fields returns the log fields every line of the sink starts with
+func (sink Log) fields() log.Fields {
+	if sink.Route == "" {
+		return log.Fields{}
+	}
+	return log.Fields{"route": sink.Route}
+}
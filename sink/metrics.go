@@ -0,0 +1,304 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricCommands are the command labels by lower case command name, the other
+// commands are counted as "other" so that clients can't add labels at will
+var metricCommands = make(map[string]string)
+
+func init() {
+	for _, name := range []string{
+		"find", "aggregate", "count", "distinct", "findAndModify", "insert", "update", "delete",
+		"getMore", "killCursors", "explain", "mapReduce", "createIndexes", "dropIndexes", "listIndexes",
+		"create", "drop", "dropDatabase", "renameCollection", "listCollections", "listDatabases",
+		"collStats", "dbStats", "hello", "isMaster", "ping", "buildInfo", "serverStatus", "getParameter",
+		"saslStart", "saslContinue", "authenticate", "logout", "endSessions", "commitTransaction",
+		"abortTransaction", "getLastError", "currentOp", "killOp", "replSetGetStatus", "connectionStatus",
+	} {
+		metricCommands[strings.ToLower(name)] = name
+	}
+}
+
+// maxNamespaceLabels is the number of namespaces the latencies are labeled
+// with, the requests on the namespaces seen later are labeled "other"
+const maxNamespaceLabels = 200
+
+// Metrics counts connections, messages, latencies and errors and serves them
+// in the Prometheus text format
+type Metrics struct {
+	// clientBytes and serverBytes are updated atomically on every proxied
+	// read, they come first to be 64-bit aligned
+	clientBytes uint64
+	serverBytes uint64
+
+	lock        sync.Mutex
+	active      int
+	connections uint64
+	// messages are counted by direction, opCode and command
+	messages    map[[3]string]uint64
+	namespaces  map[string]bool
+	latencies   map[[2]string]*histogram
+	replyErrors map[string]uint64
+	// parseErrors are counted by kind, decode or resync
+	parseErrors map[string]uint64
+	// parsers are the parsers of the open connections, their drops are added
+	// to dropped when the connection closes
+	parsers map[uint64][2]*mongo.Parser
+	dropped map[capture.Direction]uint64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// NewMetrics create metrics with every counter at zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messages:    make(map[[3]string]uint64),
+		namespaces:  make(map[string]bool),
+		latencies:   make(map[[2]string]*histogram),
+		replyErrors: make(map[string]uint64),
+		parseErrors: make(map[string]uint64),
+		parsers:     make(map[uint64][2]*mongo.Parser),
+		dropped:     make(map[capture.Direction]uint64),
+	}
+}
+
+func (m *Metrics) Open(connID uint64, remoteAddr string) {
+	m.lock.Lock()
+	m.active++
+	m.connections++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) Close(connID uint64, remoteAddr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.active--
+	if parsers, ok := m.parsers[connID]; ok {
+		delete(m.parsers, connID)
+		m.addDropped(m.dropped, parsers)
+	}
+}
+
+// Parsers watch the drops of the parsers of a connection until it is closed
+func (m *Metrics) Parsers(connID uint64, client *mongo.Parser, server *mongo.Parser) {
+	m.lock.Lock()
+	m.parsers[connID] = [2]*mongo.Parser{client, server}
+	m.lock.Unlock()
+}
+
+func (m *Metrics) addDropped(dropped map[capture.Direction]uint64, parsers [2]*mongo.Parser) {
+	for i, dir := range []capture.Direction{capture.ClientToServer, capture.ServerToClient} {
+		_, bytes := parsers[i].Dropped()
+		dropped[dir] += bytes
+	}
+}
+
+// Bytes count n bytes proxied in direction dir
+func (m *Metrics) Bytes(dir capture.Direction, n int) {
+	if dir == capture.ClientToServer {
+		atomic.AddUint64(&m.clientBytes, uint64(n))
+	} else {
+		atomic.AddUint64(&m.serverBytes, uint64(n))
+	}
+}
+
+// ParseError count an error of a parser, decode errors are counted apart from
+// the resynchronizations after data was dropped
+func (m *Metrics) ParseError(err error) {
+	kind := "resync"
+	if _, ok := err.(*mongo.DecodeError); ok {
+		kind = "decode"
+	}
+	m.lock.Lock()
+	m.parseErrors[kind]++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) Message(ev *Event) {
+	key := [3]string{ev.Direction.String(), mongo.OpName(ev.Message), ""}
+	if ev.Direction == capture.ClientToServer {
+		key[2] = commandLabel(mongo.CommandName(ev.Message))
+	}
+	m.lock.Lock()
+	m.messages[key]++
+	m.lock.Unlock()
+}
+
+// Exchange observe the latency of an answered request and count the errors of its reply
+func (m *Metrics) Exchange(ex *mongo.Exchange) {
+	if ex.Request == nil || ex.Response == nil || ex.Sequence > 0 {
+		return
+	}
+	command := mongo.CommandName(ex.Request)
+	if op := mongo.Classify(ex.Request); op != nil {
+		command = op.Command
+	}
+	ns := mongo.Namespace(ex.Request)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.namespaces[ns] {
+		if len(m.namespaces) < maxNamespaceLabels {
+			m.namespaces[ns] = true
+		} else {
+			ns = "other"
+		}
+	}
+	key := [2]string{commandLabel(command), ns}
+	h, ok := m.latencies[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[key] = h
+	}
+	h.observe(ex.Duration)
+	if !ex.OK {
+		m.replyErrors[strconv.Itoa(int(ex.Code))]++
+	}
+}
+
+func (m *Metrics) Cursor(c *mongo.Cursor) {}
+
+// ServeHTTP write the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeHeader(out, "mgosniff_connections_active", "gauge", "Client connections open.")
+	fmt.Fprintf(out, "mgosniff_connections_active %d\n", m.active)
+	writeHeader(out, "mgosniff_connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(out, "mgosniff_connections_total %d\n", m.connections)
+
+	writeHeader(out, "mgosniff_bytes_total", "counter", "Bytes proxied by direction.")
+	fmt.Fprintf(out, "mgosniff_bytes_total{direction=%s} %d\n", quoteLabel(capture.ClientToServer.String()), atomic.LoadUint64(&m.clientBytes))
+	fmt.Fprintf(out, "mgosniff_bytes_total{direction=%s} %d\n", quoteLabel(capture.ServerToClient.String()), atomic.LoadUint64(&m.serverBytes))
+
+	writeHeader(out, "mgosniff_messages_total", "counter", "Messages decoded by direction, opCode and command of requests.")
+	messages := make([][3]string, 0, len(m.messages))
+	for key := range m.messages {
+		messages = append(messages, key)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		return a[0] < b[0] || a[0] == b[0] && (a[1] < b[1] || a[1] == b[1] && a[2] < b[2])
+	})
+	for _, key := range messages {
+		fmt.Fprintf(out, "mgosniff_messages_total{direction=%s,op=%s,command=%s} %d\n",
+			quoteLabel(key[0]), quoteLabel(key[1]), quoteLabel(key[2]), m.messages[key])
+	}
+
+	writeHeader(out, "mgosniff_request_duration_seconds", "histogram", "Time from a request to its reply by command and namespace.")
+	keys := make([][2]string, 0, len(m.latencies))
+	for key := range m.latencies {
+		keys = append(keys, key)
+	}
+	sortPairs(keys)
+	for _, key := range keys {
+		h := m.latencies[key]
+		labels := fmt.Sprintf("command=%s,ns=%s", quoteLabel(key[0]), quoteLabel(key[1]))
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(out, "mgosniff_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(out, "mgosniff_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(out, "mgosniff_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "mgosniff_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	writeHeader(out, "mgosniff_reply_errors_total", "counter", "Replies with ok:0 or a query failure by error code.")
+	for _, code := range sortedStrings(m.replyErrors) {
+		fmt.Fprintf(out, "mgosniff_reply_errors_total{code=%s} %d\n", quoteLabel(code), m.replyErrors[code])
+	}
+
+	writeHeader(out, "mgosniff_parse_errors_total", "counter", "Messages the parsers failed to decode, and resynchronizations after dropped data.")
+	for _, kind := range []string{"decode", "resync"} {
+		fmt.Fprintf(out, "mgosniff_parse_errors_total{kind=%s} %d\n", quoteLabel(kind), m.parseErrors[kind])
+	}
+
+	dropped := make(map[capture.Direction]uint64)
+	for dir, n := range m.dropped {
+		dropped[dir] = n
+	}
+	for _, parsers := range m.parsers {
+		m.addDropped(dropped, parsers)
+	}
+	writeHeader(out, "mgosniff_parser_dropped_bytes_total", "counter", "Bytes not parsed because the parser fell behind, they are still proxied.")
+	for _, dir := range []capture.Direction{capture.ClientToServer, capture.ServerToClient} {
+		fmt.Fprintf(out, "mgosniff_parser_dropped_bytes_total{direction=%s} %d\n", quoteLabel(dir.String()), dropped[dir])
+	}
+}
+
+// commandLabel returns the label of command, "other" for the commands not in metricCommands
+func commandLabel(command string) string {
+	if command == "" {
+		return ""
+	}
+	if label, ok := metricCommands[strings.ToLower(command)]; ok {
+		return label
+	}
+	return "other"
+}
+
+func writeHeader(out *bufio.Writer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel returns a label value quoted and escaped as Prometheus expects
+func quoteLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+func sortPairs(keys [][2]string) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+}
+
+func sortedStrings(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+func TestCommandLabel(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"find":             "find",
+		"ismaster":         "isMaster",
+		"findandmodify":    "findAndModify",
+		"aCommandOfAnyone": "other",
+	}
+	for command, label := range tests {
+		if l := commandLabel(command); l != label {
+			t.Errorf("label of %q is %q, expect %q", command, l, label)
+		}
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	m := NewMetrics()
+	m.Bytes(capture.ClientToServer, 10)
+	m.Bytes(capture.ServerToClient, 20)
+	m.Bytes(capture.ServerToClient, 5)
+	reply := testMessage(t, 100, 1, 1, int32(0), int64(0), int32(0), int32(0))
+	for i := 0; i < maxNamespaceLabels+10; i++ {
+		query := testMessage(t, 1, 0, 2004, int32(0), fmt.Sprintf("db%d.$cmd", i), int32(0), int32(-1),
+			bson.D{{Name: "myCommand", Value: "users"}})
+		m.Message(&Event{Direction: capture.ClientToServer, Message: query})
+		m.Exchange(&mongo.Exchange{Request: query, Response: reply, OK: true})
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, line := range []string{
+		`mgosniff_bytes_total{direction="client->server"} 10`,
+		`mgosniff_bytes_total{direction="server->client"} 25`,
+		fmt.Sprintf(`mgosniff_messages_total{direction="client->server",op="QUERY",command="other"} %d`, maxNamespaceLabels+10),
+		`mgosniff_request_duration_seconds_count{command="other",ns="other"} 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("no line %s", line)
+		}
+	}
+	if n := strings.Count(out, "mgosniff_request_duration_seconds_count{"); n != maxNamespaceLabels+1 {
+		t.Errorf("%d latency series, expect %d", n, maxNamespaceLabels+1)
+	}
+}
@@ -0,0 +1,45 @@
+package sink
+
+import "github.com/ma6174/mgosniff/mongo"
+
+// Redact passes to Next copies of the messages and exchanges whose sensitive
+// values are removed by Redactor
+type Redact struct {
+	Next     Sink
+	Redactor *mongo.Redactor
+}
+
+func (r *Redact) Message(ev *Event) {
+	redacted := *ev
+	redacted.Message = r.Redactor.Message(ev.Message)
+	r.Next.Message(&redacted)
+}
+
+func (r *Redact) Exchange(ex *mongo.Exchange) {
+	redacted := *ex
+	if ex.Request != nil {
+		redacted.Request = r.Redactor.Message(ex.Request)
+	}
+	if ex.Response != nil {
+		redacted.Response = r.Redactor.Message(ex.Response)
+	}
+	// error messages such as duplicate key errors quote the values
+	redacted.ErrMsg = r.Redactor.ErrMsg(ex.ErrMsg)
+	r.Next.Exchange(&redacted)
+}
+
+func (r *Redact) Cursor(c *mongo.Cursor) {
+	r.Next.Cursor(c)
+}
+
+func (r *Redact) Open(connID uint64, remoteAddr string) {
+	if c, ok := r.Next.(ConnSink); ok {
+		c.Open(connID, remoteAddr)
+	}
+}
+
+func (r *Redact) Close(connID uint64, remoteAddr string) {
+	if c, ok := r.Next.(ConnSink); ok {
+		c.Close(connID, remoteAddr)
+	}
+}
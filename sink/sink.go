@@ -0,0 +1,83 @@
+// Package sink writes the messages and exchanges seen on proxied connections.
+package sink
+
+import (
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// TimeLayout is the layout of the time a message was received in log output
+const TimeLayout = "2006/01/02-15:04:05.000000"
+
+// Event is a message decoded on one direction of a connection
+type Event struct {
+	ConnID     uint64
+	RemoteAddr string
+	Direction  capture.Direction
+	Message    mongo.Message
+}
+
+// Sink receives the events and exchanges of all connections, the methods are
+// called from different goroutines
+type Sink interface {
+	// Message is called with every message in the order of each direction
+	Message(ev *Event)
+	// Exchange is called when a request is paired with its reply, or reported without one
+	Exchange(ex *mongo.Exchange)
+	// Cursor is called when a cursor is exhausted, killed, or leaked by a closed connection
+	Cursor(c *mongo.Cursor)
+}
+
+// ConnSink is implemented by sinks which follow the client connections
+type ConnSink interface {
+	// Open is called when a client connects
+	Open(connID uint64, remoteAddr string)
+	// Close is called after the last message and exchange of a connection
+	Close(connID uint64, remoteAddr string)
+}
+
+// Tee passes everything to each of its sinks in order
+type Tee []Sink
+
+func (t Tee) Message(ev *Event) {
+	for _, s := range t {
+		s.Message(ev)
+	}
+}
+
+func (t Tee) Exchange(ex *mongo.Exchange) {
+	for _, s := range t {
+		s.Exchange(ex)
+	}
+}
+
+func (t Tee) Cursor(c *mongo.Cursor) {
+	for _, s := range t {
+		s.Cursor(c)
+	}
+}
+
+func (t Tee) Open(connID uint64, remoteAddr string) {
+	for _, s := range t {
+		if c, ok := s.(ConnSink); ok {
+			c.Open(connID, remoteAddr)
+		}
+	}
+}
+
+func (t Tee) Close(connID uint64, remoteAddr string) {
+	for _, s := range t {
+		if c, ok := s.(ConnSink); ok {
+			c.Close(connID, remoteAddr)
+		}
+	}
+}
+
+// Discard drops everything, for when only reports such as the digest are wanted
+type Discard struct{}
+
+func (Discard) Message(ev *Event) {}
+
+func (Discard) Exchange(ex *mongo.Exchange) {}
+
+func (Discard) Cursor(c *mongo.Cursor) {}
@@ -0,0 +1,57 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/mylxsw/asteria/log"
+)
+
+// Slow passes to Next only the exchanges slower than Threshold and the requests
+// left without reply, the messages and cursors are dropped
+type Slow struct {
+	Next      Sink
+	Threshold time.Duration
+	// Explain returns the winning plan of a request, or nil if the request can't
+	// be explained, the exchange waits for it when it is set
+	Explain func(req mongo.Message) (*mongo.Plan, error)
+}
+
+func (s *Slow) Message(ev *Event) {}
+
+func (s *Slow) Exchange(ex *mongo.Exchange) {
+	if ex.Request == nil || ex.Sequence > 0 {
+		return
+	}
+	if !ex.Unanswered && (ex.Response == nil || ex.Duration < s.Threshold) {
+		return
+	}
+	if s.Explain == nil || ex.Unanswered || !ex.OK {
+		s.Next.Exchange(ex)
+		return
+	}
+
+	go func() {
+		plan, err := s.Explain(ex.Request)
+		if err != nil {
+			log.Warningf("[%s] explain slow operation failed: %v", ex.RemoteAddr, err)
+		}
+		slow := *ex
+		slow.Plan = plan
+		s.Next.Exchange(&slow)
+	}()
+}
+
+func (s *Slow) Cursor(c *mongo.Cursor) {}
+
+func (s *Slow) Open(connID uint64, remoteAddr string) {
+	if c, ok := s.Next.(ConnSink); ok {
+		c.Open(connID, remoteAddr)
+	}
+}
+
+func (s *Slow) Close(connID uint64, remoteAddr string) {
+	if c, ok := s.Next.(ConnSink); ok {
+		c.Close(connID, remoteAddr)
+	}
+}
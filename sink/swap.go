@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"sync"
+
+	"github.com/ma6174/mgosniff/mongo"
+)
+
+// Swap passes everything to a sink which can be replaced while the connections
+// are open, the events parsed after Set go to the new sink
+type Swap struct {
+	lock sync.RWMutex
+	next Sink
+	// conns are the open connections, they are opened on the new sink by Set
+	conns map[uint64]string
+}
+
+// connState is a sink keeping state about the open connections, it takes the
+// state of the sink it replaces so the connections open keep it across a Set
+type connState interface {
+	carry(prev Sink)
+}
+
+// NewSwap create a swap passing to next
+func NewSwap(next Sink) *Swap {
+	return &Swap{next: next, conns: make(map[uint64]string)}
+}
+
+// Set replace the sink, the open connections are closed on the old sink and
+// opened on the new one
+func (s *Swap) Set(next Sink) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.next
+	s.next = next
+	if c, ok := next.(connState); ok {
+		c.carry(prev)
+	}
+	for connID, remoteAddr := range s.conns {
+		if c, ok := prev.(ConnSink); ok {
+			c.Close(connID, remoteAddr)
+		}
+		if c, ok := next.(ConnSink); ok {
+			c.Open(connID, remoteAddr)
+		}
+	}
+}
+
+func (s *Swap) current() Sink {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.next
+}
+
+func (s *Swap) Message(ev *Event) {
+	s.current().Message(ev)
+}
+
+func (s *Swap) Exchange(ex *mongo.Exchange) {
+	s.current().Exchange(ex)
+}
+
+func (s *Swap) Cursor(c *mongo.Cursor) {
+	s.current().Cursor(c)
+}
+
+func (s *Swap) Open(connID uint64, remoteAddr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.conns[connID] = remoteAddr
+	if c, ok := s.next.(ConnSink); ok {
+		c.Open(connID, remoteAddr)
+	}
+}
+
+func (s *Swap) Close(connID uint64, remoteAddr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, connID)
+	if c, ok := s.next.(ConnSink); ok {
+		c.Close(connID, remoteAddr)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// handshakeTimeout is how long a TLS client has to complete its handshake
+const handshakeTimeout = 10 * time.Second
+
+var (
+	tlsCert          = flag.String("tls-cert", "", "accept TLS clients with this certificate in PEM, -tls-key is its private key")
+	tlsKey           = flag.String("tls-key", "", "private key in PEM of -tls-cert")
+	tlsClientCA      = flag.String("tls-client-ca", "", "require client certificates signed by these CA certificates in PEM")
+	upstreamTLS      = flag.Bool("upstream-tls", false, "connect to the dest addr with TLS")
+	upstreamCA       = flag.String("upstream-ca", "", "verify the dest addr with these CA certificates in PEM instead of the system ones")
+	upstreamCert     = flag.String("upstream-cert", "", "client certificate in PEM sent to the dest addr, -upstream-key is its private key")
+	upstreamKey      = flag.String("upstream-key", "", "private key in PEM of -upstream-cert")
+	upstreamSNI      = flag.String("upstream-sni", "", "server name sent to the dest addr and verified in its certificate, the host of -d by default")
+	upstreamInsecure = flag.Bool("upstream-insecure", false, "don't verify the certificate of the dest addr")
+)
+
+// addTLSFlags add the TLS flags of the proxy to the flags of a command
+func addTLSFlags(fs *flag.FlagSet) {
+	fs.StringVar(tlsCert, "tls-cert", "", "accept TLS clients with this certificate in PEM, -tls-key is its private key")
+	fs.StringVar(tlsKey, "tls-key", "", "private key in PEM of -tls-cert")
+	fs.StringVar(tlsClientCA, "tls-client-ca", "", "require client certificates signed by these CA certificates in PEM")
+	addUpstreamTLSFlags(fs)
+}
+
+// addUpstreamTLSFlags add the flags of the TLS connections to the dest addr to the flags of a command
+func addUpstreamTLSFlags(fs *flag.FlagSet) {
+	fs.BoolVar(upstreamTLS, "upstream-tls", false, "connect to the dest addr with TLS")
+	fs.StringVar(upstreamCA, "upstream-ca", "", "verify the dest addr with these CA certificates in PEM instead of the system ones")
+	fs.StringVar(upstreamCert, "upstream-cert", "", "client certificate in PEM sent to the dest addr, -upstream-key is its private key")
+	fs.StringVar(upstreamKey, "upstream-key", "", "private key in PEM of -upstream-cert")
+	fs.StringVar(upstreamSNI, "upstream-sni", "", "server name sent to the dest addr and verified in its certificate, the host of -d by default")
+	fs.BoolVar(upstreamInsecure, "upstream-insecure", false, "don't verify the certificate of the dest addr")
+}
+
+// newListenerTLS create the TLS config of a listener, client certificates are
+// required and verified when clientCA is set
+func newListenerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS listener needs both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate failed: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		if config.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// newDialTLS create the TLS config of the connections to an upstream, the
+// system CA certificates are used when ca is empty
+func newDialTLS(ca, certFile, keyFile, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure, MinVersion: tls.VersionTLS12}
+	var err error
+	if ca != "" {
+		if config.RootCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate failed: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no CA certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// dialUpstream connect to addr, with TLS when config is set, the TLS
+// handshake is done before it returns
+func dialUpstream(addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if config == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
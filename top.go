@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ma6174/mgosniff/capture"
+	"github.com/ma6174/mgosniff/mongo"
+	"github.com/ma6174/mgosniff/sink"
+	"github.com/mylxsw/asteria/level"
+	"github.com/mylxsw/asteria/log"
+)
+
+const (
+	// clearScreen move the cursor home and clear the terminal
+	clearScreen = "\x1b[H\x1b[2J"
+	hideCursor  = "\x1b[?25l"
+	showCursor  = "\x1b[?25h"
+	// maxOperationWidth is where the operations of the dashboard are cut
+	maxOperationWidth = 120
+)
+
+// runTop run the proxy and show what goes through it in a dashboard refreshed
+// every interval instead of the log
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	fs.StringVar(listenAddr, "l", ":7017", "listen port")
+	fs.StringVar(dstAddr, "d", "127.0.0.1:27017", "proxy to dest addr")
+	fs.DurationVar(timeout, "t", mongo.DefaultReplyTimeout, "report requests without reply after this timeout")
+	interval := fs.Duration("i", time.Second, "refresh interval")
+	rows := fs.Int("n", 10, "rows of each table")
+	addTLSFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s top [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	r, err := newRoute(flagRoute())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// the dashboard takes the whole terminal
+	log.SetDefaultLevel(level.Emergency)
+	board := newDashboard()
+	r.output = board
+
+	fmt.Print(hideCursor)
+	exitHooks = append(exitHooks, func() { fmt.Print(showCursor) })
+	handleExitSignals()
+	go func() {
+		if err := serve(r); err != nil {
+			fmt.Print(showCursor)
+			fmt.Fprintf(os.Stderr, "listen failed: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	for range time.Tick(*interval) {
+		var buf bytes.Buffer
+		buf.WriteString(clearScreen)
+		board.render(&buf, *rows)
+		_, _ = os.Stdout.Write(buf.Bytes())
+	}
+}
+
+// dashboard counts the operations of all connections between two refreshes
+type dashboard struct {
+	lock  sync.Mutex
+	since time.Time
+	// ops are the requests by opCode and command
+	ops        map[string]int
+	namespaces map[string]int
+	replies    int
+	errors     int
+	// errorCodes are the errors by code and message
+	errorCodes map[string]int
+	inflight   map[inflightKey]*inflightOp
+	conns      map[uint64]*topConn
+}
+
+type inflightKey struct {
+	remoteAddr string
+	requestID  int32
+}
+
+// inflightOp is a request waiting for its reply
+type inflightOp struct {
+	remoteAddr string
+	operation  string
+	sent       time.Time
+}
+
+// topConn is a client connection
+type topConn struct {
+	remoteAddr string
+	appName    string
+	opened     time.Time
+	ops        int
+}
+
+func newDashboard() *dashboard {
+	return &dashboard{
+		since:      time.Now(),
+		ops:        make(map[string]int),
+		namespaces: make(map[string]int),
+		errorCodes: make(map[string]int),
+		inflight:   make(map[inflightKey]*inflightOp),
+		conns:      make(map[uint64]*topConn),
+	}
+}
+
+func (b *dashboard) Open(connID uint64, remoteAddr string) {
+	b.lock.Lock()
+	b.conns[connID] = &topConn{remoteAddr: remoteAddr, opened: time.Now()}
+	b.lock.Unlock()
+}
+
+func (b *dashboard) Close(connID uint64, remoteAddr string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.conns, connID)
+	for key := range b.inflight {
+		if key.remoteAddr == remoteAddr {
+			delete(b.inflight, key)
+		}
+	}
+}
+
+// Message count the requests and keep those expecting a reply in flight
+func (b *dashboard) Message(ev *sink.Event) {
+	if ev.Direction != capture.ClientToServer {
+		return
+	}
+	msg := ev.Message
+	op := mongo.Classify(msg)
+
+	name, operation := mongo.OpName(msg), mongo.OpName(msg)
+	if command := mongo.CommandName(msg); command != "" {
+		name += " " + command
+	}
+	if op != nil {
+		operation = op.String()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ops[name]++
+	if ns := mongo.Namespace(msg); ns != "" {
+		b.namespaces[ns]++
+	}
+	if conn, ok := b.conns[ev.ConnID]; ok {
+		conn.ops++
+		if op != nil && op.AppName != "" {
+			conn.appName = op.AppName
+		}
+	}
+	if mongo.ExpectsReply(msg) {
+		key := inflightKey{ev.RemoteAddr, msg.Header().RequestID}
+		b.inflight[key] = &inflightOp{remoteAddr: ev.RemoteAddr, operation: operation, sent: time.Now()}
+	}
+}
+
+func (b *dashboard) Exchange(ex *mongo.Exchange) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ex.Request != nil {
+		delete(b.inflight, inflightKey{ex.RemoteAddr, ex.Request.Header().RequestID})
+	}
+	if ex.Request == nil || ex.Response == nil || ex.Sequence > 0 {
+		return
+	}
+	b.replies++
+	if !ex.OK {
+		b.errors++
+		b.errorCodes[fmt.Sprintf("%d %s", ex.Code, ex.ErrMsg)]++
+	}
+}
+
+func (b *dashboard) Cursor(c *mongo.Cursor) {}
+
+// render write the dashboard and start counting the next interval
+func (b *dashboard) render(out io.Writer, rows int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	seconds := now.Sub(b.since).Seconds()
+
+	total := 0
+	for _, n := range b.ops {
+		total += n
+	}
+	errorRate := 0.0
+	if b.replies > 0 {
+		errorRate = float64(b.errors) / float64(b.replies) * 100
+	}
+	fmt.Fprintf(out, "mgosniff top - %s -> %s  %s  connections: %d\n", *listenAddr, *dstAddr, now.Format("15:04:05"), len(b.conns))
+	fmt.Fprintf(out, "ops/sec: %.1f  in flight: %d  errors: %.1f%% (%d of %d replies)\n\n",
+		float64(total)/seconds, len(b.inflight), errorRate, b.errors, b.replies)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPS/SEC\tOPERATION")
+	for _, c := range topCounts(b.ops, rows) {
+		fmt.Fprintf(w, "%.1f\t%s\n", float64(c.n)/seconds, c.key)
+	}
+	fmt.Fprintln(w, "\t")
+	fmt.Fprintln(w, "OPS/SEC\tNAMESPACE")
+	for _, c := range topCounts(b.namespaces, rows) {
+		fmt.Fprintf(w, "%.1f\t%s\n", float64(c.n)/seconds, c.key)
+	}
+	_ = w.Flush()
+
+	inflight := make([]*inflightOp, 0, len(b.inflight))
+	for _, op := range b.inflight {
+		inflight = append(inflight, op)
+	}
+	sort.Slice(inflight, func(i, j int) bool { return inflight[i].sent.Before(inflight[j].sent) })
+	if len(inflight) > rows {
+		inflight = inflight[:rows]
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUNNING\tCLIENT\tSLOWEST IN FLIGHT")
+	for _, op := range inflight {
+		fmt.Fprintf(w, "%v\t%s\t%s\n", now.Sub(op.sent).Round(time.Millisecond), op.remoteAddr, cut(op.operation, maxOperationWidth))
+	}
+	_ = w.Flush()
+
+	conns := make([]*topConn, 0, len(b.conns))
+	for _, conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ops > conns[j].ops })
+	if len(conns) > rows {
+		conns = conns[:rows]
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tAPP\tOPS\tCONNECTED")
+	for _, conn := range conns {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%v\n", conn.remoteAddr, conn.appName, conn.ops, now.Sub(conn.opened).Round(time.Second))
+	}
+	_ = w.Flush()
+
+	if len(b.errorCodes) > 0 {
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ERRORS/SEC\tCODE ERRMSG")
+		for _, c := range topCounts(b.errorCodes, rows) {
+			fmt.Fprintf(w, "%.1f\t%s\n", float64(c.n)/seconds, cut(c.key, maxOperationWidth))
+		}
+		_ = w.Flush()
+	}
+
+	b.since = now
+	b.ops = make(map[string]int)
+	b.namespaces = make(map[string]int)
+	b.errorCodes = make(map[string]int)
+	b.replies, b.errors = 0, 0
+}
+
+type count struct {
+	key string
+	n   int
+}
+
+// topCounts returns the n largest counts
+func topCounts(counts map[string]int, n int) []count {
+	sorted := make([]count, 0, len(counts))
+	for key, c := range counts {
+		sorted = append(sorted, count{key, c})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// cut s to width characters
+func cut(s string, width int) string {
+	r := []rune(strings.Replace(s, "\n", " ", -1))
+	if len(r) <= width {
+		return string(r)
+	}
+	return string(r[:width-3]) + "..."
+}